@@ -4,6 +4,7 @@ import { ConfigModule, ConfigService } from '@nestjs/config';
 import { Logger } from '@nestjs/common';
 import { User } from '../entities/user.entity';
 import { Mail } from '../entities/mail.entity';
+import { Message } from '../entities/message.entity';
 
 @Module({
   imports: [
@@ -48,8 +49,10 @@ import { Mail } from '../entities/mail.entity';
                 ? { rejectUnauthorized: true }
                 : { rejectUnauthorized: false }
               : false,
-          entities: [User, Mail],
-          synchronize: true, // In production use migrations
+          entities: [User, Mail, Message],
+          // The schema is owned by postsmtp's versioned migrations
+          // (postsmtp migrate up), the entities only map it
+          synchronize: false,
           logging: false,
           retryAttempts: 5,
           retryDelay: 3000, // 3 seconds
@@ -4,8 +4,12 @@ import {
   PrimaryColumn,
   CreateDateColumn,
   Index,
+  ManyToOne,
+  JoinColumn,
 } from 'typeorm';
+import { Message } from './message.entity';
 
+// One row per recipient mailbox, linking it to the message it received
 @Entity('mail')
 export class Mail {
   @PrimaryColumn({ type: 'uuid' })
@@ -15,16 +19,13 @@ export class Mail {
   @Index()
   recipient: string;
 
-  @Column({ type: 'varchar', length: 255 })
-  sender: string;
-
-  @Column({ type: 'jsonb' })
-  headers: Record<string, any>;
+  @Column({ name: 'message_uid', type: 'uuid' })
+  messageUid: string;
 
-  @Column({ type: 'text' })
-  message: string;
+  @ManyToOne(() => Message, { onDelete: 'CASCADE' })
+  @JoinColumn({ name: 'message_uid' })
+  message: Message;
 
-  @CreateDateColumn()
+  @CreateDateColumn({ name: 'created_at' })
   createdAt: Date;
 }
-
@@ -0,0 +1,27 @@
+import { Entity, Column, PrimaryColumn, CreateDateColumn, Index } from 'typeorm';
+
+// Content of a message, stored once however many recipients it has.
+// postsmtp also stores the MIME tree and raw source, which the backend
+// does not read
+@Entity('messages')
+export class Message {
+  @PrimaryColumn({ type: 'uuid' })
+  uid: string;
+
+  @Column({ type: 'varchar', length: 255 })
+  @Index()
+  sender: string;
+
+  @Column({ type: 'jsonb' })
+  headers: Record<string, any>;
+
+  @Column({ type: 'text' })
+  body: string;
+
+  // HTML body stored by postsmtp, null for plain text mail
+  @Column({ type: 'text', nullable: true })
+  html: string | null;
+
+  @CreateDateColumn({ name: 'created_at' })
+  createdAt: Date;
+}
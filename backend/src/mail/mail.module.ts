@@ -5,11 +5,12 @@ import { ConfigModule, ConfigService } from '@nestjs/config';
 import { MailController } from './mail.controller';
 import { MailService } from './mail.service';
 import { Mail } from '../entities/mail.entity';
+import { Message } from '../entities/message.entity';
 import { AuthModule } from '../auth/auth.module';
 
 @Module({
   imports: [
-    TypeOrmModule.forFeature([Mail]),
+    TypeOrmModule.forFeature([Mail, Message]),
     AuthModule,
     JwtModule.registerAsync({
       imports: [ConfigModule],
@@ -7,10 +7,26 @@ import { promisify } from 'util';
 import { join } from 'path';
 import { platform } from 'os';
 import { Mail } from '../entities/mail.entity';
+import { Message } from '../entities/message.entity';
 import { SendMailDto } from './dto/send-mail.dto';
 
 const execFileAsync = promisify(execFile);
 
+// Flattens a mail row and its message into the shape the API has always
+// returned
+function toEmail(mail: Mail) {
+  return {
+    uid: mail.uid,
+    recipient: mail.recipient,
+    sender: mail.message.sender,
+    headers: mail.message.headers,
+    message: mail.message.body,
+    html: mail.message.html,
+    messageUid: mail.messageUid,
+    createdAt: mail.createdAt,
+  };
+}
+
 @Injectable()
 export class MailService {
   private readonly logger = new Logger(MailService.name);
@@ -44,10 +60,13 @@ export class MailService {
     }
 
     this.logger.log(`Getting emails for user: ${recipientEmail}`);
-    const emails = await this.mailRepository.find({
-      where: { recipient: recipientEmail },
-      order: { createdAt: 'DESC' },
-    });
+    const emails = (
+      await this.mailRepository.find({
+        where: { recipient: recipientEmail },
+        relations: { message: true },
+        order: { createdAt: 'DESC' },
+      })
+    ).map(toEmail);
 
     this.logger.log(`Found ${emails.length} emails for recipient: ${recipientEmail}`);
     return {
@@ -57,10 +76,13 @@ export class MailService {
   }
 
   async getSentEmailsForUser(senderEmail: string) {
-    const emails = await this.mailRepository.find({
-      where: { sender: senderEmail },
-      order: { createdAt: 'DESC' },
-    });
+    const emails = (
+      await this.mailRepository.find({
+        where: { message: { sender: senderEmail } },
+        relations: { message: true },
+        order: { createdAt: 'DESC' },
+      })
+    ).map(toEmail);
 
     return {
       emails,
@@ -69,15 +91,21 @@ export class MailService {
   }
 
   async searchEmailsForUser(userEmail: string, query: string) {
-    const inboxEmails = await this.mailRepository.find({
-      where: { recipient: userEmail },
-      order: { createdAt: 'DESC' },
-    });
-
-    const sentEmails = await this.mailRepository.find({
-      where: { sender: userEmail },
-      order: { createdAt: 'DESC' },
-    });
+    const inboxEmails = (
+      await this.mailRepository.find({
+        where: { recipient: userEmail },
+        relations: { message: true },
+        order: { createdAt: 'DESC' },
+      })
+    ).map(toEmail);
+
+    const sentEmails = (
+      await this.mailRepository.find({
+        where: { message: { sender: userEmail } },
+        relations: { message: true },
+        order: { createdAt: 'DESC' },
+      })
+    ).map(toEmail);
 
     const allEmails = [...inboxEmails, ...sentEmails];
 
@@ -116,13 +144,14 @@ export class MailService {
     this.logger.log(`Getting email by ID: ${uid} for recipient: ${recipientEmail}`);
     const email = await this.mailRepository.findOne({
       where: { uid, recipient: recipientEmail },
+      relations: { message: true },
     });
 
     if (!email) {
       throw new NotFoundException('Email not found');
     }
 
-    return email;
+    return toEmail(email);
   }
 
   async sendEmail(sendMailDto: SendMailDto & { sender: string }) {
@@ -140,19 +169,30 @@ export class MailService {
       ...headers,
     };
 
-    // Create mail record in database
-    const mail = this.mailRepository.create({
-      uid,
-      recipient,
-      sender,
-      headers: emailHeaders,
-      message,
+    // Store the message and the recipient's mail row, which share the uid
+    const mail = await this.mailRepository.manager.transaction(async (manager) => {
+      await manager.save(
+        manager.create(Message, {
+          uid,
+          sender,
+          headers: emailHeaders,
+          body: message,
+          html: null,
+        }),
+      );
+      return manager.save(
+        manager.create(Mail, {
+          uid,
+          recipient,
+          messageUid: uid,
+        }),
+      );
     });
 
-    await this.mailRepository.save(mail);
-
     // Prepare JSON data for sendsmtp.exe
     const smtpData = {
+      // Links sendsmtp's delivery_attempts rows to this mail row
+      mail_uid: uid,
       from: sender,
       to: [recipient],
       cc: cc || [],
@@ -162,9 +202,9 @@ export class MailService {
       body: message,
     };
 
-    // Send email using sendsmtp.exe (now uses direct MySMTP API instead of relay server)
+    // Send email using sendsmtp.exe, which delivers straight to the recipients' MX hosts
     try {
-      this.logger.log(`Sending email via sendsmtp (direct MySMTP API): ${this.sendsmtpPath}`);
+      this.logger.log(`Sending email via sendsmtp: ${this.sendsmtpPath}`);
       this.logger.debug(`SMTP data: ${JSON.stringify(smtpData, null, 2)}`);
 
       // Use -json flag to pass JSON data to sendsmtp
@@ -185,7 +225,7 @@ export class MailService {
       }
 
       this.logger.log(`sendsmtp stdout: ${stdout}`);
-      this.logger.log('Email sent successfully via direct MySMTP API');
+      this.logger.log('Email sent successfully via sendsmtp');
 
       return {
         message: 'Email sent successfully',
@@ -193,7 +233,7 @@ export class MailService {
         mail: {
           uid: mail.uid,
           recipient: mail.recipient,
-          sender: mail.sender,
+          sender,
           subject: emailHeaders.Subject,
           createdAt: mail.createdAt,
         },
@@ -0,0 +1,143 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+// Attachment is a row of the attachments table. The data is kept in the
+// blob store under Checksum, the hex SHA-256 of the decoded content.
+// Attachments belong to the stored message, which all its recipients share
+type Attachment struct {
+	ID          int64
+	MessageUID  string
+	Filename    string
+	ContentType string
+	Size        int64
+	ContentID   string
+	Checksum    string
+}
+
+// Attachments returns the parts of the message that are stored as
+// attachments: parts sent with Content-Disposition attachment or a file
+// name, attached messages, and any other part that is not text/plain or
+// text/html, such as inline images
+func (p *Part) Attachments() []*Part {
+	var attachments []*Part
+	p.collectAttachments(&attachments, true)
+	return attachments
+}
+
+func (p *Part) collectAttachments(attachments *[]*Part, root bool) {
+	if strings.HasPrefix(p.ContentType, "multipart/") && len(p.Parts) > 0 {
+		for _, child := range p.Parts {
+			child.collectAttachments(attachments, false)
+		}
+		return
+	}
+	// The message itself is never an attachment of itself, even when it is
+	// a single non-text entity
+	isText := p.ContentType == "text/plain" || p.ContentType == "text/html"
+	isMessage := strings.HasPrefix(p.ContentType, "message/")
+	if root && (isText || isMessage) {
+		return
+	}
+	if p.isAttachment() || p.filename() != "" || !isText {
+		*attachments = append(*attachments, p)
+	}
+}
+
+// filename is the Content-Disposition filename, or the older Content-Type
+// name parameter
+func (p *Part) filename() string {
+	if _, params, err := parseMediaType(p.header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		return params["filename"]
+	}
+	return p.Params["name"]
+}
+
+// contentID is the Content-ID without its angle brackets
+func (p *Part) contentID() string {
+	id := strings.TrimSpace(p.header.Get("Content-ID"))
+	return strings.TrimSuffix(strings.TrimPrefix(id, "<"), ">")
+}
+
+// storeAttachmentData writes the decoded data of every attachment of root
+// to the blob store and records its checksum in the part, so the stored
+// MIME structure references the attachments rows
+func (db *DB) storeAttachmentData(root *Part) ([]*Attachment, error) {
+	var attachments []*Attachment
+	for _, part := range root.Attachments() {
+		data, err := part.Decoded()
+		if err != nil {
+			log.Printf("[StoreMessage] WARNING: Could not decode attachment %q, storing it as received: %v\n", part.filename(), err)
+			data = part.Body
+		}
+		checksum := sha256Hex(data)
+		if err := db.blobs.Put(checksum, data); err != nil {
+			return nil, err
+		}
+		part.Attachment = checksum
+		attachments = append(attachments, &Attachment{
+			Filename:    part.filename(),
+			ContentType: part.ContentType,
+			Size:        int64(len(data)),
+			ContentID:   part.contentID(),
+			Checksum:    checksum,
+		})
+		log.Printf("[StoreMessage] Stored attachment %q (%s, %d bytes) as %s\n",
+			part.filename(), part.ContentType, len(data), checksum)
+	}
+	return attachments, nil
+}
+
+// insertAttachments adds the attachments rows of message messageUID
+func insertAttachments(tx *sql.Tx, messageUID string, attachments []*Attachment) error {
+	for i, a := range attachments {
+		_, err := tx.Exec(`
+			INSERT INTO attachments (message_uid, position, filename, content_type, size, content_id, checksum)
+			VALUES ($1, $2, NULLIF($3, ''), $4, $5, NULLIF($6, ''), $7)`,
+			messageUID, i, a.Filename, a.ContentType, a.Size, a.ContentID, a.Checksum,
+		)
+		if err != nil {
+			return fmt.Errorf("error storing attachment %q of message %s: %v", a.Filename, messageUID, err)
+		}
+	}
+	return nil
+}
+
+// Attachments returns the attachments of mail mailUID in message order
+func (db *DB) Attachments(mailUID string) ([]*Attachment, error) {
+	rows, err := db.conn.Query(`
+		SELECT a.id, a.message_uid, COALESCE(a.filename, ''), a.content_type, a.size, COALESCE(a.content_id, ''), a.checksum
+		FROM mail
+		JOIN attachments a ON a.message_uid = mail.message_uid
+		WHERE mail.uid = $1 ORDER BY a.position`,
+		mailUID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error loading attachments of mail %s: %v", mailUID, err)
+	}
+	defer rows.Close()
+
+	var attachments []*Attachment
+	for rows.Next() {
+		a := &Attachment{}
+		if err := rows.Scan(&a.ID, &a.MessageUID, &a.Filename, &a.ContentType, &a.Size, &a.ContentID, &a.Checksum); err != nil {
+			return nil, fmt.Errorf("error loading attachments of mail %s: %v", mailUID, err)
+		}
+		attachments = append(attachments, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error loading attachments of mail %s: %v", mailUID, err)
+	}
+	return attachments, nil
+}
+
+// OpenAttachment reads the data of an attachment from the blob store
+func (db *DB) OpenAttachment(a *Attachment) (io.ReadCloser, error) {
+	return db.blobs.Get(a.Checksum)
+}
@@ -0,0 +1,80 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAttachments(t *testing.T) {
+	tests := []struct {
+		file  string
+		names []string
+	}{
+		{"plain.eml", nil},
+		{"alternative.eml", nil},
+		{"nested.eml", []string{"logo.png", "invoice-2025-10.pdf"}},
+		{"untyped-parts.eml", []string{"report.txt"}},
+		{"digest.eml", []string{""}},
+		{"charsets.eml", []string{"notes.txt"}},
+		{"alternative-attachments.eml", []string{"Budget 2026 (draft).xlsx", "whiteboard.jpg"}},
+		// The attached message is one attachment, its own attachments are part of it
+		{"forwarded.eml", []string{"Re: Server migration.eml"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			attachments := ParseMessage(data).Attachments()
+			if len(attachments) != len(tt.names) {
+				t.Fatalf("got %d attachments, want %d", len(attachments), len(tt.names))
+			}
+			for i, part := range attachments {
+				if got := part.filename(); got != tt.names[i] {
+					t.Errorf("attachment %d filename = %q, want %q", i, got, tt.names[i])
+				}
+			}
+		})
+	}
+}
+
+func TestStoreAttachmentData(t *testing.T) {
+	blobs, err := NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := &DB{blobs: blobs}
+
+	data, err := os.ReadFile(filepath.Join("testdata", "nested.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := ParseMessage(data)
+	attachments, err := db.storeAttachmentData(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attachments) != 2 {
+		t.Fatalf("got %d attachments, want 2", len(attachments))
+	}
+
+	logo := attachments[0]
+	if logo.ContentID != "logo@example.com" || logo.ContentType != "image/png" || logo.Size != 70 {
+		t.Errorf("logo = %+v", logo)
+	}
+	if root.Parts[0].Parts[1].Attachment != logo.Checksum {
+		t.Errorf("part references %q, want %q", root.Parts[0].Parts[1].Attachment, logo.Checksum)
+	}
+
+	r, err := db.OpenAttachment(attachments[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	pdf := make([]byte, 8)
+	if _, err := r.Read(pdf); err != nil || string(pdf) != "%PDF-1.4" {
+		t.Errorf("attachment data starts with %q, %v", pdf, err)
+	}
+}
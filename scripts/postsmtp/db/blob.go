@@ -0,0 +1,207 @@
+package db
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// BlobStore keeps attachment data outside of PostgreSQL. Keys are the
+// hex SHA-256 checksums of the data, so storing the same data twice is
+// harmless
+type BlobStore interface {
+	Put(key string, data []byte) error
+	Get(key string) (io.ReadCloser, error)
+}
+
+// LocalBlobStore stores blobs as files below a directory
+type LocalBlobStore struct {
+	dir string
+}
+
+// NewLocalBlobStore creates dir if needed and returns a store writing to it
+func NewLocalBlobStore(dir string) (*LocalBlobStore, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create blob directory %s: %v", dir, err)
+	}
+	return &LocalBlobStore{dir: dir}, nil
+}
+
+// path spreads blobs over subdirectories named after the first two
+// characters of their key
+func (s *LocalBlobStore) path(key string) string {
+	if len(key) < 2 || strings.ContainsAny(key, `/\.`) {
+		return filepath.Join(s.dir, "invalid", hex.EncodeToString([]byte(key)))
+	}
+	return filepath.Join(s.dir, key[:2], key)
+}
+
+// Put writes data under key unless a blob with that key already exists
+func (s *LocalBlobStore) Put(key string, data []byte) error {
+	path := s.path(key)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return fmt.Errorf("error storing blob %s: %v", key, err)
+	}
+	// Write to a temporary file first so a crash never leaves a partial blob
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-"+key)
+	if err != nil {
+		return fmt.Errorf("error storing blob %s: %v", key, err)
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error storing blob %s: %v", key, err)
+	}
+	return nil
+}
+
+// Get opens the blob stored under key
+func (s *LocalBlobStore) Get(key string) (io.ReadCloser, error) {
+	f, err := os.Open(s.path(key))
+	if err != nil {
+		return nil, fmt.Errorf("error reading blob %s: %v", key, err)
+	}
+	return f, nil
+}
+
+// S3BlobStore stores blobs as objects of a bucket on an S3-compatible
+// endpoint such as MinIO. Requests use path-style URLs
+// (endpoint/bucket/key) and AWS Signature Version 4
+type S3BlobStore struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+// NewS3BlobStore returns a store for bucket on endpoint, e.g.
+// http://localhost:9000 for a local MinIO
+func NewS3BlobStore(endpoint, bucket, region, accessKey, secretKey string) (*S3BlobStore, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", endpoint)
+	}
+	if bucket == "" {
+		return nil, fmt.Errorf("S3 bucket is not set")
+	}
+	return &S3BlobStore{
+		endpoint:  u,
+		bucket:    bucket,
+		region:    region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Timeout: 60 * time.Second},
+	}, nil
+}
+
+// Put uploads data as the object key
+func (s *S3BlobStore) Put(key string, data []byte) error {
+	resp, err := s.do(http.MethodPut, key, data)
+	if err != nil {
+		return fmt.Errorf("error storing blob %s: %v", key, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error storing blob %s: %s", key, s3Error(resp))
+	}
+	return nil
+}
+
+// Get downloads the object key
+func (s *S3BlobStore) Get(key string) (io.ReadCloser, error) {
+	resp, err := s.do(http.MethodGet, key, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error reading blob %s: %v", key, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, fmt.Errorf("error reading blob %s: %s", key, s3Error(resp))
+	}
+	return resp.Body, nil
+}
+
+func (s *S3BlobStore) do(method, key string, body []byte) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket + "/" + key
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, body, time.Now().UTC())
+	return s.client.Do(req)
+}
+
+// sign adds the AWS Signature Version 4 headers for req with payload body
+func (s *S3BlobStore) sign(req *http.Request, body []byte, now time.Time) {
+	payloadHash := sha256Hex(body)
+	amzDate := now.Format("20060102T150405Z")
+	scope := now.Format("20060102") + "/" + s.region + "/s3/aws4_request"
+
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{now.Format("20060102"), s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+// s3Error summarizes a failed S3 response
+func s3Error(resp *http.Response) string {
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return strings.TrimSpace(resp.Status + " " + string(detail))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
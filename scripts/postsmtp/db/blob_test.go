@@ -0,0 +1,65 @@
+package db
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestS3BlobStore(t *testing.T) {
+	var mu sync.Mutex
+	objects := map[string][]byte{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=access/") ||
+			!strings.Contains(auth, "/us-east-1/s3/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=") {
+			http.Error(w, "bad authorization "+auth, http.StatusForbidden)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodPut:
+			body, _ := io.ReadAll(r.Body)
+			if r.Header.Get("X-Amz-Content-Sha256") != sha256Hex(body) {
+				http.Error(w, "payload hash mismatch", http.StatusBadRequest)
+				return
+			}
+			objects[r.URL.Path] = body
+		case http.MethodGet:
+			body, ok := objects[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write(body)
+		}
+	}))
+	defer server.Close()
+
+	store, err := NewS3BlobStore(server.URL, "mail", "us-east-1", "access", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := sha256Hex([]byte("attachment"))
+	if err := store.Put(key, []byte("attachment")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := objects["/mail/"+key]; !ok {
+		t.Fatalf("object not stored at /mail/%s: %v", key, objects)
+	}
+	r, err := store.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if data, _ := io.ReadAll(r); string(data) != "attachment" {
+		t.Errorf("Get returned %q", data)
+	}
+	if _, err := store.Get("missing"); err == nil {
+		t.Error("Get of a missing object succeeded")
+	}
+}
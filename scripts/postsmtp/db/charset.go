@@ -0,0 +1,58 @@
+package db
+
+import (
+	"log"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// fallbackCharset decodes 8-bit text without a usable charset declaration.
+// Such mail is almost always legacy Western European, and Windows-1252 is a
+// superset of ISO-8859-1 that maps every byte
+var fallbackCharset encoding.Encoding = charmap.Windows1252
+
+// toUTF8 converts text in charset label to UTF-8, which PostgreSQL TEXT
+// columns require. Labels are resolved like browsers do (WHATWG), so
+// ISO-8859-1 is read as Windows-1252. Text without a charset, with an
+// unknown one, or declared US-ASCII but containing 8-bit bytes is kept if it
+// is valid UTF-8 and otherwise read as Windows-1252. Invalid sequences in
+// declared UTF-8 become U+FFFD
+func toUTF8(data []byte, label string) string {
+	label = strings.ToLower(strings.Trim(strings.TrimSpace(label), `"`))
+	switch label {
+	case "utf-8", "utf8":
+		return cleanText(string(data))
+	case "", "us-ascii", "ascii":
+		return fallbackText(data)
+	}
+
+	enc, err := htmlindex.Get(label)
+	if err != nil {
+		log.Printf("[StoreMessage] Unknown charset %q, using fallback\n", label)
+		return fallbackText(data)
+	}
+	decoded, err := enc.NewDecoder().Bytes(data)
+	if err != nil {
+		log.Printf("[StoreMessage] Error decoding %s text, using fallback: %v\n", label, err)
+		return fallbackText(data)
+	}
+	return cleanText(string(decoded))
+}
+
+func fallbackText(data []byte) string {
+	if utf8.Valid(data) {
+		return cleanText(string(data))
+	}
+	decoded, _ := fallbackCharset.NewDecoder().Bytes(data)
+	return cleanText(string(decoded))
+}
+
+// cleanText makes text storable in PostgreSQL, which rejects NUL characters
+// and invalid UTF-8
+func cleanText(text string) string {
+	return strings.ReplaceAll(strings.ToValidUTF8(text, "\uFFFD"), "\x00", "")
+}
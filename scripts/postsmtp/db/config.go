@@ -33,6 +33,42 @@ func (c *Config) ConnectionString() string {
 		c.Host, c.Port, c.User, c.Password, c.Name, c.SSLMode)
 }
 
+// BlobConfig selects where attachment data is stored
+type BlobConfig struct {
+	Store       string // "local" or "s3"
+	Dir         string
+	S3Endpoint  string
+	S3Bucket    string
+	S3Region    string
+	S3AccessKey string
+	S3SecretKey string
+}
+
+// NewBlobConfigFromEnv creates a blob store configuration from environment variables
+func NewBlobConfigFromEnv() *BlobConfig {
+	return &BlobConfig{
+		Store:       getEnv("BLOB_STORE", "local"),
+		Dir:         getEnv("BLOB_DIR", "attachments"),
+		S3Endpoint:  getEnv("S3_ENDPOINT", "http://localhost:9000"),
+		S3Bucket:    getEnv("S3_BUCKET", "postsmtp"),
+		S3Region:    getEnv("S3_REGION", "us-east-1"),
+		S3AccessKey: getEnv("S3_ACCESS_KEY_ID", ""),
+		S3SecretKey: getEnv("S3_SECRET_ACCESS_KEY", ""),
+	}
+}
+
+// Open returns the configured blob store
+func (c *BlobConfig) Open() (BlobStore, error) {
+	switch c.Store {
+	case "local":
+		return NewLocalBlobStore(c.Dir)
+	case "s3":
+		return NewS3BlobStore(c.S3Endpoint, c.S3Bucket, c.S3Region, c.S3AccessKey, c.S3SecretKey)
+	default:
+		return nil, fmt.Errorf("unknown BLOB_STORE %q, expected local or s3", c.Store)
+	}
+}
+
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
@@ -13,11 +13,31 @@ import (
 
 // DB wraps the database connection and provides methods for database operations
 type DB struct {
-	conn *sql.DB
+	conn  *sql.DB
+	blobs BlobStore
 }
 
 // New creates a new database connection using the provided connection string
-func New(connString string) (*DB, error) {
+// and applies pending migrations. Attachment data is written to blobs
+func New(connString string, blobs BlobStore) (*DB, error) {
+	db, err := Connect(connString, blobs)
+	if err != nil {
+		return nil, err
+	}
+
+	// Bring the schema up to date
+	applied, err := db.MigrateUp(0)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate database: %v", err)
+	}
+	log.Printf("Database schema up to date, applied %d migrations\n", len(applied))
+	return db, nil
+}
+
+// Connect creates a new database connection without touching the schema,
+// for running migrations by hand
+func Connect(connString string, blobs BlobStore) (*DB, error) {
 	conn, err := sql.Open("postgres", connString)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to database: %v", err)
@@ -25,18 +45,12 @@ func New(connString string) (*DB, error) {
 
 	// Test connection
 	if err := conn.Ping(); err != nil {
+		conn.Close()
 		return nil, fmt.Errorf("failed to ping database: %v", err)
 	}
 
-	db := &DB{conn: conn}
-
-	// Create tables if they don't exist
-	if err := db.CreateTables(); err != nil {
-		return nil, fmt.Errorf("failed to create tables: %v", err)
-	}
-
 	log.Println("Connected to PostgreSQL database")
-	return db, nil
+	return &DB{conn: conn, blobs: blobs}, nil
 }
 
 // Close closes the database connection
@@ -44,56 +58,83 @@ func (db *DB) Close() error {
 	return db.conn.Close()
 }
 
-// CreateTables creates the necessary database tables if they don't exist
-func (db *DB) CreateTables() error {
-	// Create users table if it doesn't exist
-	usersTable := `
-	CREATE TABLE IF NOT EXISTS users (
-		id SERIAL PRIMARY KEY,
-		username VARCHAR(255) UNIQUE NOT NULL,
-		password TEXT NOT NULL,
-		salt TEXT NOT NULL,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-	);`
-
-	// Create mail table if it doesn't exist
-	mailTable := `
-	CREATE TABLE IF NOT EXISTS mail (
-		uid UUID PRIMARY KEY DEFAULT gen_random_uuid(),
-		recipient VARCHAR(255) NOT NULL,
-		sender VARCHAR(255) NOT NULL,
-		headers JSONB NOT NULL,
-		message TEXT NOT NULL,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-	);`
-
-	if _, err := db.conn.Exec(usersTable); err != nil {
-		return fmt.Errorf("failed to create users table: %v", err)
+// ValidateRecipient checks if a username exists in the users table
+func (db *DB) ValidateRecipient(username string) (bool, error) {
+	var exists bool
+	err := db.conn.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM users WHERE username = $1)",
+		username,
+	).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("error checking username %s: %v", username, err)
 	}
+	return exists, nil
+}
 
-	if _, err := db.conn.Exec(mailTable); err != nil {
-		return fmt.Errorf("failed to create mail table: %v", err)
+// AddSuppression stops sendsmtp from delivering to address, replacing the
+// reason of an existing entry
+func (db *DB) AddSuppression(address, reason, detail string) error {
+	_, err := db.conn.Exec(`
+		INSERT INTO suppressions (address, reason, source, detail)
+		VALUES ($1, $2, 'postsmtp', NULLIF($3, ''))
+		ON CONFLICT (address) DO UPDATE
+		SET reason = EXCLUDED.reason, source = EXCLUDED.source, detail = EXCLUDED.detail, updated_at = CURRENT_TIMESTAMP`,
+		strings.ToLower(strings.TrimSpace(address)), reason, detail,
+	)
+	if err != nil {
+		return fmt.Errorf("error adding %s to suppression list: %v", address, err)
 	}
-
-	log.Println("Database tables created/verified")
+	log.Printf("Suppressed %s (%s): %s\n", address, reason, detail)
 	return nil
 }
 
-// ValidateRecipient checks if a username exists in the users table
-func (db *DB) ValidateRecipient(username string) bool {
+// AttemptedMail reports whether sendsmtp tried to deliver mail mailUID to
+// recipient, according to delivery_attempts
+func (db *DB) AttemptedMail(mailUID, recipient string) (bool, error) {
 	var exists bool
 	err := db.conn.QueryRow(
-		"SELECT EXISTS(SELECT 1 FROM users WHERE username = $1)",
-		username,
+		"SELECT EXISTS(SELECT 1 FROM delivery_attempts WHERE mail_uid = $1 AND lower(recipient) = lower($2))",
+		mailUID, recipient,
 	).Scan(&exists)
 	if err != nil {
-		log.Printf("Error checking username: %v", err)
-		return false
+		return false, fmt.Errorf("error looking up mail %s to %s: %v", mailUID, recipient, err)
 	}
-	return exists
+	return exists, nil
 }
 
-// StoreMessage stores an email message in the database
+// AttemptedMessage reports whether sendsmtp tried to deliver the message
+// with Message-ID messageID to recipient, according to delivery_attempts
+func (db *DB) AttemptedMessage(messageID, recipient string) (bool, error) {
+	var exists bool
+	err := db.conn.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM delivery_attempts WHERE btrim(message_id, '<>') = $1 AND lower(recipient) = lower($2))",
+		strings.Trim(strings.TrimSpace(messageID), "<>"), recipient,
+	).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("error looking up message %s to %s: %v", messageID, recipient, err)
+	}
+	return exists, nil
+}
+
+// RecordBounce adds a bounced attempt for recipient of mail mailUID to the
+// delivery_attempts table, so the delivery_status view shows bounces that
+// arrive after the message was accepted
+func (db *DB) RecordBounce(mailUID, recipient, enhancedCode, detail string) error {
+	_, err := db.conn.Exec(`
+		INSERT INTO delivery_attempts
+			(mail_uid, message_id, recipient, status, enhanced_code, reply_text, started_at, finished_at)
+		VALUES ($1, '', $2, 'bounced', NULLIF($3, ''), NULLIF($4, ''), NOW() AT TIME ZONE 'UTC', NOW() AT TIME ZONE 'UTC')`,
+		mailUID, recipient, enhancedCode, detail,
+	)
+	if err != nil {
+		return fmt.Errorf("error recording bounce of %s for mail %s: %v", recipient, mailUID, err)
+	}
+	log.Printf("Recorded bounce of %s for mail %s: %s\n", recipient, mailUID, detail)
+	return nil
+}
+
+// StoreMessage stores an email message in the database once and links it to
+// each recipient through a mail row, all in one transaction
 func (db *DB) StoreMessage(mailFrom string, rcptTo []string, data []byte) error {
 	// Log raw data for debugging
 	log.Printf("[StoreMessage] Raw data length: %d bytes\n", len(data))
@@ -106,189 +147,22 @@ func (db *DB) StoreMessage(mailFrom string, rcptTo []string, data []byte) error
 		log.Printf("[StoreMessage] Data preview (first 200 bytes): %q\n", string(preview))
 	}
 
-	// Parse email to extract headers and body
-	// Normalize line endings: convert \r\n to \n, then handle any remaining \r
-	emailStr := string(data)
-	// Replace \r\n with \n first, then any remaining \r with \n
-	emailStr = strings.ReplaceAll(emailStr, "\r\n", "\n")
-	emailStr = strings.ReplaceAll(emailStr, "\r", "\n")
-
-	lines := strings.Split(emailStr, "\n")
-	log.Printf("[StoreMessage] Parsed into %d lines\n", len(lines))
-
-	headers := make(map[string]string)
-	var body strings.Builder
-	inBody := false
-	var currentHeader string
-	headerEndIndex := -1
-
-	// First pass: find where headers end (empty line)
-	for i, line := range lines {
-		trimmedLine := strings.TrimSpace(line)
-		if trimmedLine == "" && !inBody {
-			inBody = true
-			headerEndIndex = i
-			log.Printf("[StoreMessage] Found header/body separator at line %d\n", i+1)
-			break
-		}
-	}
-
-	// Second pass: parse headers and body
-	for i, line := range lines {
-		// Remove trailing \r if present (shouldn't happen after normalization, but be safe)
-		line = strings.TrimRight(line, "\r")
-
-		if i <= headerEndIndex {
-			// Still in headers (including the empty line)
-			if i == headerEndIndex {
-				// This is the empty line, skip it
-				continue
-			}
-
-			// Parse headers - must start at beginning of line (not continuation)
-			// Continuation lines start with space or tab
-			trimmedLine := strings.TrimSpace(line)
-			if trimmedLine == "" {
-				// Empty line means end of headers (should have been caught earlier)
-				continue
-			}
-
-			if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
-				// Continuation of previous header (folded header according to RFC 5322)
-				if currentHeader != "" {
-					// Append to existing header value (remove leading whitespace)
-					headers[currentHeader] = headers[currentHeader] + " " + strings.TrimSpace(line)
-				}
-			} else if strings.Contains(line, ":") {
-				// New header line - split on FIRST colon only
-				colonIndex := strings.Index(line, ":")
-				if colonIndex > 0 && colonIndex < len(line)-1 {
-					headerName := strings.TrimSpace(line[:colonIndex])
-					headerValue := strings.TrimSpace(line[colonIndex+1:])
-
-					// Validate header name
-					// Must be non-empty, lowercase, no spaces, no invalid chars
-					headerNameLower := strings.ToLower(headerName)
-					if headerNameLower == "" {
-						log.Printf("[StoreMessage] WARNING: Skipping header with empty name at line %d: %q\n", i+1, line)
-						continue
-					}
-					if strings.Contains(headerNameLower, " ") {
-						log.Printf("[StoreMessage] WARNING: Skipping header with space in name at line %d: %q\n", i+1, line)
-						continue
-					}
-					// Skip lines that look malformed (e.g., just numbers or special chars)
-					if len(headerNameLower) > 50 {
-						log.Printf("[StoreMessage] WARNING: Skipping suspiciously long header name at line %d: %q\n", i+1, line)
-						continue
-					}
-
-					currentHeader = headerNameLower
-
-					// Store or append value (some headers may appear multiple times)
-					if existingValue, exists := headers[currentHeader]; exists {
-						headers[currentHeader] = existingValue + ", " + headerValue
-					} else {
-						headers[currentHeader] = headerValue
-					}
-				}
-			}
-		} else {
-			// Body content (after empty line)
-			body.WriteString(line)
-			if i < len(lines)-1 {
-				body.WriteString("\n")
-			}
-		}
-	}
-
-	bodyStr := body.String()
-
-	// If Content-Type indicates multipart, try to extract plain text part
-	contentType := headers["content-type"]
-	if contentType != "" && strings.Contains(strings.ToLower(contentType), "multipart") {
-		log.Printf("[StoreMessage] Detected multipart email, extracting plain text body\n")
-		log.Printf("[StoreMessage] Content-Type: %s\n", contentType)
-
-		// Extract boundary from Content-Type header
-		// Content-Type might be malformed with multiple values like:
-		// "multipart/alternative; boundary=\"xxx\", text/plain; charset=\"UTF-8\", text/html; charset=\"UTF-8\""
-		// We need to extract just the first part (multipart/alternative) and get boundary from there
-
-		// Take first value before comma (if multiple values)
-		firstContentType := contentType
-		commaIndex := strings.Index(contentType, ",")
-		if commaIndex != -1 {
-			firstContentType = strings.TrimSpace(contentType[:commaIndex])
-			log.Printf("[StoreMessage] Content-Type has multiple values, using first: %s\n", firstContentType)
-		}
-
-		log.Printf("[StoreMessage] Parsing Content-Type: %s\n", firstContentType)
-
-		// Find boundary in the Content-Type value
-		contentTypeLower := strings.ToLower(firstContentType)
-		boundaryStart := strings.Index(contentTypeLower, "boundary=")
-		if boundaryStart != -1 {
-			// Start after "boundary="
-			boundaryStr := firstContentType[boundaryStart+9:]
-			// Remove leading/trailing whitespace
-			boundaryStr = strings.TrimSpace(boundaryStr)
-
-			log.Printf("[StoreMessage] Boundary string before parsing: %q\n", boundaryStr)
-
-			// Handle quoted boundary (boundary="value" or boundary=\"value\")
-			if strings.HasPrefix(boundaryStr, "\\\"") {
-				// Handle escaped quote \"
-				boundaryStr = boundaryStr[2:] // Skip \"
-				endQuote := strings.Index(boundaryStr, "\\\"")
-				if endQuote == -1 {
-					endQuote = strings.Index(boundaryStr, "\"")
-				}
-				if endQuote != -1 {
-					boundaryStr = boundaryStr[:endQuote]
-				}
-			} else if strings.HasPrefix(boundaryStr, "\"") {
-				// Handle regular quote "
-				endQuote := strings.Index(boundaryStr[1:], "\"")
-				if endQuote != -1 {
-					boundaryStr = boundaryStr[1 : endQuote+1]
-				}
-			} else {
-				// Unquoted boundary - everything up to next semicolon, comma, space, or end
-				endIndex := len(boundaryStr)
-				for _, char := range []string{";", ",", " ", "\t", "\n", "\r"} {
-					idx := strings.Index(boundaryStr, char)
-					if idx != -1 && idx < endIndex {
-						endIndex = idx
-					}
-				}
-				if endIndex < len(boundaryStr) {
-					boundaryStr = boundaryStr[:endIndex]
-				}
-			}
-
-			boundary := strings.TrimSpace(boundaryStr)
-			// Remove any remaining quotes and escape sequences
-			boundary = strings.Trim(boundary, "\"")
-			boundary = strings.ReplaceAll(boundary, "\\\"", "\"")
-			boundary = strings.ReplaceAll(boundary, "\\\\", "\\")
-
-			log.Printf("[StoreMessage] Extracted boundary: %q\n", boundary)
-
-			// Parse multipart body
-			plainTextBody := extractPlainTextFromMultipart(bodyStr, boundary)
-			if plainTextBody != "" && plainTextBody != bodyStr {
-				log.Printf("[StoreMessage] Extracted plain text body: %d bytes\n", len(plainTextBody))
-				bodyStr = plainTextBody
-			} else {
-				log.Printf("[StoreMessage] Could not extract plain text, using original body\n")
-			}
-		} else {
-			log.Printf("[StoreMessage] No boundary found in Content-Type\n")
-		}
+	// Parse the message into its MIME tree; the text/plain part is the body,
+	// rendered from the HTML part if there is none
+	root := ParseMessage(data)
+	headers := root.Headers.Map()
+	bodyStr := root.PlainText()
+	htmlStr := root.HTML()
+	log.Printf("[StoreMessage] Content-Type: %s, %d top-level parts\n", root.ContentType, len(root.Parts))
+
+	// Attachment data goes to the blob store before the parts are marshaled,
+	// which then reference it by checksum
+	attachments, err := db.storeAttachmentData(root)
+	if err != nil {
+		return fmt.Errorf("error storing attachments: %v", err)
 	}
 
-	log.Printf("[StoreMessage] Parsed headers count: %d, Body length: %d bytes\n", len(headers), len(bodyStr))
+	log.Printf("[StoreMessage] Parsed headers count: %d, Body length: %d bytes, HTML length: %d bytes\n", len(headers), len(bodyStr), len(htmlStr))
 	if len(bodyStr) > 0 {
 		// Log first 200 characters of body for debugging
 		bodyPreview := bodyStr
@@ -300,198 +174,122 @@ func (db *DB) StoreMessage(mailFrom string, rcptTo []string, data []byte) error
 		log.Printf("[StoreMessage] WARNING: Body is empty after parsing!\n")
 	}
 
-	// Convert headers to JSON
+	// Convert headers to JSON: the ordered fields, and the flat map derived
+	// from them that the backend reads
 	headersJSON, err := json.Marshal(headers)
 	if err != nil {
 		return fmt.Errorf("error marshaling headers to JSON: %v", err)
 	}
+	headerFieldsJSON, err := json.Marshal(root.Headers)
+	if err != nil {
+		return fmt.Errorf("error marshaling header fields to JSON: %v", err)
+	}
+	partsJSON, err := json.Marshal(root)
+	if err != nil {
+		return fmt.Errorf("error marshaling MIME parts to JSON: %v", err)
+	}
 
-	// Generate UUID for each message
-	messageUID := uuid.New()
+	// The raw source is kept compressed next to the parsed form
+	rawCompressed, err := compressRaw(data)
+	if err != nil {
+		return fmt.Errorf("error compressing raw message: %v", err)
+	}
+	log.Printf("[StoreMessage] Raw message compressed from %d to %d bytes\n", len(data), len(rawCompressed))
 
-	// Store each recipient separately with the same message
 	// Ensure recipient is always a full email address (username@domain), not just username
+	var recipients []string
+	seen := make(map[string]bool)
 	for _, recipient := range rcptTo {
 		// Validate that recipient is a full email address (contains @)
 		if !strings.Contains(recipient, "@") {
 			log.Printf("WARNING: Recipient '%s' is not a full email address, skipping storage\n", recipient)
 			continue
 		}
+		if seen[strings.ToLower(recipient)] {
+			continue
+		}
+		seen[strings.ToLower(recipient)] = true
+		recipients = append(recipients, recipient)
+	}
+	if len(recipients) == 0 {
+		log.Printf("WARNING: Message from %s has no recipient to store it for\n", mailFrom)
+		return nil
+	}
+
+	// The message and all its recipients are stored in one transaction, so a
+	// failure leaves nothing behind for the client's retry to duplicate
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	messageUID := uuid.New().String()
+	log.Printf("Storing message - UID: %s, Sender: %s, Recipients: %v\n", messageUID, mailFrom, recipients)
+	_, err = tx.Exec(
+		"INSERT INTO messages (uid, sender, headers, header_fields, body, html, parts, raw) VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), $7, $8)",
+		messageUID,
+		mailFrom,
+		headersJSON,
+		headerFieldsJSON,
+		bodyStr,
+		htmlStr,
+		partsJSON,
+		rawCompressed,
+	)
+	if err != nil {
+		log.Printf("ERROR: Failed to store message: %v\n", err)
+		return fmt.Errorf("error storing message: %v", err)
+	}
 
-		log.Printf("Storing message - UID: %s, Recipient: %s (full email), Sender: %s\n",
-			messageUID.String(), recipient, mailFrom)
+	if err := insertAttachments(tx, messageUID, attachments); err != nil {
+		log.Printf("ERROR: %v\n", err)
+		return err
+	}
 
-		log.Printf("[StoreMessage] Storing - Body length: %d bytes\n", len(bodyStr))
+	// One mail row per recipient links the message to the mailbox
+	for _, recipient := range recipients {
+		mailUID := uuid.New()
+		log.Printf("[StoreMessage] Storing for recipient %s as mail %s\n", recipient, mailUID)
 
-		_, err := db.conn.Exec(
-			"INSERT INTO mail (uid, recipient, sender, headers, message) VALUES ($1, $2, $3, $4, $5)",
-			messageUID,
+		_, err := tx.Exec(
+			"INSERT INTO mail (uid, recipient, message_uid) VALUES ($1, $2, $3)",
+			mailUID,
 			recipient,
-			mailFrom,
-			headersJSON,
-			bodyStr,
+			messageUID,
 		)
 		if err != nil {
 			log.Printf("ERROR: Failed to store message for recipient %s: %v\n", recipient, err)
-			return fmt.Errorf("error storing message: %v", err)
+			return fmt.Errorf("error storing message for %s: %v", recipient, err)
 		}
+	}
 
-		log.Printf("Successfully stored message for recipient: %s\n", recipient)
-
-		// Generate new UUID for next recipient if multiple
-		messageUID = uuid.New()
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing message: %v", err)
 	}
 
-	log.Printf("Stored message from %s to %v", mailFrom, rcptTo)
+	log.Printf("Stored message %s from %s to %v", messageUID, mailFrom, recipients)
 	return nil
 }
 
-// extractPlainTextFromMultipart extracts the plain text part from a multipart MIME message
-func extractPlainTextFromMultipart(body, boundary string) string {
-	if boundary == "" {
-		log.Printf("[extractPlainTextFromMultipart] Empty boundary\n")
-		return body
-	}
-
-	log.Printf("[extractPlainTextFromMultipart] Searching for boundary: %q\n", boundary)
-	log.Printf("[extractPlainTextFromMultipart] Body length: %d bytes\n", len(body))
-
-	// Multipart messages have parts separated by --boundary or \r\n--boundary\r\n
-	// First line after boundary separator is typically blank, then headers, then blank line, then content
-
-	// Try different boundary marker formats
-	var boundaryMarker string
-	boundaryFormats := []string{
-		"\r\n--" + boundary + "\r\n",
-		"\n--" + boundary + "\n",
-		"--" + boundary + "\r\n",
-		"--" + boundary + "\n",
-		"\r\n--" + boundary + "\n",
-		"\n--" + boundary + "\r\n",
-	}
-
-	for _, format := range boundaryFormats {
-		if strings.Contains(body, format) {
-			boundaryMarker = format
-			break
-		}
+// HeaderFields returns the header of mail uid as ordered fields
+func (db *DB) HeaderFields(uid string) (Header, error) {
+	var fieldsJSON []byte
+	err := db.conn.QueryRow(`
+		SELECT messages.header_fields FROM mail
+		JOIN messages ON messages.uid = mail.message_uid
+		WHERE mail.uid = $1`,
+		uid,
+	).Scan(&fieldsJSON)
+	if err == sql.ErrNoRows {
+		return nil, ErrMailNotFound
 	}
-
-	if boundaryMarker == "" {
-		// Try without line endings - just the boundary itself
-		if strings.Contains(body, "--"+boundary) {
-			boundaryMarker = "--" + boundary
-		} else {
-			log.Printf("[extractPlainTextFromMultipart] Boundary marker not found in body\n")
-			return body
-		}
+	if err != nil {
+		return nil, fmt.Errorf("error loading header fields of mail %s: %v", uid, err)
 	}
-
-	log.Printf("[extractPlainTextFromMultipart] Using boundary marker: %q\n", boundaryMarker)
-
-	// Split by boundary marker
-	parts := strings.Split(body, boundaryMarker)
-	log.Printf("[extractPlainTextFromMultipart] Found %d parts\n", len(parts))
-
-	// Also try splitting by just the boundary (in case line endings are inconsistent)
-	if len(parts) == 1 {
-		// Try alternative splitting
-		altParts := strings.Split(body, "--"+boundary)
-		if len(altParts) > 1 {
-			log.Printf("[extractPlainTextFromMultipart] Using alternative boundary splitting, found %d parts\n", len(altParts))
-			parts = altParts
-		}
+	var fields Header
+	if err := json.Unmarshal(fieldsJSON, &fields); err != nil {
+		return nil, fmt.Errorf("error decoding header fields of mail %s: %v", uid, err)
 	}
-
-	for partIndex, part := range parts {
-		// Skip empty parts and closing boundary (which ends with --)
-		trimmedPart := strings.TrimSpace(part)
-		if trimmedPart == "" || trimmedPart == "--" {
-			log.Printf("[extractPlainTextFromMultipart] Skipping empty part %d\n", partIndex)
-			continue
-		}
-
-		log.Printf("[extractPlainTextFromMultipart] Processing part %d (length: %d bytes)\n", partIndex, len(part))
-
-		// Check if this part is plain text
-		partLines := strings.Split(part, "\n")
-		isPlainText := false
-		contentStartIndex := -1
-
-		// Find headers and content in this part
-		inPartHeaders := true
-		partHeaders := make(map[string]string)
-		var partContent strings.Builder
-
-		for i, line := range partLines {
-			lineTrimmed := strings.TrimSpace(line)
-
-			if inPartHeaders {
-				if lineTrimmed == "" {
-					// Empty line marks end of headers, content starts next
-					inPartHeaders = false
-					continue
-				}
-
-				// Parse part header
-				if strings.Contains(line, ":") {
-					colonIndex := strings.Index(line, ":")
-					if colonIndex > 0 {
-						headerName := strings.ToLower(strings.TrimSpace(line[:colonIndex]))
-						headerValue := strings.TrimSpace(line[colonIndex+1:])
-						partHeaders[headerName] = headerValue
-
-						// Check if this is Content-Type: text/plain
-						if headerName == "content-type" && strings.Contains(strings.ToLower(headerValue), "text/plain") {
-							isPlainText = true
-							log.Printf("[extractPlainTextFromMultipart] Found text/plain in part %d\n", partIndex)
-						}
-					}
-				}
-			} else {
-				// We're in the content section
-				if contentStartIndex == -1 {
-					contentStartIndex = i
-				}
-				partContent.WriteString(line)
-				if i < len(partLines)-1 {
-					partContent.WriteString("\n")
-				}
-			}
-		}
-
-		if isPlainText && partContent.Len() > 0 {
-			// Extract plain text content
-			plainText := partContent.String()
-			// Remove trailing boundary markers and whitespace
-			plainText = strings.TrimSpace(plainText)
-			// Remove trailing -- if present (closing boundary)
-			plainText = strings.TrimSuffix(plainText, "--")
-			plainText = strings.TrimSpace(plainText)
-			// Remove any remaining boundary markers
-			plainText = strings.TrimSuffix(plainText, boundary)
-			plainText = strings.TrimSpace(plainText)
-			// Remove any remaining boundary markers with line endings
-			for _, marker := range []string{"\r\n--" + boundary, "\n--" + boundary, "--" + boundary} {
-				plainText = strings.TrimSuffix(plainText, marker)
-			}
-			plainText = strings.TrimSpace(plainText)
-
-			log.Printf("[extractPlainTextFromMultipart] Extracted plain text: %d bytes\n", len(plainText))
-			if len(plainText) > 0 {
-				preview := plainText
-				if len(preview) > 100 {
-					preview = preview[:100] + "..."
-				}
-				log.Printf("[extractPlainTextFromMultipart] Plain text preview: %q\n", preview)
-			}
-			return plainText
-		} else if isPlainText {
-			log.Printf("[extractPlainTextFromMultipart] Part %d is plain text but content is empty\n", partIndex)
-		}
-	}
-
-	log.Printf("[extractPlainTextFromMultipart] No plain text part found, returning original body\n")
-	// If no plain text part found, return original body
-	return body
+	return fields, nil
 }
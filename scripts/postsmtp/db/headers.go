@@ -0,0 +1,225 @@
+package db
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// headerDecoder decodes RFC 2047 encoded words in any charset that toUTF8
+// knows, not only the UTF-8 and ISO-8859-1 built into package mime
+var headerDecoder = &mime.WordDecoder{
+	CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+		enc, err := htmlindex.Get(strings.ToLower(charset))
+		if err != nil {
+			return nil, err
+		}
+		return enc.NewDecoder().Reader(input), nil
+	},
+}
+
+// decodeHeader decodes the RFC 2047 encoded words of a header value to
+// UTF-8. A value with an undecodable word is kept as received; raw 8-bit
+// values are converted like text without a charset
+func decodeHeader(value string) string {
+	decoded, err := headerDecoder.DecodeHeader(value)
+	if err != nil {
+		decoded = value
+	}
+	return fallbackText([]byte(decoded))
+}
+
+// HeaderField is a header field of a message or part. Value is decoded to
+// UTF-8; Raw keeps the value as received when decoding changed it
+type HeaderField struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	Raw   string `json:"raw,omitempty"`
+}
+
+// Header is the list of header fields in the order they were received,
+// with names in their original case. Repeated fields such as Received,
+// DKIM-Signature or Authentication-Results stay separate entries
+type Header []HeaderField
+
+// Get returns the first value of the field name, compared case-insensitively,
+// or "" if there is none
+func (h Header) Get(name string) string {
+	for _, field := range h {
+		if strings.EqualFold(field.Name, name) {
+			return field.Value
+		}
+	}
+	return ""
+}
+
+// Values returns every value of the field name in message order
+func (h Header) Values(name string) []string {
+	var values []string
+	for _, field := range h {
+		if strings.EqualFold(field.Name, name) {
+			values = append(values, field.Value)
+		}
+	}
+	return values
+}
+
+// Map is the flat view stored in the headers column for the backend:
+// lowercase names, repeated fields joined with ", " in message order
+func (h Header) Map() map[string]string {
+	m := make(map[string]string, len(h))
+	for _, field := range h {
+		name := strings.ToLower(field.Name)
+		if existing, ok := m[name]; ok {
+			m[name] = existing + ", " + field.Value
+		} else {
+			m[name] = field.Value
+		}
+	}
+	return m
+}
+
+// scanHeader reads the header block at the start of data, which
+// mail.ReadMessage has accepted, keeping the order and case that
+// textproto discards. Folded lines are unfolded the way textproto does
+func scanHeader(data []byte) Header {
+	var fields Header
+	for len(data) > 0 {
+		var line []byte
+		line, data, _ = bytes.Cut(data, []byte("\n"))
+		line = bytes.TrimRight(line, "\r")
+		if len(line) == 0 {
+			break
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if n := len(fields); n > 0 {
+				continued := string(bytes.TrimSpace(line))
+				if fields[n-1].Value == "" {
+					fields[n-1].Value = continued
+				} else if continued != "" {
+					fields[n-1].Value += " " + continued
+				}
+			}
+			continue
+		}
+		name, value, ok := bytes.Cut(line, []byte(":"))
+		if !ok {
+			continue
+		}
+		fields = append(fields, HeaderField{
+			Name:  string(bytes.TrimRight(name, " \t")),
+			Value: string(bytes.TrimSpace(value)),
+		})
+	}
+	return fields
+}
+
+// headerFields lists a header parsed by textproto, which only multipart
+// body parts are. Their original order and case are lost: fields come in
+// canonical form sorted by name, repeated fields in message order
+func headerFields(header textproto.MIMEHeader) Header {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fields := make(Header, 0, len(names))
+	for _, name := range names {
+		for _, value := range header[name] {
+			fields = append(fields, HeaderField{Name: name, Value: value})
+		}
+	}
+	return fields
+}
+
+// decoded returns the fields with their values decoded by decodeHeader
+func (h Header) decoded() Header {
+	for i, field := range h {
+		if value := decodeHeader(field.Value); value != field.Value {
+			h[i].Raw = field.Value
+			h[i].Value = value
+		}
+	}
+	return h
+}
+
+// rfc2231ParamRe matches the extended (charset-encoded) segments of MIME
+// parameters: name*=charset'lang'value and name*0*=, name*1*= and so on
+var rfc2231ParamRe = regexp.MustCompile(`(?i)([a-z0-9!#$&+.^_|~-]+)\*(?:(\d+)\*)?=([^;\s]*)`)
+
+// rfc2231Escape percent-encodes every byte outside attribute-char (RFC 2231
+// section 7): controls, space, non-ASCII, "*", "'", "%" and the tspecials
+func rfc2231Escape(s string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c > ' ' && c < 0x7f && !strings.ContainsRune(`*'%()<>@,;:\"/[]?=`, rune(c)) {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&0xf])
+	}
+	return b.String()
+}
+
+// parseMediaType is mime.ParseMediaType with RFC 2231 parameters in any
+// charset, where package mime only decodes UTF-8 and US-ASCII, and with
+// RFC 2047 encoded words in name and filename parameters, which many
+// clients send instead
+func parseMediaType(value string) (string, map[string]string, error) {
+	mediaType, params, err := mime.ParseMediaType(normalizeRFC2231(value))
+	for _, name := range []string{"name", "filename"} {
+		if v, ok := params[name]; ok {
+			params[name] = decodeHeader(v)
+		}
+	}
+	return mediaType, params, err
+}
+
+// normalizeRFC2231 re-encodes extended parameters declared in a charset
+// other than UTF-8 or US-ASCII as UTF-8
+func normalizeRFC2231(value string) string {
+	if !strings.Contains(value, "*=") {
+		return value
+	}
+	charsets := make(map[string]string)
+	for _, m := range rfc2231ParamRe.FindAllStringSubmatch(value, -1) {
+		if m[2] == "" || m[2] == "0" {
+			if parts := strings.SplitN(m[3], "'", 3); len(parts) == 3 {
+				charsets[strings.ToLower(m[1])] = strings.ToLower(parts[0])
+			}
+		}
+	}
+
+	return rfc2231ParamRe.ReplaceAllStringFunc(value, func(segment string) string {
+		m := rfc2231ParamRe.FindStringSubmatch(segment)
+		charset := charsets[strings.ToLower(m[1])]
+		if charset == "" || charset == "utf-8" || charset == "us-ascii" {
+			return segment
+		}
+		encoded := m[3]
+		if m[2] == "" || m[2] == "0" {
+			encoded = strings.SplitN(encoded, "'", 3)[2]
+		}
+		raw, err := url.PathUnescape(encoded)
+		if err != nil {
+			return segment
+		}
+		reencoded := rfc2231Escape(toUTF8([]byte(raw), charset))
+		if m[2] == "" || m[2] == "0" {
+			reencoded = "utf-8''" + reencoded
+		}
+		return strings.TrimSuffix(segment, m[3]) + reencoded
+	})
+}
@@ -0,0 +1,58 @@
+package db
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+var (
+	// Elements whose content is never displayed
+	htmlHiddenRe = regexp.MustCompile(`(?is)<(head|script|style|title)\b.*?</(head|script|style|title)\s*>|<!--.*?-->`)
+	// Elements that start a new line or paragraph
+	htmlBreakRe     = regexp.MustCompile(`(?i)<br\s*/?>`)
+	htmlBlockRe     = regexp.MustCompile(`(?i)</?(p|div|h[1-6]|ul|ol|table|blockquote|pre|hr)\b[^>]*>`)
+	htmlRowRe       = regexp.MustCompile(`(?i)</tr\s*>`)
+	htmlListItemRe  = regexp.MustCompile(`(?i)<li\b[^>]*>`)
+	htmlCellRe      = regexp.MustCompile(`(?i)</t[dh]\s*>`)
+	htmlLinkRe      = regexp.MustCompile(`(?is)<a\b[^>]*?\bhref\s*=\s*("([^"]*)"|'([^']*)')[^>]*>(.*?)</a\s*>`)
+	htmlTagRe       = regexp.MustCompile(`(?s)<[^>]*>`)
+	htmlSpaceRe     = regexp.MustCompile(`[ \t\r\f\v]+`)
+	htmlBlankLineRe = regexp.MustCompile(`\n{3,}`)
+)
+
+// htmlToText renders an HTML body as plain text for messages without a
+// text/plain part: block elements become line breaks, links keep their
+// target in brackets and entities are decoded. It is meant for display and
+// search, not as a faithful conversion
+func htmlToText(body string) string {
+	text := htmlHiddenRe.ReplaceAllString(body, "")
+	text = htmlLinkRe.ReplaceAllStringFunc(text, func(link string) string {
+		m := htmlLinkRe.FindStringSubmatch(link)
+		href := m[2] + m[3]
+		label := strings.TrimSpace(htmlTagRe.ReplaceAllString(m[4], ""))
+		if href == "" || strings.HasPrefix(href, "#") || html.UnescapeString(label) == href {
+			return label
+		}
+		return label + " [" + href + "]"
+	})
+
+	// Whitespace in the markup is insignificant, line breaks come from tags
+	text = strings.NewReplacer("\r\n", " ", "\n", " ").Replace(text)
+	text = htmlBreakRe.ReplaceAllString(text, "\n")
+	text = htmlBlockRe.ReplaceAllString(text, "\n\n")
+	text = htmlRowRe.ReplaceAllString(text, "\n")
+	text = htmlListItemRe.ReplaceAllString(text, "\n- ")
+	text = htmlCellRe.ReplaceAllString(text, " ")
+	text = htmlTagRe.ReplaceAllString(text, "")
+	text = html.UnescapeString(text)
+	text = strings.ReplaceAll(text, " ", " ")
+
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(htmlSpaceRe.ReplaceAllString(line, " "))
+	}
+	text = strings.Join(lines, "\n")
+	text = htmlBlankLineRe.ReplaceAllString(text, "\n\n")
+	return strings.TrimSpace(text)
+}
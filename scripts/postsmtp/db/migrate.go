@@ -0,0 +1,236 @@
+package db
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID serializes migrations of concurrently starting instances
+// through a PostgreSQL advisory lock
+const migrationLockID = 7241385001
+
+// migrationNameRe matches migrations/NNNN_name.up.sql and .down.sql
+var migrationNameRe = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration is a versioned schema change from the migrations directory
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus tells whether a migration has been applied
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// loadMigrations reads the migrations directory of fsys, the embedded
+// migrationFiles outside tests, in version order. Every version needs both
+// an up and a down file
+func loadMigrations(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		m := migrationNameRe.FindStringSubmatch(entry.Name())
+		if m == nil {
+			return nil, fmt.Errorf("unexpected migration file %s", entry.Name())
+		}
+		// 1_name and 0001_name are the same version
+		version, _ := strconv.Atoi(m[1])
+		content, err := fs.ReadFile(fsys, "migrations/"+entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		migration := byVersion[version]
+		if migration == nil {
+			migration = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = migration
+		} else if migration.Name != m[2] {
+			return nil, fmt.Errorf("migration %d is named both %s and %s", version, migration.Name, m[2])
+		}
+		script := &migration.Down
+		if m[3] == "up" {
+			script = &migration.Up
+		}
+		if *script != "" {
+			return nil, fmt.Errorf("migration %d has more than one %s file", version, m[3])
+		}
+		*script = string(content)
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("migration %04d_%s needs both an up and a down file", migration.Version, migration.Name)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// createMigrationsTable creates the schema_migrations table, which records
+// the applied versions. It holds the migration lock, as instances starting
+// at the same time would otherwise race to create it
+func (db *DB) createMigrationsTable() error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", migrationLockID); err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %v", err)
+	}
+	_, err = tx.Exec(`
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %v", err)
+	}
+	return tx.Commit()
+}
+
+// MigrationStatus lists every known migration and whether it is applied
+func (db *DB) MigrationStatus() ([]MigrationStatus, error) {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.createMigrationsTable(); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.conn.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("error reading schema_migrations: %v", err)
+	}
+	defer rows.Close()
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, fmt.Errorf("error reading schema_migrations: %v", err)
+		}
+		applied[version] = appliedAt
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading schema_migrations: %v", err)
+	}
+
+	status := make([]MigrationStatus, len(migrations))
+	for i, migration := range migrations {
+		appliedAt, ok := applied[migration.Version]
+		status[i] = MigrationStatus{Migration: migration, Applied: ok, AppliedAt: appliedAt}
+	}
+	return status, nil
+}
+
+// MigrateUp applies up to steps pending migrations in version order, all of
+// them if steps is 0, and returns those it applied
+func (db *DB) MigrateUp(steps int) ([]Migration, error) {
+	status, err := db.MigrationStatus()
+	if err != nil {
+		return nil, err
+	}
+	var done []Migration
+	for _, s := range status {
+		if s.Applied {
+			continue
+		}
+		if steps > 0 && len(done) == steps {
+			break
+		}
+		if err := db.runMigration(s.Migration, true); err != nil {
+			return done, err
+		}
+		done = append(done, s.Migration)
+	}
+	return done, nil
+}
+
+// MigrateDown reverts the steps most recently applied migrations and
+// returns those it reverted
+func (db *DB) MigrateDown(steps int) ([]Migration, error) {
+	status, err := db.MigrationStatus()
+	if err != nil {
+		return nil, err
+	}
+	var done []Migration
+	for i := len(status) - 1; i >= 0 && len(done) < steps; i-- {
+		if !status[i].Applied {
+			continue
+		}
+		if err := db.runMigration(status[i].Migration, false); err != nil {
+			return done, err
+		}
+		done = append(done, status[i].Migration)
+	}
+	return done, nil
+}
+
+// runMigration applies (up) or reverts a migration and records it in
+// schema_migrations in one transaction. Another instance may have done the
+// same while this one waited for the lock, which leaves nothing to do
+func (db *DB) runMigration(migration Migration, up bool) error {
+	direction, script := "down", migration.Down
+	if up {
+		direction, script = "up", migration.Up
+	}
+	label := fmt.Sprintf("%04d_%s (%s)", migration.Version, migration.Name, direction)
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("migration %s: %v", label, err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", migrationLockID); err != nil {
+		return fmt.Errorf("migration %s: %v", label, err)
+	}
+	var applied bool
+	err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM schema_migrations WHERE version = $1)", migration.Version).Scan(&applied)
+	if err != nil {
+		return fmt.Errorf("migration %s: %v", label, err)
+	}
+	if applied == up {
+		return nil
+	}
+
+	if _, err := tx.Exec(script); err != nil {
+		return fmt.Errorf("migration %s failed: %v", label, err)
+	}
+	if up {
+		_, err = tx.Exec("INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", migration.Version, migration.Name)
+	} else {
+		_, err = tx.Exec("DELETE FROM schema_migrations WHERE version = $1", migration.Version)
+	}
+	if err != nil {
+		return fmt.Errorf("migration %s: %v", label, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("migration %s: %v", label, err)
+	}
+	log.Printf("Applied migration %s\n", label)
+	return nil
+}
@@ -0,0 +1,84 @@
+package db
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("no migrations embedded")
+	}
+	for i, migration := range migrations {
+		if migration.Version != i+1 {
+			t.Errorf("migration %d_%s has version %d, want %d", migration.Version, migration.Name, migration.Version, i+1)
+		}
+		if strings.TrimSpace(migration.Up) == "" || strings.TrimSpace(migration.Down) == "" {
+			t.Errorf("migration %d_%s has an empty script", migration.Version, migration.Name)
+		}
+	}
+}
+
+func TestLoadMigrationsOrder(t *testing.T) {
+	fsys := fstest.MapFS{
+		"migrations/0010_ten.up.sql":    {Data: []byte("up 10")},
+		"migrations/0010_ten.down.sql":  {Data: []byte("down 10")},
+		"migrations/0002_two.down.sql":  {Data: []byte("down 2")},
+		"migrations/0002_two.up.sql":    {Data: []byte("up 2")},
+		"migrations/0001_one.up.sql":    {Data: []byte("up 1")},
+		"migrations/0001_one.down.sql":  {Data: []byte("down 1")},
+		"migrations/0009_nine.up.sql":   {Data: []byte("up 9")},
+		"migrations/0009_nine.down.sql": {Data: []byte("down 9")},
+	}
+	migrations, err := loadMigrations(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Migration{
+		{1, "one", "up 1", "down 1"},
+		{2, "two", "up 2", "down 2"},
+		{9, "nine", "up 9", "down 9"},
+		{10, "ten", "up 10", "down 10"},
+	}
+	if len(migrations) != len(want) {
+		t.Fatalf("got %d migrations, want %d", len(migrations), len(want))
+	}
+	for i := range want {
+		if migrations[i] != want[i] {
+			t.Errorf("migration %d is %+v, want %+v", i, migrations[i], want[i])
+		}
+	}
+}
+
+func TestLoadMigrationsErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+		want  string
+	}{
+		{"missing down", []string{"0001_one.up.sql", "0002_two.up.sql", "0002_two.down.sql"}, "0001_one needs both"},
+		{"missing up", []string{"0001_one.down.sql"}, "0001_one needs both"},
+		{"names differ", []string{"0001_one.up.sql", "0001_first.down.sql"}, "named both"},
+		{"same version twice", []string{"0001_one.up.sql", "1_one.up.sql", "0001_one.down.sql"}, "more than one up file"},
+		{"no direction", []string{"0001_one.sql"}, "unexpected migration file"},
+		{"not sql", []string{"0001_one.up.txt"}, "unexpected migration file"},
+		{"no version", []string{"one.up.sql"}, "unexpected migration file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := fstest.MapFS{}
+			for _, name := range tt.files {
+				fsys["migrations/"+name] = &fstest.MapFile{Data: []byte("SELECT 1;")}
+			}
+			_, err := loadMigrations(fsys)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("loadMigrations() = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS mail;
+DROP TABLE IF EXISTS users;
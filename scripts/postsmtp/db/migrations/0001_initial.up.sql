@@ -0,0 +1,19 @@
+-- Tables postsmtp created before migrations were versioned. IF NOT EXISTS
+-- lets databases set up by CreateTables adopt this migration as applied.
+
+CREATE TABLE IF NOT EXISTS users (
+	id SERIAL PRIMARY KEY,
+	username VARCHAR(255) UNIQUE NOT NULL,
+	password TEXT NOT NULL,
+	salt TEXT NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS mail (
+	uid UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+	recipient VARCHAR(255) NOT NULL,
+	sender VARCHAR(255) NOT NULL,
+	headers JSONB NOT NULL,
+	message TEXT NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,21 @@
+-- Columns of the backend's User entity that postsmtp did not create
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email TEXT;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP;
+
+-- TypeORM schema synchronization created these under the property names
+-- before the entities were mapped to snake_case columns
+DO $$
+BEGIN
+	IF EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'createdAt') THEN
+		UPDATE users SET created_at = "createdAt" WHERE created_at IS NULL;
+		ALTER TABLE users DROP COLUMN "createdAt";
+	END IF;
+	IF EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'updatedAt') THEN
+		UPDATE users SET updated_at = "updatedAt";
+		ALTER TABLE users DROP COLUMN "updatedAt";
+	END IF;
+	IF EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'mail' AND column_name = 'createdAt') THEN
+		UPDATE mail SET created_at = "createdAt" WHERE created_at IS NULL;
+		ALTER TABLE mail DROP COLUMN "createdAt";
+	END IF;
+END $$;
@@ -0,0 +1,14 @@
+DROP TABLE attachments;
+DROP INDEX mail_recipient;
+DROP INDEX mail_message_uid;
+
+-- Every mail row gets its own copy of the message back
+ALTER TABLE mail ADD COLUMN sender VARCHAR(255), ADD COLUMN headers JSONB, ADD COLUMN message TEXT;
+UPDATE mail SET sender = messages.sender, headers = messages.headers, message = messages.body
+FROM messages WHERE messages.uid = mail.message_uid;
+ALTER TABLE mail ALTER COLUMN sender SET NOT NULL;
+ALTER TABLE mail ALTER COLUMN headers SET NOT NULL;
+ALTER TABLE mail ALTER COLUMN message SET NOT NULL;
+ALTER TABLE mail DROP COLUMN message_uid;
+
+DROP TABLE messages;
@@ -0,0 +1,47 @@
+-- Every message is stored once, however many recipients it has, and mail
+-- keeps only what belongs to one mailbox
+
+CREATE TABLE messages (
+	uid UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+	sender VARCHAR(255) NOT NULL,
+	headers JSONB NOT NULL,
+	header_fields JSONB NOT NULL,
+	body TEXT NOT NULL,
+	html TEXT,
+	-- Null for mail the backend sends and mail stored before messages were
+	-- parsed
+	parts JSONB,
+	raw BYTEA,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX messages_sender ON messages (sender);
+
+-- Existing mail becomes a message of the same uid, with header_fields built
+-- from its flat headers map
+INSERT INTO messages (uid, sender, headers, header_fields, body, created_at)
+SELECT uid, sender, headers,
+	(SELECT COALESCE(jsonb_agg(jsonb_build_object('name', key, 'value', value)), '[]'::jsonb)
+	 FROM jsonb_each_text(mail.headers)),
+	message, created_at
+FROM mail;
+
+ALTER TABLE mail ADD COLUMN message_uid UUID REFERENCES messages(uid) ON DELETE CASCADE;
+UPDATE mail SET message_uid = uid;
+ALTER TABLE mail ALTER COLUMN message_uid SET NOT NULL;
+ALTER TABLE mail DROP COLUMN sender, DROP COLUMN headers, DROP COLUMN message;
+CREATE INDEX mail_message_uid ON mail (message_uid);
+CREATE INDEX mail_recipient ON mail (recipient);
+
+-- Attachment data is kept in the blob store under its checksum
+CREATE TABLE attachments (
+	id SERIAL PRIMARY KEY,
+	message_uid UUID NOT NULL REFERENCES messages(uid) ON DELETE CASCADE,
+	position INTEGER NOT NULL,
+	filename TEXT,
+	content_type VARCHAR(255) NOT NULL,
+	size BIGINT NOT NULL,
+	content_id TEXT,
+	checksum CHAR(64) NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX attachments_message_uid ON attachments (message_uid);
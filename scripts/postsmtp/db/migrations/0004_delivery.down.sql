@@ -0,0 +1,5 @@
+DROP TABLE pgp_keys;
+DROP VIEW delivery_status;
+DROP TABLE delivery_attempts;
+DROP TABLE mail_preferences;
+DROP TABLE suppressions;
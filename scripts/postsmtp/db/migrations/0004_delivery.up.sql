@@ -0,0 +1,59 @@
+-- Tables sendsmtp reads and writes. postsmtp adds to suppressions from
+-- incoming reports and marks VERP bounces in delivery_attempts
+
+-- Recipients sendsmtp does not deliver to
+CREATE TABLE suppressions (
+	address VARCHAR(255) PRIMARY KEY,
+	reason VARCHAR(32) NOT NULL,
+	source VARCHAR(32) NOT NULL,
+	detail TEXT,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Unsubscribes from a single list; suppressions covers all mail
+CREATE TABLE mail_preferences (
+	address VARCHAR(255) NOT NULL,
+	list VARCHAR(64) NOT NULL,
+	unsubscribed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (address, list)
+);
+
+-- Every attempt to hand a message to an MX
+CREATE TABLE delivery_attempts (
+	id BIGSERIAL PRIMARY KEY,
+	mail_uid UUID,
+	message_id TEXT NOT NULL,
+	recipient VARCHAR(255) NOT NULL,
+	status VARCHAR(16) NOT NULL,
+	mx_host VARCHAR(255),
+	reply_code INTEGER,
+	enhanced_code VARCHAR(16),
+	reply_text TEXT,
+	tls BOOLEAN NOT NULL DEFAULT FALSE,
+	tls_verified BOOLEAN NOT NULL DEFAULT FALSE,
+	tls_version VARCHAR(16),
+	started_at TIMESTAMP NOT NULL,
+	finished_at TIMESTAMP NOT NULL
+);
+CREATE INDEX delivery_attempts_mail_uid_idx ON delivery_attempts (mail_uid, recipient);
+
+-- Latest attempt per recipient, which is what the UI shows as "delivered",
+-- "deferred" or "bounced"
+CREATE VIEW delivery_status AS
+SELECT DISTINCT ON (mail_uid, recipient)
+	mail_uid, recipient, status, mx_host, reply_code, enhanced_code, reply_text,
+	tls, tls_verified, finished_at AS updated_at
+FROM delivery_attempts
+WHERE mail_uid IS NOT NULL
+ORDER BY mail_uid, recipient, finished_at DESC, id DESC;
+
+-- OpenPGP keys sendsmtp signs and encrypts with
+CREATE TABLE pgp_keys (
+	address VARCHAR(255) PRIMARY KEY,
+	fingerprint VARCHAR(64) NOT NULL,
+	public_key TEXT NOT NULL,
+	private_key TEXT,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
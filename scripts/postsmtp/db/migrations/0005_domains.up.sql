@@ -0,0 +1,5 @@
+-- Domains postsmtp accepts mail for, in addition to SMTP_LOCAL_DOMAINS
+CREATE TABLE domains (
+	domain VARCHAR(255) PRIMARY KEY,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
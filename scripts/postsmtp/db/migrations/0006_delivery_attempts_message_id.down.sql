@@ -0,0 +1 @@
+DROP INDEX delivery_attempts_message_id_idx;
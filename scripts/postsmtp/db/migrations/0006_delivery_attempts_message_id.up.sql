@@ -0,0 +1,2 @@
+-- postsmtp looks up the message a report at the bounce address returns
+CREATE INDEX delivery_attempts_message_id_idx ON delivery_attempts (btrim(message_id, '<>'));
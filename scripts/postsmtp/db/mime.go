@@ -0,0 +1,230 @@
+package db
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"log"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// maxPartDepth bounds how deeply multiparts and attached messages are
+// parsed; anything nested deeper is kept as a single part
+const maxPartDepth = 32
+
+// Part is a node of the MIME tree of a received message. The root is the
+// message itself; multipart entities and attached messages (message/rfc822)
+// have children in Parts. Body is the content as received, without decoding
+// its Content-Transfer-Encoding
+type Part struct {
+	ContentType string            `json:"content_type"`
+	Params      map[string]string `json:"params,omitempty"`
+	Headers     Header            `json:"headers"`
+	Size        int               `json:"size"`
+	Parts       []*Part           `json:"parts,omitempty"`
+	Attachment  string            `json:"attachment,omitempty"` // checksum of the row in attachments
+	Body        []byte            `json:"-"`
+
+	header textproto.MIMEHeader
+}
+
+// ParseMessage parses a message into its MIME tree. Messages without a
+// header/body separator or with broken multiparts still yield a tree: what
+// cannot be parsed is kept as the body of the part it belongs to
+func ParseMessage(data []byte) *Part {
+	header, fields, body, err := readMessage(data)
+	if err != nil {
+		log.Printf("[ParseMessage] Could not parse message header, storing it as body: %v\n", err)
+		return newPart(textproto.MIMEHeader{}, nil, data, "text/plain", 0)
+	}
+	return newPart(header, fields, body, "text/plain", 0)
+}
+
+// readMessage splits a message into its header, as parsed by net/mail and
+// as ordered fields, and its body
+func readMessage(data []byte) (textproto.MIMEHeader, Header, []byte, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	body, err := io.ReadAll(msg.Body)
+	if err != nil {
+		log.Printf("[ParseMessage] Error reading message body: %v\n", err)
+	}
+	return textproto.MIMEHeader(msg.Header), scanHeader(data), body, nil
+}
+
+// newPart builds the part with the given header and body and parses its
+// children. fields is the header in received order, or nil to list header
+// instead. defaultType applies when the part has no usable Content-Type,
+// which is text/plain except inside multipart/digest (RFC 2046 5.1.5)
+func newPart(header textproto.MIMEHeader, fields Header, body []byte, defaultType string, depth int) *Part {
+	if fields == nil {
+		fields = headerFields(header)
+	}
+	p := &Part{
+		ContentType: defaultType,
+		Headers:     fields.decoded(),
+		Size:        len(body),
+		Body:        body,
+		header:      header,
+	}
+	if value := header.Get("Content-Type"); value != "" {
+		// Parameters that fail to parse are dropped, the media type is kept
+		mediaType, params, _ := parseMediaType(value)
+		if mediaType != "" {
+			p.ContentType = mediaType
+			p.Params = params
+		}
+	}
+	if len(p.Params) == 0 {
+		p.Params = nil
+	}
+
+	if depth >= maxPartDepth {
+		log.Printf("[ParseMessage] Parts nested deeper than %d levels are not parsed\n", maxPartDepth)
+		return p
+	}
+	switch {
+	case strings.HasPrefix(p.ContentType, "multipart/"):
+		p.Parts = parseMultipart(body, p.Params["boundary"], p.ContentType == "multipart/digest", depth)
+	case p.ContentType == "message/rfc822" || p.ContentType == "message/global":
+		if header, fields, inner, err := readMessage(body); err == nil {
+			p.Parts = []*Part{newPart(header, fields, inner, "text/plain", depth+1)}
+		}
+	}
+	return p
+}
+
+// parseMultipart splits a multipart body into its parts. Parts read before
+// an error are kept
+func parseMultipart(body []byte, boundary string, digest bool, depth int) []*Part {
+	if boundary == "" {
+		log.Printf("[ParseMessage] Multipart without boundary, keeping it as a single part\n")
+		return nil
+	}
+	defaultType := "text/plain"
+	if digest {
+		defaultType = "message/rfc822"
+	}
+
+	var parts []*Part
+	mr := multipart.NewReader(bytes.NewReader(body), boundary)
+	for {
+		// NextRawPart leaves quoted-printable content as received
+		part, err := mr.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("[ParseMessage] Error reading part %d: %v\n", len(parts)+1, err)
+			break
+		}
+		content, err := io.ReadAll(part)
+		if err != nil {
+			log.Printf("[ParseMessage] Error reading part %d: %v\n", len(parts)+1, err)
+			break
+		}
+		parts = append(parts, newPart(part.Header, nil, content, defaultType, depth+1))
+	}
+	return parts
+}
+
+// isAttachment reports whether the part was sent as an attachment rather
+// than for display
+func (p *Part) isAttachment() bool {
+	disposition, _, _ := parseMediaType(p.header.Get("Content-Disposition"))
+	return disposition == "attachment"
+}
+
+// Decoded returns the body with its Content-Transfer-Encoding removed.
+// Unknown encodings and 7bit, 8bit or binary bodies are returned as received
+func (p *Part) Decoded() ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(p.header.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		// Line breaks and other whitespace are not part of the encoding
+		encoded := strings.Map(func(r rune) rune {
+			if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+				return -1
+			}
+			return r
+		}, string(p.Body))
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			// Some senders omit the padding
+			decoded, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(encoded, "="))
+		}
+		return decoded, err
+	case "quoted-printable":
+		return io.ReadAll(quotedprintable.NewReader(bytes.NewReader(p.Body)))
+	default:
+		return p.Body, nil
+	}
+}
+
+// Text returns the content of the part as UTF-8: the transfer encoding is
+// removed and the declared charset converted, see toUTF8. A body whose
+// transfer encoding is broken is converted as received
+func (p *Part) Text() string {
+	data, err := p.Decoded()
+	if err != nil {
+		log.Printf("[ParseMessage] Error decoding %s part, using it as received: %v\n", p.ContentType, err)
+		data = p.Body
+	}
+	return toUTF8(data, p.Params["charset"])
+}
+
+// PlainText returns the text of the first text/plain part that is not an
+// attachment, without descending into attached messages. Without one, or
+// when it is empty, the HTML body is rendered as text; a message with
+// neither yields the body of the root part, as received. Lines end in LF
+// whatever the message used
+func (p *Part) PlainText() string {
+	if text := p.findBody("text/plain"); text != nil {
+		if body := strings.TrimSpace(text.Text()); body != "" {
+			return normalizeNewlines(body)
+		}
+	}
+	if body := p.HTML(); body != "" {
+		return htmlToText(body)
+	}
+	if p.findBody("text/plain") != nil {
+		return ""
+	}
+	return normalizeNewlines(cleanText(string(p.Body)))
+}
+
+// HTML returns the text of the first text/html part that is not an
+// attachment, or "" if there is none. Like PlainText, lines end in LF
+func (p *Part) HTML() string {
+	if html := p.findBody("text/html"); html != nil {
+		return normalizeNewlines(strings.TrimSpace(html.Text()))
+	}
+	return ""
+}
+
+// normalizeNewlines turns CRLF and bare CR into LF, the line ending of the
+// text and HTML bodies stored for a message
+func normalizeNewlines(text string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(text, "\r\n", "\n"), "\r", "\n")
+}
+
+// findBody returns the first displayed part of the given content type
+func (p *Part) findBody(contentType string) *Part {
+	if p.ContentType == contentType && !p.isAttachment() {
+		return p
+	}
+	if !strings.HasPrefix(p.ContentType, "multipart/") {
+		return nil
+	}
+	for _, child := range p.Parts {
+		if body := child.findBody(contentType); body != nil {
+			return body
+		}
+	}
+	return nil
+}
@@ -0,0 +1,350 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// shape renders the content types of a MIME tree, e.g.
+// multipart/alternative(text/plain,text/html)
+func shape(p *Part) string {
+	if len(p.Parts) == 0 {
+		return p.ContentType
+	}
+	children := make([]string, len(p.Parts))
+	for i, child := range p.Parts {
+		children[i] = shape(child)
+	}
+	return p.ContentType + "(" + strings.Join(children, ",") + ")"
+}
+
+func TestParseMessageFixtures(t *testing.T) {
+	tests := []struct {
+		file    string
+		shape   string
+		text    string
+		subject string
+	}{
+		{
+			file:    "plain.eml",
+			shape:   "text/plain",
+			text:    "Hi Bob,\n\nAre you free for lunch on Thursday? The usual place at 12:30.\n\n--\nAlice",
+			subject: "Lunch on Thursday?",
+		},
+		{
+			file:    "alternative.eml",
+			shape:   "multipart/alternative(text/plain,text/html)",
+			text:    "Notes from today are below.\n\n- ship the release on Friday\n- Dave owns the changelog",
+			subject: "Meeting notes",
+		},
+		{
+			file:    "nested.eml",
+			shape:   "multipart/mixed(multipart/related(multipart/alternative(text/plain,text/html),image/png),application/pdf)",
+			text:    "Hi Bob,\n\nthe invoice for October is attached.\n\nErin",
+			subject: "Invoice for October",
+		},
+		{
+			file:    "quoted-boundary.eml",
+			shape:   "multipart/alternative(text/plain,text/html)",
+			text:    "Thanks, the quote is fine.\n\n> -----Original Message-----\n> Content-Type: multipart/alternative; boundary=\"----=_NextPart_000_0001\"\n>\n> ------=_NextPart_000_0001_01DC3F22.8D0B5F60\n> Please find our quote below.",
+			subject: "RE: Quote",
+		},
+		{
+			file:    "untyped-parts.eml",
+			shape:   "multipart/mixed(text/plain,text/plain)",
+			text:    "This part has no headers at all and is text/plain by default.",
+			subject: "Report",
+		},
+		{
+			file:    "html-only.eml",
+			shape:   "text/html",
+			text:    "Good news, Bob!\n\nYour order #48213 is on its way. Expected delivery: Wednesday.\n\n- 1 × USB-C cable\n- 2 × AA batteries\n\nTrack your parcel [https://shop.example/track/48213]\n\nShop & Co Ltd\nhttps://shop.example/unsubscribe",
+			subject: "Your order has shipped",
+		},
+		{
+			file:    "charsets.eml",
+			shape:   "multipart/mixed(multipart/alternative(text/plain,text/html),text/plain)",
+			text:    "Grüße aus München – bis bald, € 5. Dieser Satz ist länger als eine Zeile.",
+			subject: "Gruesse",
+		},
+		{
+			file:    "digest.eml",
+			shape:   "multipart/mixed(text/plain,multipart/digest(message/rfc822(text/plain)))",
+			text:    "Today's Topics:\n\n   1. Re: build fails on arm64 (Heidi)",
+			subject: "example-users Digest, Vol 12, Issue 3",
+		},
+		{
+			file:    "alternative-attachments.eml",
+			shape:   "multipart/mixed(multipart/alternative(text/plain,text/html),application/vnd.openxmlformats-officedocument.spreadsheetml.sheet,image/jpeg)",
+			text:    "Hi Bob,\n\nattached is the draft budget for 2026 and a photo of the whiteboard from Friday's session. Please send me your comments by Thursday.\n\nGrüße,\nFrank",
+			subject: "Budget 2026 - draft for review",
+		},
+		{
+			// The text of the forwarded message is not the text of this one
+			file:    "forwarded.eml",
+			shape:   "multipart/mixed(text/plain,message/rfc822(multipart/mixed(multipart/alternative(text/plain,text/html),application/pdf)))",
+			text:    "Bob, FYI - Grace's plan for the migration, see the attached message.\n\nHeidi",
+			subject: "Fwd: Re: Server migration",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			root := ParseMessage(data)
+			if got := shape(root); got != tt.shape {
+				t.Errorf("shape = %s, want %s", got, tt.shape)
+			}
+			if got := root.PlainText(); got != tt.text {
+				t.Errorf("PlainText() = %q, want %q", got, tt.text)
+			}
+			if got := root.Headers.Get("Subject"); got != tt.subject {
+				t.Errorf("subject = %q, want %q", got, tt.subject)
+			}
+			if _, err := json.Marshal(root); err != nil {
+				t.Errorf("marshaling parts: %v", err)
+			}
+		})
+	}
+}
+
+func TestParseMessagePartHeaders(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "nested.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := ParseMessage(data)
+	logo := root.Parts[0].Parts[1]
+	if got := logo.Headers.Get("Content-ID"); got != "<logo@example.com>" {
+		t.Errorf("content-id = %q", got)
+	}
+	if got := logo.Params["name"]; got != "logo.png" {
+		t.Errorf("name parameter = %q", got)
+	}
+	if got := logo.Headers.Get("Content-Transfer-Encoding"); got != "base64" {
+		t.Errorf("content-transfer-encoding = %q", got)
+	}
+	if root.Parts[1].Size == 0 {
+		t.Error("attachment size is 0")
+	}
+}
+
+func TestHTML(t *testing.T) {
+	tests := []struct {
+		file string
+		html string
+	}{
+		{"plain.eml", ""},
+		{"alternative.eml", "<!DOCTYPE html>\n<html>\n  <body>\n    <p>Notes from today are below.</p>\n    <ul><li>ship the release on Friday</li><li>Dave owns the changelog</li></ul>\n  </body>\n</html>"},
+		{"untyped-parts.eml", ""},
+		{"charsets.eml", "<p>Grüße aus München – bis bald, € 5</p>"},
+		{"forwarded.eml", ""},
+	}
+	for _, tt := range tests {
+		data, err := os.ReadFile(filepath.Join("testdata", tt.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ParseMessage(data).HTML(); got != tt.html {
+			t.Errorf("%s: HTML() = %q, want %q", tt.file, got, tt.html)
+		}
+	}
+
+	// An empty text part is a placeholder, the HTML part is rendered instead
+	root := ParseMessage([]byte("Content-Type: multipart/alternative; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\n\r\n" +
+		"--b\r\nContent-Type: text/html\r\n\r\n<p>Hello&nbsp;<b>there</b></p>\r\n--b--\r\n"))
+	if got := root.PlainText(); got != "Hello there" {
+		t.Errorf("PlainText() = %q, want rendering of the HTML part", got)
+	}
+}
+
+func TestParseMessageForwarded(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "forwarded.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	attached := ParseMessage(data).Parts[1].Parts[0]
+	if got := attached.Headers.Get("Subject"); got != "Re: Server migration" {
+		t.Errorf("attached message subject = %q", got)
+	}
+	if got := attached.PlainText(); got != "Heidi,\n\nthe cut-over plan is attached. The old host goes read-only on Saturday.\n\nGrace" {
+		t.Errorf("attached message PlainText() = %q", got)
+	}
+	if got := attached.HTML(); !strings.HasPrefix(got, "<html><body><p>Heidi,</p>") {
+		t.Errorf("attached message HTML() = %q", got)
+	}
+}
+
+func TestNormalizeNewlines(t *testing.T) {
+	// Bare CR, bare LF and CRLF in one body all end up as LF
+	root := ParseMessage([]byte("Content-Type: text/plain\r\n\r\none\r\ntwo\rthree\nfour\r\n"))
+	if got := root.PlainText(); got != "one\ntwo\nthree\nfour" {
+		t.Errorf("PlainText() = %q", got)
+	}
+	root = ParseMessage([]byte("Subject: x\r\nContent-Type: text/html\r\n\r\n<p>a</p>\r\n<p>b</p>\r<p>c</p>\r\n"))
+	if got := root.HTML(); got != "<p>a</p>\n<p>b</p>\n<p>c</p>" {
+		t.Errorf("HTML() = %q", got)
+	}
+	if got := root.PlainText(); got != "a\n\nb\n\nc" {
+		t.Errorf("PlainText() of HTML = %q", got)
+	}
+}
+
+func TestToUTF8(t *testing.T) {
+	tests := []struct {
+		data    string
+		charset string
+		want    string
+	}{
+		{"plain ascii", "", "plain ascii"},
+		{"caf\xc3\xa9", "UTF-8", "café"},
+		{"caf\xe9", "utf-8", "caf\uFFFD"},
+		{"caf\xe9", "iso-8859-1", "café"},
+		{"\x93quoted\x94", "windows-1252", "\u201cquoted\u201d"},
+		{"\xa4", "ISO-8859-15", "€"},
+		{"\xc4\xe9", "koi8-r", "дИ"},
+		{"\x1b$B$3$s$K$A$O\x1b(B", "iso-2022-jp", "こんにちは"},
+		// Undeclared, unknown or wrongly declared 8-bit text
+		{"caf\xe9", "", "café"},
+		{"caf\xc3\xa9", "", "café"},
+		{"caf\xe9", "us-ascii", "café"},
+		{"caf\xe9", "x-no-such-charset", "café"},
+		{"nul\x00byte", "", "nulbyte"},
+	}
+	for _, tt := range tests {
+		if got := toUTF8([]byte(tt.data), tt.charset); got != tt.want {
+			t.Errorf("toUTF8(%q, %q) = %q, want %q", tt.data, tt.charset, got, tt.want)
+		}
+	}
+}
+
+func TestEncodedHeaders(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "encoded-words.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := ParseMessage(data)
+	headers := map[string]string{
+		"subject":      "Échange de documents ✓",
+		"from":         "André Martin <andre@example.fr>",
+		"to":           `Привет <privet@example.ru>, "Bob" <bob@example.com>`,
+		"thread-topic": "日本語",
+		"message-id":   "<encoded-words-1@example.fr>",
+	}
+	for name, want := range headers {
+		if got := root.Headers.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	for _, field := range root.Headers {
+		switch field.Name {
+		case "Subject":
+			if !strings.HasPrefix(field.Raw, "=?UTF-8?B?w4ljaGFuZ2UgZGUg?=") {
+				t.Errorf("raw subject = %q", field.Raw)
+			}
+		case "Message-ID":
+			if field.Raw != "" {
+				t.Errorf("unchanged Message-ID kept as raw value %q", field.Raw)
+			}
+		}
+	}
+
+	var names []string
+	for _, part := range root.Attachments() {
+		names = append(names, part.filename())
+	}
+	want := []string{"Résumé détaillé.pdf", "Kostenübersicht.xlsx", "€-Preise.txt"}
+	if strings.Join(names, "|") != strings.Join(want, "|") {
+		t.Errorf("filenames = %q, want %q", names, want)
+	}
+}
+
+func TestParseMediaTypeRFC2231(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{`attachment; filename*=iso-8859-1''r%E9sum%E9.pdf`, "résumé.pdf"},
+		// Characters that are not attribute-char must stay percent-encoded
+		{`attachment; filename*=iso-8859-1''a%3Db%40c%3Ad%26e%2Bf%24g%E9.txt`, "a=b@c:d&e+f$gé.txt"},
+		{`attachment; filename*0*=iso-8859-1''%E9t%E9%20%3D%20;filename*1*=%40%26%2B%24.txt`, "été = @&+$.txt"},
+		{`attachment; filename*=utf-8''a%3Db%40c.txt`, "a=b@c.txt"},
+	}
+	for _, tt := range tests {
+		mediaType, params, err := parseMediaType(tt.value)
+		if err != nil || mediaType != "attachment" {
+			t.Errorf("parseMediaType(%q) = %q, %v", tt.value, mediaType, err)
+			continue
+		}
+		if params["filename"] != tt.want {
+			t.Errorf("parseMediaType(%q) filename = %q, want %q", tt.value, params["filename"], tt.want)
+		}
+	}
+}
+
+func TestHeaderOrder(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "plain.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := ParseMessage(data)
+
+	var names []string
+	for _, field := range root.Headers {
+		names = append(names, field.Name)
+	}
+	want := "Return-Path Received Received From To Subject Date Message-ID"
+	if got := strings.Join(names, " "); got != want {
+		t.Errorf("field order = %s, want %s", got, want)
+	}
+
+	received := root.Headers.Values("received")
+	if len(received) != 2 ||
+		received[0] != "from mail.example.org (mail.example.org [192.0.2.10]) by mx.example.com with ESMTPS id 4A1B2C3D for <bob@example.com>; Tue, 14 Oct 2025 09:12:03 +0000" ||
+		!strings.HasPrefix(received[1], "by mail.example.org (Postfix") {
+		t.Errorf("Received = %q", received)
+	}
+
+	flat := root.Headers.Map()
+	if flat["received"] != received[0]+", "+received[1] || flat["message-id"] != "<20251014091202.9F8E7D6C@mail.example.org>" {
+		t.Errorf("Map() = %v", flat)
+	}
+}
+
+func TestCompressRaw(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "quoted-boundary.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, err := compressRaw(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decompressRaw(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("raw message changed by compression")
+	}
+}
+
+func TestParseMessageWithoutBody(t *testing.T) {
+	root := ParseMessage([]byte("Subject: only headers\r\n"))
+	if root.Headers.Get("Subject") != "only headers" || root.PlainText() != "" {
+		t.Errorf("got headers %v, text %q", root.Headers, root.PlainText())
+	}
+
+	root = ParseMessage([]byte("no header here at all"))
+	if root.PlainText() != "no header here at all" {
+		t.Errorf("PlainText() = %q", root.PlainText())
+	}
+}
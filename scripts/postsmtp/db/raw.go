@@ -0,0 +1,60 @@
+package db
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrMailNotFound is returned for a uid without a row in the mail table
+var ErrMailNotFound = errors.New("mail not found")
+
+// compressRaw gzips the message as received in DATA for the raw column
+func compressRaw(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompressRaw(compressed []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
+// RawMessage returns the exact bytes received in DATA for mail uid, for
+// re-parsing, export, forwarding or DKIM verification. Mail without a
+// stored raw source, such as mail the backend sent or mail received before
+// sources were kept, yields ErrMailNotFound as well
+func (db *DB) RawMessage(uid string) ([]byte, error) {
+	var compressed []byte
+	err := db.conn.QueryRow(`
+		SELECT messages.raw FROM mail
+		JOIN messages ON messages.uid = mail.message_uid
+		WHERE mail.uid = $1 AND messages.raw IS NOT NULL`,
+		uid,
+	).Scan(&compressed)
+	if err == sql.ErrNoRows {
+		return nil, ErrMailNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error loading raw message %s: %v", uid, err)
+	}
+	data, err := decompressRaw(compressed)
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing raw message %s: %v", uid, err)
+	}
+	return data, nil
+}
@@ -0,0 +1,112 @@
+package db
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// RecipientError is why a recipient is refused, with the SMTP reply code
+// and enhanced status code (RFC 3463) that say so
+type RecipientError struct {
+	Code     int
+	Enhanced string
+	Message  string
+}
+
+func (e *RecipientError) Error() string {
+	return fmt.Sprintf("%d %s %s", e.Code, e.Enhanced, e.Message)
+}
+
+// Temporary reports whether the recipient may be accepted on a later try,
+// as when the database could not be queried
+func (e *RecipientError) Temporary() bool {
+	return e.Code >= 400 && e.Code < 500
+}
+
+// recipientStore is the part of DB that RecipientValidator queries
+type recipientStore interface {
+	ValidateRecipient(username string) (bool, error)
+	IsLocalDomain(domain string) (bool, error)
+}
+
+// RecipientValidator accepts recipients whose domain is local and whose
+// local part is a user. Local domains are those configured when it is
+// created and those in the domains table
+type RecipientValidator struct {
+	domains map[string]bool
+	store   recipientStore
+}
+
+// NewRecipientValidator returns a validator treating domains and the
+// entries of the domains table of database as local
+func NewRecipientValidator(domains []string, database *DB) *RecipientValidator {
+	return newRecipientValidator(domains, database)
+}
+
+func newRecipientValidator(domains []string, store recipientStore) *RecipientValidator {
+	v := &RecipientValidator{domains: make(map[string]bool), store: store}
+	for _, domain := range domains {
+		if domain = normalizeDomain(domain); domain != "" {
+			v.domains[domain] = true
+		}
+	}
+	return v
+}
+
+// normalizeDomain lowercases a domain and drops the trailing dot of a
+// fully qualified name
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+}
+
+// Check returns nil if mail for address is accepted, or a *RecipientError
+// with the reply to RCPT TO: 5.7.1 for a domain that is not local, since
+// postsmtp does not relay, 5.1.1 for an unknown user, and a temporary 4.3.0
+// when the domains or users table cannot be queried
+func (v *RecipientValidator) Check(address string) error {
+	address = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(address), "<"), ">")
+	at := strings.LastIndex(address, "@")
+	if at <= 0 || at == len(address)-1 {
+		return &RecipientError{Code: 501, Enhanced: "5.1.3", Message: fmt.Sprintf("bad recipient address syntax: %s", address)}
+	}
+	username, domain := address[:at], normalizeDomain(address[at+1:])
+
+	local, err := v.isLocal(domain)
+	if err != nil {
+		log.Printf("Error checking domain %s: %v\n", domain, err)
+		return &RecipientError{Code: 451, Enhanced: "4.3.0", Message: "temporary failure checking recipient domain"}
+	}
+	if !local {
+		return &RecipientError{Code: 550, Enhanced: "5.7.1", Message: fmt.Sprintf("relay access denied: %s is not a local domain", domain)}
+	}
+	exists, err := v.store.ValidateRecipient(username)
+	if err != nil {
+		log.Printf("Error checking user %s: %v\n", username, err)
+		return &RecipientError{Code: 451, Enhanced: "4.3.0", Message: "temporary failure checking recipient"}
+	}
+	if !exists {
+		return &RecipientError{Code: 550, Enhanced: "5.1.1", Message: fmt.Sprintf("mailbox unavailable: %s", address)}
+	}
+	return nil
+}
+
+func (v *RecipientValidator) isLocal(domain string) (bool, error) {
+	if v.domains[domain] {
+		return true, nil
+	}
+	return v.store.IsLocalDomain(domain)
+}
+
+// IsLocalDomain checks if domain is listed in the domains table
+func (db *DB) IsLocalDomain(domain string) (bool, error) {
+	var exists bool
+	err := db.conn.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM domains WHERE lower(domain) = $1)",
+		normalizeDomain(domain),
+	).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("error checking domain %s: %v", domain, err)
+	}
+	return exists, nil
+}
@@ -0,0 +1,91 @@
+package db
+
+import (
+	"errors"
+	"testing"
+)
+
+// fakeRecipientStore stands in for the users and domains tables
+type fakeRecipientStore struct {
+	users   map[string]bool
+	domains map[string]bool
+	err     error
+	userErr error
+}
+
+func (s *fakeRecipientStore) ValidateRecipient(username string) (bool, error) {
+	return s.users[username], s.userErr
+}
+
+func (s *fakeRecipientStore) IsLocalDomain(domain string) (bool, error) {
+	return s.domains[domain], s.err
+}
+
+func TestRecipientValidator(t *testing.T) {
+	store := &fakeRecipientStore{
+		users:   map[string]bool{"alice": true, "bob": true},
+		domains: map[string]bool{"mail.example.org": true},
+	}
+	v := newRecipientValidator([]string{"example.com", " Example.NET. ", ""}, store)
+
+	tests := []struct {
+		address  string
+		enhanced string // "" when accepted
+	}{
+		{"alice@example.com", ""},
+		{"<bob@example.com>", ""},
+		{"alice@EXAMPLE.com", ""},
+		{"alice@example.com.", ""},
+		{"alice@example.net", ""},
+		{"bob@mail.example.org", ""},
+		{"carol@example.com", "5.1.1"},
+		{"Alice@example.com", "5.1.1"},
+		{"alice@example.org", "5.7.1"},
+		{"alice@any-domain-at-all.test", "5.7.1"},
+		{"alice@example.com.evil.test", "5.7.1"},
+		{"alice@[192.0.2.1]", "5.7.1"},
+		{"alice", "5.1.3"},
+		{"@example.com", "5.1.3"},
+		{"alice@", "5.1.3"},
+	}
+	for _, tt := range tests {
+		err := v.Check(tt.address)
+		if tt.enhanced == "" {
+			if err != nil {
+				t.Errorf("Check(%q) = %v, want accepted", tt.address, err)
+			}
+			continue
+		}
+		var rerr *RecipientError
+		if !errors.As(err, &rerr) || rerr.Enhanced != tt.enhanced {
+			t.Errorf("Check(%q) = %v, want %s", tt.address, err, tt.enhanced)
+		}
+	}
+}
+
+func TestRecipientValidatorDomainLookupError(t *testing.T) {
+	store := &fakeRecipientStore{users: map[string]bool{"alice": true}, err: errors.New("connection refused")}
+	v := newRecipientValidator([]string{"example.com"}, store)
+
+	if err := v.Check("alice@example.com"); err != nil {
+		t.Errorf("configured domain needs no lookup, got %v", err)
+	}
+	var rerr *RecipientError
+	if err := v.Check("alice@example.org"); !errors.As(err, &rerr) || rerr.Code != 451 || !rerr.Temporary() {
+		t.Errorf("failed lookup = %v, want a temporary 451 failure", err)
+	}
+}
+
+func TestRecipientValidatorUserLookupError(t *testing.T) {
+	store := &fakeRecipientStore{userErr: errors.New("connection refused")}
+	v := newRecipientValidator([]string{"example.com"}, store)
+
+	// A failed lookup must not refuse the user as unknown
+	var rerr *RecipientError
+	if err := v.Check("alice@example.com"); !errors.As(err, &rerr) || rerr.Code != 451 || !rerr.Temporary() {
+		t.Errorf("failed lookup = %v, want a temporary 451 failure", err)
+	}
+	if err := v.Check("alice@example.org"); !errors.As(err, &rerr) || rerr.Enhanced != "5.7.1" || rerr.Temporary() {
+		t.Errorf("non-local domain = %v, want a permanent 5.7.1 refusal", err)
+	}
+}
@@ -13,10 +13,14 @@
 //   - Windows: go build -o postsmtp.exe
 //   - Unix/Linux: go build -o postsmtp
 //   - Cross-platform: go build (output name depends on OS)
+//
+// Schema migrations are applied on startup; "postsmtp migrate up [N]",
+// "postsmtp migrate down [N]" and "postsmtp migrate status" manage them
+// by hand.
 package main
 
 import (
-	"fmt"
+	"errors"
 	"log"
 	"net"
 	"os"
@@ -33,30 +37,55 @@ import (
 )
 
 type MessageHandler struct {
-	db *db.DB
+	db         *db.DB
+	recipients *db.RecipientValidator
+	// Mailboxes sendsmtp uses as envelope sender without VERP
+	bounceAddresses map[string]bool
 }
 
-func NewMessageHandler(database *db.DB) *MessageHandler {
-	return &MessageHandler{db: database}
+func NewMessageHandler(database *db.DB, recipients *db.RecipientValidator, bounceAddresses []string) *MessageHandler {
+	h := &MessageHandler{db: database, recipients: recipients, bounceAddresses: make(map[string]bool)}
+	for _, address := range bounceAddresses {
+		h.bounceAddresses[strings.ToLower(address)] = true
+	}
+	return h
 }
 
 func (h *MessageHandler) HandleMessage(conn net.Conn, mailFrom string, rcptTo []string, data []byte) error {
-	// Validate all recipients
+	// Bounces to VERP addresses are stored for the base mailbox
+	var bounces []*verpAddress
+	toBounceAddress := false
+	mailboxes := make([]string, 0, len(rcptTo))
 	for _, recipient := range rcptTo {
-		// Extract username from email (e.g., "user@domain.com" -> "user")
-		parts := strings.Split(recipient, "@")
-		if len(parts) == 0 {
-			return fmt.Errorf("invalid recipient format: %s", recipient)
+		if verp, ok := decodeVERP(recipient); ok {
+			log.Printf("VERP bounce address %s: mail %s, recipient %s\n", recipient, verp.MailUID, verp.Recipient)
+			bounces = append(bounces, verp)
+			recipient = verp.Base
+		} else if h.bounceAddresses[strings.ToLower(strings.Trim(recipient, "<> "))] {
+			toBounceAddress = true
 		}
-		username := parts[0]
+		mailboxes = append(mailboxes, recipient)
+	}
 
-		if !h.db.ValidateRecipient(username) {
-			return fmt.Errorf("recipient username not found: %s", username)
+	// Validate all recipients: the domain must be local and the user must exist
+	for _, recipient := range mailboxes {
+		if err := h.recipients.Check(recipient); err != nil {
+			return err
 		}
 	}
 
 	// Store the message
-	return h.db.StoreMessage(mailFrom, rcptTo, data)
+	if err := h.db.StoreMessage(mailFrom, mailboxes, data); err != nil {
+		return err
+	}
+
+	// Bounces and abuse reports for mail we sent feed sendsmtp's suppression
+	// list. Only the addresses sendsmtp returns them to are read
+	if len(bounces) > 0 || toBounceAddress {
+		reports, messageID := parseReports(data)
+		applyReports(h.db, bounces, toBounceAddress, reports, messageID)
+	}
+	return nil
 }
 
 func main() {
@@ -65,9 +94,25 @@ func main() {
 		log.Println("No .env file found, using environment variables")
 	}
 
+	// "postsmtp migrate ..." manages the schema instead of starting the server
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(os.Args[2:]); err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+		return
+	}
+
+	// Attachment data is kept in a local directory or an S3-compatible bucket
+	blobConfig := db.NewBlobConfigFromEnv()
+	blobs, err := blobConfig.Open()
+	if err != nil {
+		log.Fatalf("Failed to open blob store: %v", err)
+	}
+	log.Printf("Storing attachments in %s blob store\n", blobConfig.Store)
+
 	// Connect to PostgreSQL using db package
 	dbConfig := db.NewConfigFromEnv()
-	database, err := db.New(dbConfig.ConnectionString())
+	database, err := db.New(dbConfig.ConnectionString(), blobs)
 	if err != nil {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
@@ -85,8 +130,16 @@ func main() {
 
 	log.Printf("Starting SMTP server on %s:%s", serverAddress, serverPortStr)
 
+	// Mail is accepted for the local domains only: SMTP_LOCAL_DOMAINS and
+	// the domains table. Without either, SMTP_SERVER_DOMAIN is the one
+	localDomains := getEnvList("SMTP_LOCAL_DOMAINS", getEnv("SMTP_SERVER_DOMAIN", "localhost"))
+	log.Printf("Accepting mail for local domains %v and those in the domains table\n", localDomains)
+
 	// Create message handler
-	handler := NewMessageHandler(database)
+	// Reports at the bounce addresses (SMTP_BOUNCE_ADDRESSES) and VERP
+	// addresses update sendsmtp's suppression list
+	bounceAddresses := getEnvList("SMTP_BOUNCE_ADDRESSES", "")
+	handler := NewMessageHandler(database, db.NewRecipientValidator(localDomains, database), bounceAddresses)
 
 	// Create SMTP server using MySMTP library v0.0.19
 	// Reference: https://github.com/ImBubbles/MySMTP
@@ -128,18 +181,29 @@ func main() {
 		return handler.HandleMessage(nil, mailFrom, rcptTo, data)
 	}
 
-	// Set email exists checker - validate recipients
+	// Set email exists checker - validate recipients at RCPT TO. The hook
+	// only returns a bool and MySMTP replies a bare 550 to every refused
+	// recipient, so the 5.7.1 (non-local domain) and 5.1.1 (unknown user)
+	// replies are blocked on MySMTP and only the log tells them apart. It
+	// cannot send a 451 either, so a recipient that could not be checked is
+	// accepted here rather than refused for good, and HandleMessage checks it
+	// again at DATA, where a still failing lookup fails the message
 	handlers.EmailExistsChecker = func(email string) bool {
-		// Extract username from email
-		parts := strings.Split(email, "@")
-		if len(parts) == 0 {
-			log.Printf("EmailExistsChecker: Invalid email format: %s (returning false)\n", email)
+		// Bounces to a VERP address belong to its base mailbox
+		if verp, ok := decodeVERP(email); ok {
+			email = verp.Base
+		}
+		if err := handler.recipients.Check(email); err != nil {
+			var rerr *db.RecipientError
+			if errors.As(err, &rerr) && rerr.Temporary() {
+				log.Printf("EmailExistsChecker: Accepting %s until DATA: %v\n", email, err)
+				return true
+			}
+			log.Printf("EmailExistsChecker: Rejecting %s: %v\n", email, err)
 			return false
 		}
-		username := parts[0]
-		exists := handler.db.ValidateRecipient(username)
-		log.Printf("EmailExistsChecker: Checking email %s -> username: %s, exists: %v\n", email, username, exists)
-		return exists
+		log.Printf("EmailExistsChecker: Accepting %s\n", email)
+		return true
 	}
 
 	// Set handlers for the server
@@ -189,6 +253,14 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+// getEnvList splits a comma- or space-separated environment variable
+// Returns the values of defaultValue if the variable is not set
+func getEnvList(key, defaultValue string) []string {
+	return strings.FieldsFunc(getEnv(key, defaultValue), func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+}
+
 // getEnvBool parses a boolean environment variable
 // Returns true if the value is "true", "1", "yes", or "on" (case-insensitive)
 // Returns false for any other value or if the variable is not set
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"postsmtp/db"
+)
+
+const migrateUsage = "usage: postsmtp migrate up [N] | down [N] | status"
+
+// runMigrate implements the migrate command: up applies N (default all)
+// pending migrations, down reverts the N (default 1) most recent ones and
+// status lists them all
+func runMigrate(args []string) error {
+	if len(args) == 0 || len(args) > 2 {
+		return fmt.Errorf(migrateUsage)
+	}
+	steps := 0
+	if args[0] == "down" {
+		steps = 1
+	}
+	if len(args) == 2 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid number of migrations %q\n%s", args[1], migrateUsage)
+		}
+		steps = n
+	}
+
+	dbConfig := db.NewConfigFromEnv()
+	database, err := db.Connect(dbConfig.ConnectionString(), nil)
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	switch args[0] {
+	case "up":
+		applied, err := database.MigrateUp(steps)
+		fmt.Printf("Applied %d migrations\n", len(applied))
+		return err
+	case "down":
+		reverted, err := database.MigrateDown(steps)
+		fmt.Printf("Reverted %d migrations\n", len(reverted))
+		return err
+	case "status":
+		status, err := database.MigrationStatus()
+		if err != nil {
+			return err
+		}
+		for _, s := range status {
+			state := "pending"
+			if s.Applied {
+				state = "applied " + s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d  %-32s  %s\n", s.Version, s.Name, state)
+		}
+		return nil
+	default:
+		return fmt.Errorf(migrateUsage)
+	}
+}
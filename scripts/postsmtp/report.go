@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// Suppression reasons, shared with sendsmtp through the suppressions table
+const (
+	suppressHardBounce = "hard_bounce"
+	suppressComplaint  = "complaint"
+)
+
+// suppressionReport is a recipient that an incoming report says should no
+// longer receive mail from us
+type suppressionReport struct {
+	Address string
+	Reason  string
+	Status  string // enhanced status code of a bounce, e.g. 5.1.1
+	Detail  string
+}
+
+// parseReports extracts recipients whose mailbox is bad from an RFC 3464
+// delivery status notification and complaining recipients from an RFC 5965
+// abuse report, with the Message-ID of the returned message. Any other
+// message yields nothing
+func parseReports(data []byte) ([]suppressionReport, string) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, ""
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/report" || params["boundary"] == "" {
+		return nil, ""
+	}
+
+	var reports []suppressionReport
+	var feedback textproto.MIMEHeader
+	var returnedHeaders textproto.MIMEHeader
+
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("[parseReports] Error reading report part: %v\n", err)
+			break
+		}
+		partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		switch partType {
+		case "message/delivery-status", "message/global-delivery-status":
+			reports = append(reports, parseDeliveryStatus(part)...)
+		case "message/feedback-report":
+			fields, err := readFieldBlocks(part)
+			if err == nil && len(fields) > 0 {
+				feedback = fields[0]
+			}
+		case "message/rfc822", "text/rfc822-headers":
+			header, err := textproto.NewReader(bufio.NewReader(part)).ReadMIMEHeader()
+			if err == nil || len(header) > 0 {
+				returnedHeaders = header
+			}
+		}
+	}
+
+	if feedback != nil && strings.EqualFold(strings.TrimSpace(feedback.Get("Feedback-Type")), "abuse") {
+		// Original-Rcpt-To is optional, fall back to the To of the returned message
+		recipients := feedback.Values("Original-Rcpt-To")
+		if len(recipients) == 0 && returnedHeaders != nil {
+			if list, err := mail.ParseAddressList(returnedHeaders.Get("To")); err == nil {
+				for _, addr := range list {
+					recipients = append(recipients, addr.Address)
+				}
+			}
+		}
+		for _, rcpt := range recipients {
+			reports = append(reports, suppressionReport{
+				Address: stripAddressType(rcpt),
+				Reason:  suppressComplaint,
+				Detail:  "abuse report from " + stripAddressType(feedback.Get("Reporting-MTA")),
+			})
+		}
+	}
+
+	var messageID string
+	if returnedHeaders != nil {
+		messageID = strings.TrimSpace(returnedHeaders.Get("Message-Id"))
+	}
+	return reports, messageID
+}
+
+// dsnAddressFailed reports whether a DSN recipient says the mailbox itself is
+// bad, by the rule sendsmtp's addressBounced applies to replies: a 5.1.x
+// Status (RFC 3463 addressing status), or without one a 550, 551 or 553 SMTP
+// Diagnostic-Code. Other failures, such as 5.2.2 mailbox full, 5.3.4 message
+// too big or 5.7.1 policy, are about the message or the sender
+func dsnAddressFailed(status, diagnostic string) bool {
+	if fields := strings.Fields(status); len(fields) > 0 {
+		return strings.HasPrefix(fields[0], "5.1.")
+	}
+	diagType, text, ok := strings.Cut(diagnostic, ";")
+	if !ok || !strings.EqualFold(strings.TrimSpace(diagType), "smtp") {
+		return false
+	}
+	code, _, _ := strings.Cut(strings.TrimSpace(text), " ")
+	return code == "550" || code == "551" || code == "553"
+}
+
+// parseDeliveryStatus returns the recipients whose Action is failed for a
+// reason dsnAddressFailed accepts
+func parseDeliveryStatus(r io.Reader) []suppressionReport {
+	blocks, err := readFieldBlocks(r)
+	if err != nil || len(blocks) < 2 {
+		return nil
+	}
+	reportingMTA := stripAddressType(blocks[0].Get("Reporting-MTA"))
+
+	var reports []suppressionReport
+	// The first block holds per-message fields, the rest one block per recipient
+	for _, fields := range blocks[1:] {
+		action := strings.ToLower(strings.TrimSpace(fields.Get("Action")))
+		status := strings.TrimSpace(fields.Get("Status"))
+		if action != "failed" || !dsnAddressFailed(status, fields.Get("Diagnostic-Code")) {
+			continue
+		}
+		recipient := fields.Get("Final-Recipient")
+		if recipient == "" {
+			recipient = fields.Get("Original-Recipient")
+		}
+		address := stripAddressType(recipient)
+		if !strings.Contains(address, "@") {
+			continue
+		}
+		detail := status
+		if diag := strings.TrimSpace(fields.Get("Diagnostic-Code")); diag != "" {
+			detail += " " + stripAddressType(diag)
+		}
+		if reportingMTA != "" {
+			detail += " (" + reportingMTA + ")"
+		}
+		reports = append(reports, suppressionReport{Address: address, Reason: suppressHardBounce, Status: status, Detail: detail})
+	}
+	return reports
+}
+
+// readFieldBlocks reads consecutive header-style blocks separated by blank lines
+func readFieldBlocks(r io.Reader) ([]textproto.MIMEHeader, error) {
+	tr := textproto.NewReader(bufio.NewReader(r))
+	var blocks []textproto.MIMEHeader
+	for {
+		// Skip blank lines between blocks
+		line, err := tr.R.Peek(1)
+		for err == nil && (line[0] == '\r' || line[0] == '\n') {
+			tr.R.ReadByte()
+			line, err = tr.R.Peek(1)
+		}
+		if err != nil {
+			if err == io.EOF {
+				return blocks, nil
+			}
+			return blocks, err
+		}
+		header, err := tr.ReadMIMEHeader()
+		if len(header) > 0 {
+			blocks = append(blocks, header)
+		}
+		if err != nil {
+			if err == io.EOF {
+				return blocks, nil
+			}
+			return blocks, err
+		}
+	}
+}
+
+// stripAddressType removes the "rfc822;" / "dns;" / "smtp;" type prefix of DSN fields
+func stripAddressType(value string) string {
+	if _, rest, ok := strings.Cut(value, ";"); ok {
+		value = rest
+	}
+	return strings.Trim(strings.TrimSpace(value), "<>")
+}
+
+// reportStore is the part of db.DB that applyReports uses
+type reportStore interface {
+	AttemptedMail(mailUID, recipient string) (bool, error)
+	AttemptedMessage(messageID, recipient string) (bool, error)
+	AddSuppression(address, reason, detail string) error
+	RecordBounce(mailUID, recipient, enhancedCode, detail string) error
+}
+
+// applyReports acts on the reports of a message that arrived at VERP
+// addresses, or at a bounce address when toBounceAddress is set. Anyone can
+// send a report to any mailbox, so it only counts for mail sendsmtp sent:
+//
+//   - At a VERP address the encoded mail_uid and recipient must be in
+//     delivery_attempts. The recipient encoded there is the one marked
+//     bounced and suppressed, whatever address the report names (e.g. after
+//     forwarding). Delay notices and auto-replies come back to the same
+//     address and carry no report
+//   - At a bounce address the returned message's Message-ID must have been
+//     sent to the recipient the report names
+//
+// Reports elsewhere are stored as mail and otherwise ignored
+func applyReports(store reportStore, verps []*verpAddress, toBounceAddress bool, reports []suppressionReport, messageID string) {
+	for _, verp := range verps {
+		var report *suppressionReport
+		for i := range reports {
+			if report == nil || strings.EqualFold(reports[i].Address, verp.Recipient) {
+				report = &reports[i]
+			}
+		}
+		if report == nil {
+			log.Printf("Message to VERP address of %s (mail %s) is not a failure or complaint report, stored only\n",
+				verp.Recipient, verp.MailUID)
+			continue
+		}
+		sent, err := store.AttemptedMail(verp.MailUID, verp.Recipient)
+		if err != nil {
+			log.Printf("WARNING: %v\n", err)
+			continue
+		}
+		if !sent {
+			log.Printf("Ignoring report for %s: mail %s was not sent to it\n", verp.Recipient, verp.MailUID)
+			continue
+		}
+
+		if report.Reason == suppressHardBounce {
+			if err := store.RecordBounce(verp.MailUID, verp.Recipient, report.Status, report.Detail); err != nil {
+				log.Printf("WARNING: %v\n", err)
+			}
+		}
+		if err := store.AddSuppression(verp.Recipient, report.Reason, report.Detail); err != nil {
+			log.Printf("WARNING: %v\n", err)
+		}
+	}
+
+	if !toBounceAddress {
+		return
+	}
+	for _, report := range reports {
+		if messageID == "" {
+			log.Printf("Ignoring report for %s: the returned message has no Message-ID\n", report.Address)
+			continue
+		}
+		sent, err := store.AttemptedMessage(messageID, report.Address)
+		if err != nil {
+			log.Printf("WARNING: %v\n", err)
+			continue
+		}
+		if !sent {
+			log.Printf("Ignoring report for %s: message %s was not sent to it\n", report.Address, messageID)
+			continue
+		}
+		if err := store.AddSuppression(report.Address, report.Reason, report.Detail); err != nil {
+			log.Printf("WARNING: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDSNAddressFailed(t *testing.T) {
+	tests := []struct {
+		status, diagnostic string
+		want               bool
+	}{
+		{"5.1.1", "smtp; 550 5.1.1 user unknown", true},
+		{"5.1.10 (null MX)", "", true},
+		{"5.2.2", "smtp; 552 5.2.2 mailbox full", false},
+		{"5.7.1", "smtp; 550 5.7.1 rejected by policy", false},
+		{"5.3.4", "smtp; 552 5.3.4 message too big", false},
+		{"5.0.0", "smtp; 550 no such user", false},
+		{"4.4.1", "", false},
+		{"", "smtp; 550 no such user", true},
+		{"", "smtp; 553 mailbox name not allowed", true},
+		{"", "smtp; 554 transaction failed", false},
+		{"", "x-unix; 550 no such user", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		if got := dsnAddressFailed(tt.status, tt.diagnostic); got != tt.want {
+			t.Errorf("dsnAddressFailed(%q, %q) = %v, want %v", tt.status, tt.diagnostic, got, tt.want)
+		}
+	}
+}
+
+const testDSN = "From: MAILER-DAEMON@mx.example.net\r\n" +
+	"To: bounces@mymail.example\r\n" +
+	"Subject: Undelivered Mail Returned to Sender\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/report; report-type=delivery-status; boundary=\"b1\"\r\n" +
+	"\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Your message could not be delivered.\r\n" +
+	"--b1\r\n" +
+	"Content-Type: message/delivery-status\r\n" +
+	"\r\n" +
+	"Reporting-MTA: dns; mx.example.net\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; bob@example.net\r\n" +
+	"Action: failed\r\n" +
+	"Status: 5.1.1\r\n" +
+	"Diagnostic-Code: smtp; 550 5.1.1 no such user\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; carol@example.net\r\n" +
+	"Action: failed\r\n" +
+	"Status: 5.2.2\r\n" +
+	"Diagnostic-Code: smtp; 552 5.2.2 mailbox full\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; dave@example.net\r\n" +
+	"Action: delayed\r\n" +
+	"Status: 4.4.1\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/rfc822-headers\r\n" +
+	"\r\n" +
+	"From: alice@mymail.example\r\n" +
+	"To: bob@example.net, carol@example.net, dave@example.net\r\n" +
+	"Message-ID: <0123abcd@mymail.example>\r\n" +
+	"\r\n" +
+	"--b1--\r\n"
+
+func TestParseReports(t *testing.T) {
+	reports, messageID := parseReports([]byte(testDSN))
+	if messageID != "<0123abcd@mymail.example>" {
+		t.Errorf("Message-ID %q", messageID)
+	}
+	if len(reports) != 1 || reports[0].Address != "bob@example.net" || reports[0].Reason != suppressHardBounce || reports[0].Status != "5.1.1" {
+		t.Fatalf("got %+v, want only the 5.1.1 failure of bob", reports)
+	}
+	if !strings.Contains(reports[0].Detail, "no such user") || !strings.Contains(reports[0].Detail, "mx.example.net") {
+		t.Errorf("detail %q", reports[0].Detail)
+	}
+
+	if reports, messageID := parseReports([]byte("Subject: hi\r\n\r\nnot a report\r\n")); reports != nil || messageID != "" {
+		t.Errorf("plain message gives %+v, %q", reports, messageID)
+	}
+}
+
+// fakeReportStore records what applyReports does. attempts holds
+// "mail_uid recipient" and "message-id recipient" pairs that were sent
+type fakeReportStore struct {
+	attempts   map[string]bool
+	suppressed []string
+	bounced    []string
+}
+
+func (s *fakeReportStore) AttemptedMail(mailUID, recipient string) (bool, error) {
+	return s.attempts[mailUID+" "+recipient], nil
+}
+
+func (s *fakeReportStore) AttemptedMessage(messageID, recipient string) (bool, error) {
+	return s.attempts[strings.Trim(messageID, "<>")+" "+recipient], nil
+}
+
+func (s *fakeReportStore) AddSuppression(address, reason, detail string) error {
+	s.suppressed = append(s.suppressed, address+" "+reason)
+	return nil
+}
+
+func (s *fakeReportStore) RecordBounce(mailUID, recipient, enhancedCode, detail string) error {
+	s.bounced = append(s.bounced, mailUID+" "+recipient+" "+enhancedCode)
+	return nil
+}
+
+func TestApplyReports(t *testing.T) {
+	const uid = "6f1c2a9e-3b4d-4e5f-8a7b-9c0d1e2f3a4b"
+	const other = "00000000-0000-4000-8000-000000000000"
+	bounce := suppressionReport{Address: "bob@example.net", Reason: suppressHardBounce, Status: "5.1.1", Detail: "5.1.1 no such user"}
+	complaint := suppressionReport{Address: "bob@example.net", Reason: suppressComplaint, Detail: "abuse report"}
+	forwarded := suppressionReport{Address: "bob@forward.example", Reason: suppressHardBounce, Status: "5.1.1"}
+
+	tests := []struct {
+		name            string
+		verps           []*verpAddress
+		toBounceAddress bool
+		reports         []suppressionReport
+		messageID       string
+		suppressed      []string
+		bounced         []string
+	}{
+		{
+			name:       "VERP bounce for mail we sent",
+			verps:      []*verpAddress{{MailUID: uid, Recipient: "bob@example.net"}},
+			reports:    []suppressionReport{bounce},
+			suppressed: []string{"bob@example.net hard_bounce"},
+			bounced:    []string{uid + " bob@example.net 5.1.1"},
+		},
+		{
+			name:       "VERP complaint for mail we sent",
+			verps:      []*verpAddress{{MailUID: uid, Recipient: "bob@example.net"}},
+			reports:    []suppressionReport{complaint},
+			suppressed: []string{"bob@example.net complaint"},
+		},
+		{
+			name:       "VERP bounce naming a forwarding address suppresses the encoded recipient",
+			verps:      []*verpAddress{{MailUID: uid, Recipient: "bob@example.net"}},
+			reports:    []suppressionReport{forwarded},
+			suppressed: []string{"bob@example.net hard_bounce"},
+			bounced:    []string{uid + " bob@example.net 5.1.1"},
+		},
+		{
+			name:    "VERP address of mail we did not send",
+			verps:   []*verpAddress{{MailUID: other, Recipient: "bob@example.net"}},
+			reports: []suppressionReport{bounce},
+		},
+		{
+			name:  "VERP address without a report",
+			verps: []*verpAddress{{MailUID: uid, Recipient: "bob@example.net"}},
+		},
+		{
+			name:            "bounce address, message sent to the reported recipient",
+			toBounceAddress: true,
+			reports:         []suppressionReport{bounce},
+			messageID:       "<0123abcd@mymail.example>",
+			suppressed:      []string{"bob@example.net hard_bounce"},
+		},
+		{
+			name:            "bounce address, message not sent to the reported recipient",
+			toBounceAddress: true,
+			reports:         []suppressionReport{forwarded},
+			messageID:       "<0123abcd@mymail.example>",
+		},
+		{
+			name:            "bounce address, unknown message",
+			toBounceAddress: true,
+			reports:         []suppressionReport{bounce},
+			messageID:       "<forged@elsewhere.example>",
+		},
+		{
+			name:            "bounce address, no returned message",
+			toBounceAddress: true,
+			reports:         []suppressionReport{bounce},
+		},
+		{
+			name:    "report to an ordinary mailbox",
+			reports: []suppressionReport{bounce, complaint},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &fakeReportStore{attempts: map[string]bool{
+				uid + " bob@example.net":                  true,
+				"0123abcd@mymail.example bob@example.net": true,
+			}}
+			applyReports(store, tt.verps, tt.toBounceAddress, tt.reports, tt.messageID)
+			if !reflect.DeepEqual(store.suppressed, tt.suppressed) {
+				t.Errorf("suppressed %v, want %v", store.suppressed, tt.suppressed)
+			}
+			if !reflect.DeepEqual(store.bounced, tt.bounced) {
+				t.Errorf("bounced %v, want %v", store.bounced, tt.bounced)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// uuidPattern matches the mail_uid sendsmtp encodes in VERP addresses
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// verpAddress is a decoded VERP envelope sender of a message sendsmtp sent.
+// Bounces come back to it, e.g.
+//
+//	bounces+6f1c...=bob=example.net@mymail.example
+//
+// decodes to Base bounces@mymail.example, MailUID 6f1c... and Recipient
+// bob@example.net, the recipient the bounce is about
+type verpAddress struct {
+	Base      string
+	MailUID   string
+	Recipient string
+}
+
+// decodeVERP decodes address, returning false when it is not a VERP address
+func decodeVERP(address string) (*verpAddress, bool) {
+	at := strings.LastIndex(address, "@")
+	if at <= 0 {
+		return nil, false
+	}
+	local, domain := address[:at], address[at+1:]
+
+	// The tag follows the last "+" before the first "=", so the base local
+	// part may itself carry a "+detail"
+	eq := strings.Index(local, "=")
+	if eq <= 0 {
+		return nil, false
+	}
+	plus := strings.LastIndex(local[:eq], "+")
+	if plus <= 0 {
+		return nil, false
+	}
+	tag, encoded := local[plus+1:eq], local[eq+1:]
+	if !uuidPattern.MatchString(tag) {
+		return nil, false
+	}
+	// The recipient's domain cannot contain "=", its local part may
+	sep := strings.LastIndex(encoded, "=")
+	if sep <= 0 || sep == len(encoded)-1 {
+		return nil, false
+	}
+	return &verpAddress{
+		Base:      local[:plus] + "@" + domain,
+		MailUID:   strings.ToLower(tag),
+		Recipient: encoded[:sep] + "@" + encoded[sep+1:],
+	}, true
+}
@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func TestDecodeVERP(t *testing.T) {
+	const uid = "6f1c2a9e-3b4d-4e5f-8a7b-9c0d1e2f3a4b"
+	// Encoded by sendsmtp's delivery.VERPAddress, see sendsmtp/delivery/envelope_test.go
+	tests := []struct {
+		address         string
+		base, recipient string
+	}{
+		{"bounces+" + uid + "=bob=example.net@mymail.example", "bounces@mymail.example", "bob@example.net"},
+		{"alice+" + uid + "=carol.smith=mail.example.org@example.com", "alice@example.com", "carol.smith@mail.example.org"},
+		{"bounces+news+" + uid + "=bob=example.net@mymail.example", "bounces+news@mymail.example", "bob@example.net"},
+		{"bounces+" + uid + "=bob+lists=example.net@mymail.example", "bounces@mymail.example", "bob+lists@example.net"},
+		{"bounces+" + uid + "=a=b=example.net@mymail.example", "bounces@mymail.example", "a=b@example.net"},
+		{"bounces+6F1C2A9E-3B4D-4E5F-8A7B-9C0D1E2F3A4B=bob=example.net@mymail.example", "bounces@mymail.example", "bob@example.net"},
+	}
+	for _, tt := range tests {
+		v, ok := decodeVERP(tt.address)
+		if !ok {
+			t.Errorf("decodeVERP(%q) failed", tt.address)
+			continue
+		}
+		if v.Base != tt.base || v.MailUID != uid || v.Recipient != tt.recipient {
+			t.Errorf("decodeVERP(%q) = %+v, want %s, %s, %s", tt.address, v, tt.base, uid, tt.recipient)
+		}
+	}
+
+	for _, address := range []string{
+		"bounces@mymail.example",
+		"bob+lists@example.net",
+		"bounces+not-a-uid=bob=example.net@mymail.example",
+		"bounces+" + uid + "@mymail.example",
+		"bounces+" + uid + "=bob@mymail.example",
+		"bounces+" + uid + "=bob=@mymail.example",
+		"+" + uid + "=bob=example.net@mymail.example",
+		"bounces+" + uid + "=bob=example.net",
+	} {
+		if v, ok := decodeVERP(address); ok {
+			t.Errorf("decodeVERP(%q) = %+v, want no VERP address", address, v)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package delivery
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// SMTPError is a reply from the remote server that rejected a command
+type SMTPError struct {
+	Code     int    // three digit reply code
+	Enhanced string // RFC 3463 enhanced status code, if the server sent one
+	Message  string // reply text without the enhanced code
+	Reason   string // machine readable classification for failures detected locally
+}
+
+func (e *SMTPError) Error() string {
+	if e.Enhanced != "" {
+		return fmt.Sprintf("%d %s %s", e.Code, e.Enhanced, e.Message)
+	}
+	return fmt.Sprintf("%d %s", e.Code, e.Message)
+}
+
+// Permanent reports whether the reply is a 5xx failure that must not be retried
+func (e *SMTPError) Permanent() bool {
+	return e.Code >= 500 && e.Code < 600
+}
+
+// Temporary reports whether the reply is a 4xx failure worth retrying later
+func (e *SMTPError) Temporary() bool {
+	return e.Code >= 400 && e.Code < 500
+}
+
+// ReasonMessageTooLarge is reported for a message larger than the SIZE the
+// server advertised; it fails before transmission
+const ReasonMessageTooLarge = "message_too_large"
+
+// errMessageTooLarge is the permanent failure for a message larger than the
+// SIZE the server advertised in EHLO (RFC 1870), reported as the server would
+func errMessageTooLarge(size int, limit int64, host string) *SMTPError {
+	return &SMTPError{
+		Code:     552,
+		Enhanced: "5.3.4",
+		Message:  fmt.Sprintf("message size %d exceeds the %d byte limit advertised by %s", size, limit, host),
+		Reason:   ReasonMessageTooLarge,
+	}
+}
+
+// smtpClient speaks the client side of an ESMTP session on an established
+// connection. It exposes EHLO extensions and accepts MAIL/RCPT parameters,
+// which the DSN, SIZE and similar extensions depend on. Neither MySMTP's
+// client, which runs the whole conversation for a JSON mail, nor net/smtp,
+// whose Mail and Rcpt take no parameters, allow that
+type smtpClient struct {
+	conn        net.Conn
+	text        *textproto.Conn
+	host        string            // remote host name, used for SNI and logging
+	localName   string            // name sent in EHLO/HELO
+	ext         map[string]string // EHLO keywords (upper case) to their parameters
+	tls         bool              // STARTTLS completed
+	tlsVerified bool              // peer certificate chained to a trusted root and matched host, or matched DANE
+	tlsVersion  uint16
+	dane        *danePolicy // TLSA records the certificate must match, see dane.go
+	unwatch     func() bool // stops closing the connection when the context is done
+	logf        func(format string, args ...interface{})
+}
+
+// newSMTPClient reads the server greeting on conn and returns a client ready for hello
+func newSMTPClient(conn net.Conn, host, localName string) (*smtpClient, error) {
+	c := &smtpClient{
+		conn:      conn,
+		text:      textproto.NewConn(conn),
+		host:      host,
+		localName: localName,
+		logf:      func(string, ...interface{}) {},
+	}
+	if _, _, err := c.readReply(220); err != nil {
+		c.text.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// hello sends EHLO and falls back to HELO for servers without ESMTP support
+func (c *smtpClient) hello() error {
+	_, msg, err := c.cmd(250, "EHLO %s", c.localName)
+	if err != nil {
+		var smtpErr *SMTPError
+		if !errors.As(err, &smtpErr) {
+			return err
+		}
+		c.logf("EHLO rejected by %s (%v), falling back to HELO\n", c.host, err)
+		if _, _, err := c.cmd(250, "HELO %s", c.localName); err != nil {
+			return err
+		}
+		c.ext = map[string]string{}
+		return nil
+	}
+
+	c.ext = make(map[string]string)
+	lines := strings.Split(msg, "\n")
+	for _, line := range lines[1:] {
+		keyword, params, _ := strings.Cut(strings.TrimSpace(line), " ")
+		c.ext[strings.ToUpper(keyword)] = params
+	}
+	return nil
+}
+
+// extension reports whether the server advertised keyword in its EHLO reply
+// and returns the advertised parameters
+func (c *smtpClient) extension(keyword string) (bool, string) {
+	params, ok := c.ext[strings.ToUpper(keyword)]
+	return ok, params
+}
+
+// startTLS upgrades the session with STARTTLS and repeats EHLO as RFC 3207
+// requires. The handshake succeeds for any certificate so that delivery stays
+// opportunistic; whether the certificate actually validated is recorded in
+// tlsVerified. Under DANE a certificate that matches no TLSA record fails it
+func (c *smtpClient) startTLS() error {
+	if _, _, err := c.cmd(220, "STARTTLS"); err != nil {
+		return err
+	}
+
+	config := &tls.Config{
+		ServerName:         c.host,
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS12,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if c.dane != nil && len(c.dane.records) > 0 {
+				if err := c.dane.verify(cs); err != nil {
+					return fmt.Errorf("DANE authentication failed: %v", err)
+				}
+				c.tlsVerified = true
+				return nil
+			}
+			c.tlsVerified = verifyPeerCertificate(cs, c.host) == nil
+			return nil
+		},
+	}
+	tlsConn := tls.Client(c.conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		return fmt.Errorf("TLS handshake with %s failed: %v", c.host, err)
+	}
+
+	c.conn = tlsConn
+	c.text = textproto.NewConn(tlsConn)
+	c.tls = true
+	c.tlsVersion = tlsConn.ConnectionState().Version
+	return c.hello()
+}
+
+// verifyPeerCertificate checks the presented chain against the system roots and host name
+func verifyPeerCertificate(cs tls.ConnectionState, host string) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("no peer certificate")
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       host,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// tlsInfo describes the session's TLS state, nil for a plain text session
+func (c *smtpClient) tlsInfo() *TLSInfo {
+	if !c.tls {
+		return nil
+	}
+	return &TLSInfo{
+		Version:  tls.VersionName(c.tlsVersion),
+		Verified: c.tlsVerified,
+		DANE:     c.dane != nil && len(c.dane.records) > 0,
+	}
+}
+
+// mail sends MAIL FROM with optional ESMTP parameters such as RET or ENVID
+func (c *smtpClient) mail(from string, params ...string) error {
+	_, _, err := c.cmd(250, "MAIL FROM:<%s>%s", from, formatParams(params))
+	return err
+}
+
+// rcpt sends RCPT TO with optional ESMTP parameters such as NOTIFY or ORCPT
+func (c *smtpClient) rcpt(to string, params ...string) error {
+	_, _, err := c.cmd(25, "RCPT TO:<%s>%s", to, formatParams(params))
+	return err
+}
+
+// data transmits the message. Line endings are normalized to CRLF and leading
+// dots are escaped by the DotWriter
+func (c *smtpClient) data(message []byte) error {
+	if _, _, err := c.cmd(354, "DATA"); err != nil {
+		return err
+	}
+	w := c.text.DotWriter()
+	if _, err := w.Write(message); err != nil {
+		w.Close()
+		return fmt.Errorf("error writing message data: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("error finishing message data: %v", err)
+	}
+	_, _, err := c.readReply(250)
+	return err
+}
+
+// reset aborts the current transaction so the session can be reused
+func (c *smtpClient) reset() error {
+	_, _, err := c.cmd(250, "RSET")
+	return err
+}
+
+// quit ends the session and closes the connection
+func (c *smtpClient) quit() error {
+	_, _, err := c.cmd(221, "QUIT")
+	closeErr := c.close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// close drops the connection without QUIT, used after fatal errors
+func (c *smtpClient) close() error {
+	if c.unwatch != nil {
+		c.unwatch()
+	}
+	return c.text.Close()
+}
+
+// setDeadline bounds the next read and write on the connection
+func (c *smtpClient) setDeadline(d time.Duration) {
+	c.conn.SetDeadline(time.Now().Add(d))
+}
+
+// cmd sends a command and reads the reply, expecting a code that starts with expectCode
+func (c *smtpClient) cmd(expectCode int, format string, args ...interface{}) (int, string, error) {
+	id, err := c.text.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	c.text.StartResponse(id)
+	defer c.text.EndResponse(id)
+	return c.readReply(expectCode)
+}
+
+// readReply reads a (possibly multi-line) reply and converts protocol level
+// rejections into *SMTPError so callers can classify them
+func (c *smtpClient) readReply(expectCode int) (int, string, error) {
+	code, msg, err := c.text.ReadResponse(expectCode)
+	if err != nil {
+		var protoErr *textproto.Error
+		if errors.As(err, &protoErr) {
+			return code, msg, newSMTPError(protoErr.Code, protoErr.Msg)
+		}
+		return code, msg, err
+	}
+	return code, msg, nil
+}
+
+// newSMTPError splits an RFC 3463 enhanced status code off the reply text
+func newSMTPError(code int, msg string) *SMTPError {
+	e := &SMTPError{Code: code, Message: msg}
+	if first, rest, ok := strings.Cut(msg, " "); ok && isEnhancedCode(first) {
+		e.Enhanced = first
+		e.Message = rest
+	}
+	return e
+}
+
+// isEnhancedCode reports whether s looks like class.subject.detail, e.g. 5.1.1
+func isEnhancedCode(s string) bool {
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 || len(parts[0]) != 1 || (parts[0] != "2" && parts[0] != "4" && parts[0] != "5") {
+		return false
+	}
+	for _, p := range parts[1:] {
+		if len(p) == 0 || len(p) > 3 {
+			return false
+		}
+		for _, r := range p {
+			if r < '0' || r > '9' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func formatParams(params []string) string {
+	var b strings.Builder
+	for _, p := range params {
+		if p != "" {
+			b.WriteString(" ")
+			b.WriteString(p)
+		}
+	}
+	return b.String()
+}
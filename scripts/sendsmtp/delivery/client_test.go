@@ -0,0 +1,266 @@
+package delivery
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpStep is one exchange of a scripted server: a command it expects and
+// the raw reply it sends. A step with cmd dataStep reads the message after
+// DATA instead of a command
+type smtpStep struct {
+	cmd   string // expected command prefix, e.g. "MAIL FROM:"
+	reply string // CRLF terminated reply lines
+}
+
+// dataStep stands for the message content sent after a 354 reply
+const dataStep = "<data>"
+
+// scriptedSession plays the server side of an SMTP session on conn and
+// returns what the client sent: every command line, and for dataStep the
+// raw lines of the message as they arrived, dot-stuffing included
+func scriptedSession(t *testing.T, conn net.Conn, greeting string, steps []smtpStep) <-chan []string {
+	t.Helper()
+	received := make(chan []string, 1)
+	go func() {
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		var lines []string
+		defer func() { received <- lines }()
+
+		r := bufio.NewReader(conn)
+		readLine := func() (string, bool) {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return "", false
+			}
+			return line, true
+		}
+		if _, err := conn.Write([]byte(greeting)); err != nil {
+			return
+		}
+		for _, step := range steps {
+			if step.cmd == dataStep {
+				for {
+					line, ok := readLine()
+					if !ok {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					lines = append(lines, line)
+				}
+			} else {
+				line, ok := readLine()
+				if !ok {
+					return
+				}
+				lines = append(lines, strings.TrimSuffix(line, "\r\n"))
+				if !strings.HasPrefix(line, step.cmd) {
+					t.Errorf("server expected %q, got %q", step.cmd, line)
+					return
+				}
+			}
+			if _, err := conn.Write([]byte(step.reply)); err != nil {
+				return
+			}
+		}
+	}()
+	return received
+}
+
+// pipeClient connects a client to a scripted server over net.Pipe
+func pipeClient(t *testing.T, greeting string, steps []smtpStep) (*smtpClient, <-chan []string) {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	received := scriptedSession(t, serverConn, greeting, steps)
+	clientConn.SetDeadline(time.Now().Add(10 * time.Second))
+	client, err := newSMTPClient(clientConn, "mx.example.net", "mail.example.com")
+	if err != nil {
+		t.Fatalf("newSMTPClient() = %v", err)
+	}
+	t.Cleanup(func() { client.close() })
+	return client, received
+}
+
+func TestClientMultilineEHLO(t *testing.T) {
+	client, received := pipeClient(t, "220-mx.example.net ESMTP\r\n220 no UCE\r\n", []smtpStep{
+		{"EHLO mail.example.com", "250-mx.example.net greets mail.example.com\r\n" +
+			"250-SIZE 35882577\r\n" +
+			"250-8BITMIME\r\n" +
+			"250-dsn\r\n" +
+			"250-AUTH PLAIN LOGIN\r\n" +
+			"250 STARTTLS\r\n"},
+		{"QUIT", "221 2.0.0 bye\r\n"},
+	})
+	if err := client.hello(); err != nil {
+		t.Fatalf("hello() = %v", err)
+	}
+	for _, tt := range []struct {
+		keyword string
+		ok      bool
+		params  string
+	}{
+		{"SIZE", true, "35882577"},
+		{"8bitmime", true, ""},
+		{"DSN", true, ""},
+		{"AUTH", true, "PLAIN LOGIN"},
+		{"STARTTLS", true, ""},
+		{"REQUIRETLS", false, ""},
+		{"MX.EXAMPLE.NET", false, ""},
+	} {
+		if ok, params := client.extension(tt.keyword); ok != tt.ok || params != tt.params {
+			t.Errorf("extension(%q) = %v, %q, want %v, %q", tt.keyword, ok, params, tt.ok, tt.params)
+		}
+	}
+	if err := client.quit(); err != nil {
+		t.Errorf("quit() = %v", err)
+	}
+	<-received
+}
+
+func TestClientHELOFallback(t *testing.T) {
+	client, received := pipeClient(t, "220 old.example.net\r\n", []smtpStep{
+		{"EHLO ", "502 5.5.2 command not recognized\r\n"},
+		{"HELO mail.example.com", "250 old.example.net\r\n"},
+	})
+	if err := client.hello(); err != nil {
+		t.Fatalf("hello() = %v", err)
+	}
+	if ok, _ := client.extension("SIZE"); ok || len(client.ext) != 0 {
+		t.Errorf("HELO session has extensions %v", client.ext)
+	}
+	client.close()
+	<-received
+}
+
+func TestClientDataDotStuffing(t *testing.T) {
+	client, received := pipeClient(t, "220 mx.example.net\r\n", []smtpStep{
+		{"DATA", "354 go ahead\r\n"},
+		{dataStep, "250 2.0.0 queued as 4A1B\r\n"},
+	})
+	message := "Subject: dots\r\n\r\n" +
+		".leading dot\r\n" +
+		"..two dots\r\n" +
+		"bare LF\n" +
+		".\r\n" +
+		"middle . dot\r\n" +
+		"last line without break"
+	if err := client.data([]byte(message)); err != nil {
+		t.Fatalf("data() = %v", err)
+	}
+	client.close()
+
+	lines := <-received
+	want := []string{
+		"DATA",
+		"Subject: dots\r\n",
+		"\r\n",
+		"..leading dot\r\n",
+		"...two dots\r\n",
+		"bare LF\r\n",
+		"..\r\n",
+		"middle . dot\r\n",
+		"last line without break\r\n",
+	}
+	if strings.Join(lines, "|") != strings.Join(want, "|") {
+		t.Errorf("on the wire:\n%q\nwant:\n%q", lines, want)
+	}
+}
+
+func TestClientReplyCodes(t *testing.T) {
+	tests := []struct {
+		name      string
+		reply     string
+		code      int    // 0 when the command succeeds
+		enhanced  string // of the *SMTPError
+		message   string
+		permanent bool
+	}{
+		{"accepted", "250 2.1.5 ok\r\n", 0, "", "", false},
+		{"cannot verify", "252 2.1.5 cannot VRFY, will attempt delivery\r\n", 0, "", "", false},
+		{"unknown user", "550 5.1.1 <bob@example.net>: user unknown\r\n", 550, "5.1.1", "<bob@example.net>: user unknown", true},
+		{"no enhanced code", "550 no such user here\r\n", 550, "", "no such user here", true},
+		{"greylisted", "451 4.7.1 greylisted, try again later\r\n", 451, "4.7.1", "greylisted, try again later", false},
+		{"mailbox full", "552 5.2.2 mailbox full\r\n", 552, "5.2.2", "mailbox full", true},
+		{"multiline rejection", "550-5.7.1 rejected by policy\r\n550 5.7.1 see https://postmaster.example.net\r\n", 550, "5.7.1",
+			"rejected by policy\n5.7.1 see https://postmaster.example.net", true},
+		{"version-like text", "550 1.2.3 is not an enhanced code\r\n", 550, "", "1.2.3 is not an enhanced code", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, received := pipeClient(t, "220 mx.example.net\r\n", []smtpStep{
+				{"RCPT TO:<bob@example.net> NOTIFY=FAILURE", tt.reply},
+			})
+			err := client.rcpt("bob@example.net", "", "NOTIFY=FAILURE")
+			client.close()
+			<-received
+
+			if tt.code == 0 {
+				if err != nil {
+					t.Fatalf("rcpt() = %v, want success", err)
+				}
+				return
+			}
+			var smtpErr *SMTPError
+			if !errors.As(err, &smtpErr) {
+				t.Fatalf("rcpt() = %v, want *SMTPError", err)
+			}
+			if smtpErr.Code != tt.code || smtpErr.Enhanced != tt.enhanced || smtpErr.Message != tt.message {
+				t.Errorf("got %d %q %q, want %d %q %q", smtpErr.Code, smtpErr.Enhanced, smtpErr.Message, tt.code, tt.enhanced, tt.message)
+			}
+			if smtpErr.Permanent() != tt.permanent || smtpErr.Temporary() == tt.permanent {
+				t.Errorf("Permanent() = %v, Temporary() = %v", smtpErr.Permanent(), smtpErr.Temporary())
+			}
+		})
+	}
+}
+
+func TestClientMailParameters(t *testing.T) {
+	client, received := pipeClient(t, "220 mx.example.net\r\n", []smtpStep{
+		{"MAIL FROM:", "250 2.1.0 ok\r\n"},
+		{"MAIL FROM:", "250 2.1.0 ok\r\n"},
+		{"MAIL FROM:", "555 5.5.4 unsupported parameter\r\n"},
+	})
+	if err := client.mail("alice@example.com", "SIZE=1234", "", "RET=HDRS"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.mail(""); err != nil {
+		t.Fatal(err)
+	}
+	err := client.mail("alice@example.com", "REQUIRETLS")
+	var smtpErr *SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 555 {
+		t.Errorf("mail() = %v, want the 555 reply", err)
+	}
+	client.close()
+
+	want := []string{
+		"MAIL FROM:<alice@example.com> SIZE=1234 RET=HDRS",
+		"MAIL FROM:<>",
+		"MAIL FROM:<alice@example.com> REQUIRETLS",
+	}
+	if lines := <-received; strings.Join(lines, "|") != strings.Join(want, "|") {
+		t.Errorf("commands %q, want %q", lines, want)
+	}
+}
+
+func TestClientBadGreeting(t *testing.T) {
+	for _, greeting := range []string{
+		"554 5.3.2 not accepting mail\r\n",
+		"hello there\r\n",
+	} {
+		clientConn, serverConn := net.Pipe()
+		received := scriptedSession(t, serverConn, greeting, nil)
+		clientConn.SetDeadline(time.Now().Add(10 * time.Second))
+		if _, err := newSMTPClient(clientConn, "mx.example.net", "localhost"); err == nil {
+			t.Errorf("greeting %q accepted", greeting)
+		}
+		<-received
+	}
+}
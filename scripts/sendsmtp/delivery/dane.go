@@ -0,0 +1,228 @@
+package delivery
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DANE for SMTP (RFC 7672). The mode passed to NewDANE selects the policy:
+//
+//	off      certificates are checked against the system roots only
+//	on       TLSA records authenticate the MX when they are DNSSEC-secure,
+//	         other MX servers get opportunistic TLS
+//	require  every MX must have secure, matching TLSA records
+//
+// TLSA records are looked up at _25._tcp.<mx host> through the given
+// resolver, which must validate DNSSEC: an answer counts as secure only when
+// the resolver sets the AD bit, so it should run on the same host. With DANE
+// enabled the MX records themselves come from that resolver, and DANE is only
+// applied when the MX RRset is secure as well, so the names TLSA records are
+// looked up for cannot be forged.
+//
+// With secure TLSA records STARTTLS is mandatory and the certificate must
+// match a DANE-TA(2) or DANE-EE(3) record; PKIX usages are unusable for SMTP
+// (RFC 7672 section 3.1.3). If every record is unusable, TLS is still
+// mandatory but unauthenticated. A failed lookup (SERVFAIL, e.g. bogus
+// signatures) or a certificate mismatch makes that MX unusable; delivery moves
+// on to the next MX and is deferred when none is left, never sent in plain text.
+
+// DANE policies, see above
+const (
+	DANEOff     = "off"
+	DANEOn      = "on"
+	DANERequire = "require"
+)
+
+// daneQueryTimeout bounds a single query to the validating resolver
+const daneQueryTimeout = 5 * time.Second
+
+// DANE is the DANE policy and the resolver MX and TLSA records are fetched
+// from. It may be shared by several Deliverers
+type DANE struct {
+	mode     string
+	resolver string // host:port of the DNSSEC-validating resolver
+}
+
+// NewDANE returns the policy for mode, nil when mode is off. resolver is the
+// host:port of a DNSSEC-validating resolver
+func NewDANE(mode, resolver string) (*DANE, error) {
+	switch mode {
+	case DANEOff:
+		return nil, nil
+	case DANEOn, DANERequire:
+	default:
+		return nil, fmt.Errorf("DANE mode must be %s, %s or %s, got %q", DANEOff, DANEOn, DANERequire, mode)
+	}
+	if _, _, err := net.SplitHostPort(resolver); err != nil {
+		return nil, fmt.Errorf("DANE resolver must be host:port, got %q", resolver)
+	}
+	return &DANE{mode: mode, resolver: resolver}, nil
+}
+
+// danePolicy is what DANE demands of the session with one MX
+type danePolicy struct {
+	names   []string    // reference identifiers for DANE-TA: the MX host and the domain
+	records []*dns.TLSA // usable records, the certificate must match one; empty means unauthenticated
+}
+
+// query sends one DNSSEC-enabled query to the resolver. NXDOMAIN is an answer,
+// any other failure (SERVFAIL for bogus data included) is an error
+func (c *DANE) query(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+	msg.SetEdns0(4096, true)
+	msg.AuthenticatedData = true
+
+	client := &dns.Client{Timeout: daneQueryTimeout}
+	resp, _, err := client.ExchangeContext(ctx, msg, c.resolver)
+	if err == nil && resp.Truncated {
+		client.Net = "tcp"
+		resp, _, err = client.ExchangeContext(ctx, msg, c.resolver)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s lookup of %s failed: %v", dns.TypeToString[qtype], name, err)
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("%s lookup of %s failed: %s", dns.TypeToString[qtype], name, dns.RcodeToString[resp.Rcode])
+	}
+	return resp, nil
+}
+
+// lookupMX returns the MX records of domain from the validating resolver and
+// whether the answer is DNSSEC-secure. A domain that does not exist is a
+// *net.DNSError with IsNotFound set, as from net.Resolver.LookupMX
+func (c *DANE) lookupMX(ctx context.Context, domain string) ([]*net.MX, bool, error) {
+	resp, err := c.query(ctx, domain, dns.TypeMX)
+	if err != nil {
+		return nil, false, err
+	}
+	if resp.Rcode == dns.RcodeNameError {
+		return nil, resp.AuthenticatedData, &net.DNSError{Err: "no such host", Name: domain, Server: c.resolver, IsNotFound: true}
+	}
+	var mxs []*net.MX
+	for _, rr := range resp.Answer {
+		if mx, ok := rr.(*dns.MX); ok {
+			mxs = append(mxs, &net.MX{Host: mx.Mx, Pref: mx.Preference})
+		}
+	}
+	return mxs, resp.AuthenticatedData, nil
+}
+
+// policyFor decides how the session with host, an MX of domain, must be
+// protected. secureMX tells whether host came from a DNSSEC-secure MX
+// lookup, see lookupMX. nil means plain opportunistic TLS; an error means the
+// MX must not be used
+func (c *DANE) policyFor(ctx context.Context, domain, host string, secureMX bool, logf func(string, ...interface{})) (*danePolicy, error) {
+	if c == nil {
+		return nil, nil
+	}
+	if !secureMX {
+		return c.withoutDANE(host, "the MX records of "+domain+" are not DNSSEC-signed", logf)
+	}
+
+	resp, err := c.query(ctx, "_25._tcp."+host, dns.TypeTLSA)
+	if err != nil {
+		return nil, err
+	}
+	if !resp.AuthenticatedData {
+		return c.withoutDANE(host, "its TLSA lookup is not DNSSEC-secure", logf)
+	}
+
+	policy := &danePolicy{names: []string{host, domain}}
+	found := 0
+	for _, rr := range resp.Answer {
+		tlsa, ok := rr.(*dns.TLSA)
+		if !ok {
+			continue
+		}
+		found++
+		if usableTLSA(tlsa) {
+			policy.records = append(policy.records, tlsa)
+		}
+	}
+	if found == 0 {
+		return c.withoutDANE(host, "it has no TLSA records", logf)
+	}
+	if len(policy.records) == 0 {
+		logf("WARNING: none of the %d TLSA record(s) of %s is usable, TLS is mandatory but unauthenticated\n", found, host)
+	}
+	return policy, nil
+}
+
+// withoutDANE is the outcome for an MX without secure TLSA records
+func (c *DANE) withoutDANE(host, reason string, logf func(string, ...interface{})) (*danePolicy, error) {
+	if c.mode == DANERequire {
+		return nil, fmt.Errorf("DANE is required but %s", reason)
+	}
+	logf("No DANE for %s: %s\n", host, reason)
+	return nil, nil
+}
+
+// usableTLSA reports whether rr is a DANE-TA or DANE-EE record with a
+// selector and matching type we can check
+func usableTLSA(rr *dns.TLSA) bool {
+	return (rr.Usage == 2 || rr.Usage == 3) && rr.Selector <= 1 && rr.MatchingType <= 2
+}
+
+// verify authenticates the peer certificate chain against the TLSA records.
+// DANE-EE ignores names and validity dates; DANE-TA requires the leaf to
+// chain to a matching certificate and to name the MX host or the domain
+func (p *danePolicy) verify(cs tls.ConnectionState) error {
+	chain := cs.PeerCertificates
+	if len(chain) == 0 {
+		return errors.New("no peer certificate")
+	}
+	for _, rr := range p.records {
+		if rr.Usage == 3 {
+			if tlsaMatches(rr, chain[0]) {
+				return nil
+			}
+			continue
+		}
+		for i, ta := range chain[1:] {
+			if !tlsaMatches(rr, ta) {
+				continue
+			}
+			opts := x509.VerifyOptions{Roots: x509.NewCertPool(), Intermediates: x509.NewCertPool()}
+			opts.Roots.AddCert(ta)
+			for _, cert := range chain[1 : i+1] {
+				opts.Intermediates.AddCert(cert)
+			}
+			for _, name := range p.names {
+				opts.DNSName = name
+				if _, err := chain[0].Verify(opts); err == nil {
+					return nil
+				}
+			}
+		}
+	}
+	return errors.New("certificate does not match any TLSA record")
+}
+
+// tlsaMatches compares the certificate data selected by rr with its association data
+func tlsaMatches(rr *dns.TLSA, cert *x509.Certificate) bool {
+	data := cert.Raw
+	if rr.Selector == 1 {
+		data = cert.RawSubjectPublicKeyInfo
+	}
+	switch rr.MatchingType {
+	case 1:
+		sum := sha256.Sum256(data)
+		data = sum[:]
+	case 2:
+		sum := sha512.Sum512(data)
+		data = sum[:]
+	}
+	return strings.EqualFold(hex.EncodeToString(data), rr.Certificate)
+}
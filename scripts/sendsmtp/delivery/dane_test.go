@@ -0,0 +1,302 @@
+package delivery
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testZone is what the stand-in resolver answers for one name and type
+type testZone struct {
+	rcode  int
+	secure bool
+	answer []dns.RR
+}
+
+// startTestResolver serves zones on a local UDP port in place of a
+// DNSSEC-validating resolver; secure answers carry the AD bit
+func startTestResolver(t *testing.T, zones map[string]testZone) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		q := req.Question[0]
+		zone, ok := zones[dns.TypeToString[q.Qtype]+" "+strings.TrimSuffix(q.Name, ".")]
+		if !ok {
+			resp.Rcode = dns.RcodeNameError
+			resp.AuthenticatedData = true
+		} else {
+			resp.Rcode = zone.rcode
+			resp.AuthenticatedData = zone.secure
+			resp.Answer = zone.answer
+		}
+		w.WriteMsg(resp)
+	})
+	server := &dns.Server{PacketConn: pc, Handler: handler}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+// newTLSA returns a record of the given usage and selector with a SHA-256 digest of cert
+func newTLSA(host string, usage, selector uint8, cert *x509.Certificate) *dns.TLSA {
+	data := cert.Raw
+	if selector == 1 {
+		data = cert.RawSubjectPublicKeyInfo
+	}
+	sum := sha256.Sum256(data)
+	return &dns.TLSA{
+		Hdr:          dns.RR_Header{Name: dns.Fqdn("_25._tcp." + host), Rrtype: dns.TypeTLSA, Class: dns.ClassINET, Ttl: 300},
+		Usage:        usage,
+		Selector:     selector,
+		MatchingType: 1,
+		Certificate:  hex.EncodeToString(sum[:]),
+	}
+}
+
+// newTestCert issues a certificate for names, self-signed when parent is nil
+func newTestCert(t *testing.T, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, names ...string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "sendsmtp DANE test"},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+func TestDANEPolicy(t *testing.T) {
+	cert, _ := newTestCert(t, nil, nil, "mx.secure.test")
+	pkixEE := newTLSA("mx.secure.test", 1, 1, cert)
+	resolver := startTestResolver(t, map[string]testZone{
+		"MX secure.test":                 {secure: true},
+		"TLSA _25._tcp.mx.secure.test":   {secure: true, answer: []dns.RR{newTLSA("mx.secure.test", 3, 1, cert)}},
+		"TLSA _25._tcp.mx.pkix.test":     {secure: true, answer: []dns.RR{pkixEE}},
+		"MX pkix.test":                   {secure: true},
+		"MX insecure.test":               {secure: false},
+		"MX unsigned.test":               {secure: true},
+		"TLSA _25._tcp.mx.unsigned.test": {secure: false, answer: []dns.RR{newTLSA("mx.unsigned.test", 3, 1, cert)}},
+		"MX bogus.test":                  {secure: true},
+		"TLSA _25._tcp.mx.bogus.test":    {rcode: dns.RcodeServerFailure},
+		"MX none.test":                   {secure: true},
+	})
+
+	on, err := NewDANE(DANEOn, resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	require, _ := NewDANE(DANERequire, resolver)
+
+	tests := []struct {
+		name        string
+		conf        *DANE
+		domain      string
+		wantErr     bool
+		wantPolicy  bool
+		wantRecords int
+	}{
+		{"secure TLSA", on, "secure.test", false, true, 1},
+		{"only PKIX usages", on, "pkix.test", false, true, 0},
+		{"insecure MX", on, "insecure.test", false, false, 0},
+		{"insecure TLSA", on, "unsigned.test", false, false, 0},
+		{"no TLSA", on, "none.test", false, false, 0},
+		{"SERVFAIL", on, "bogus.test", true, false, 0},
+		{"required, secure", require, "secure.test", false, true, 1},
+		{"required, no TLSA", require, "none.test", true, false, 0},
+		{"required, insecure MX", require, "insecure.test", true, false, 0},
+		{"off", nil, "secure.test", false, false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secureMX := false
+			if tt.conf != nil {
+				if _, secureMX, err = tt.conf.lookupMX(context.Background(), tt.domain); err != nil {
+					t.Fatal(err)
+				}
+			}
+			policy, err := tt.conf.policyFor(context.Background(), tt.domain, "mx."+tt.domain, secureMX, t.Logf)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if (policy != nil) != tt.wantPolicy {
+				t.Fatalf("policy = %+v, want policy %v", policy, tt.wantPolicy)
+			}
+			if policy != nil && len(policy.records) != tt.wantRecords {
+				t.Errorf("%d usable records, want %d", len(policy.records), tt.wantRecords)
+			}
+		})
+	}
+}
+
+func TestDANELookupMX(t *testing.T) {
+	mx := func(pref uint16, host string) dns.RR {
+		return &dns.MX{Hdr: dns.RR_Header{Name: "x.test.", Rrtype: dns.TypeMX, Class: dns.ClassINET, Ttl: 300}, Preference: pref, Mx: host}
+	}
+	resolver := startTestResolver(t, map[string]testZone{
+		"MX secure.test":   {secure: true, answer: []dns.RR{mx(10, "mx1.secure.test."), mx(20, "mx2.secure.test.")}},
+		"MX insecure.test": {secure: false, answer: []dns.RR{mx(10, "mx.insecure.test.")}},
+		"MX bogus.test":    {rcode: dns.RcodeServerFailure},
+	})
+	conf, _ := NewDANE(DANEOn, resolver)
+	ctx := context.Background()
+
+	mxs, secure, err := conf.lookupMX(ctx, "secure.test")
+	if err != nil || !secure || len(mxs) != 2 || mxs[0].Host != "mx1.secure.test." || mxs[1].Pref != 20 {
+		t.Errorf("secure.test = %v, %v, %v", mxs, secure, err)
+	}
+	if mxs, secure, err := conf.lookupMX(ctx, "insecure.test"); err != nil || secure || len(mxs) != 1 {
+		t.Errorf("insecure.test = %v, %v, %v", mxs, secure, err)
+	}
+	var dnsErr *net.DNSError
+	if _, _, err := conf.lookupMX(ctx, "missing.test"); !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Errorf("missing.test error = %v, want a not found *net.DNSError", err)
+	}
+	if _, _, err := conf.lookupMX(ctx, "bogus.test"); err == nil || errors.As(err, &dnsErr) {
+		t.Errorf("bogus.test error = %v, want a lookup failure", err)
+	}
+}
+
+func TestNewDANE(t *testing.T) {
+	if _, err := NewDANE("maybe", "127.0.0.1:53"); err == nil {
+		t.Error("unknown mode accepted")
+	}
+	if _, err := NewDANE(DANEOn, "127.0.0.1"); err == nil {
+		t.Error("resolver without port accepted")
+	}
+	if conf, err := NewDANE(DANEOff, ""); conf != nil || err != nil {
+		t.Errorf("off = %v, %v, want nil, nil", conf, err)
+	}
+}
+
+func TestDANEVerify(t *testing.T) {
+	ca, caKey := newTestCert(t, nil, nil)
+	leaf, _ := newTestCert(t, ca, caKey, "mx.example.net")
+	other, _ := newTestCert(t, nil, nil, "mx.example.net")
+	chain := tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf, ca}}
+
+	tests := []struct {
+		name    string
+		records []*dns.TLSA
+		names   []string
+		wantErr bool
+	}{
+		{"DANE-EE SPKI", []*dns.TLSA{newTLSA("mx.example.net", 3, 1, leaf)}, []string{"unrelated.test"}, false},
+		{"DANE-EE full certificate", []*dns.TLSA{newTLSA("mx.example.net", 3, 0, leaf)}, nil, false},
+		{"DANE-EE mismatch", []*dns.TLSA{newTLSA("mx.example.net", 3, 1, other)}, nil, true},
+		{"DANE-TA", []*dns.TLSA{newTLSA("mx.example.net", 2, 0, ca)}, []string{"mx.example.net", "example.net"}, false},
+		{"DANE-TA by domain", []*dns.TLSA{newTLSA("mx.example.net", 2, 1, ca)}, []string{"mx.other.test", "mx.example.net"}, false},
+		{"DANE-TA name mismatch", []*dns.TLSA{newTLSA("mx.example.net", 2, 0, ca)}, []string{"mx.other.test", "other.test"}, true},
+		{"DANE-TA for the leaf", []*dns.TLSA{newTLSA("mx.example.net", 2, 0, leaf)}, []string{"mx.example.net"}, true},
+		{"second record matches", []*dns.TLSA{newTLSA("mx.example.net", 3, 1, other), newTLSA("mx.example.net", 3, 1, leaf)}, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := &danePolicy{names: tt.names, records: tt.records}
+			if err := policy.verify(chain); (err != nil) != tt.wantErr {
+				t.Errorf("verify() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDANEStartTLS(t *testing.T) {
+	cert, key := newTestCert(t, nil, nil, "mx.example.net")
+	other, _ := newTestCert(t, nil, nil, "mx.example.net")
+	serverTLS := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}}}
+
+	for _, tt := range []struct {
+		name   string
+		record *dns.TLSA
+		wantOK bool
+	}{
+		{"matching", newTLSA("mx.example.net", 3, 1, cert), true},
+		{"not matching", newTLSA("mx.example.net", 3, 1, other), false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			go func() {
+				serverConn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer serverConn.Close()
+				serverConn.Write([]byte("220 mx.example.net ESMTP\r\n"))
+				buf := make([]byte, 512)
+				serverConn.Read(buf) // STARTTLS
+				serverConn.Write([]byte("220 go ahead\r\n"))
+				tlsConn := tls.Server(serverConn, serverTLS)
+				if tlsConn.Handshake() != nil {
+					return
+				}
+				tlsConn.Read(buf) // EHLO
+				tlsConn.Write([]byte("250-mx.example.net\r\n250 REQUIRETLS\r\n"))
+			}()
+
+			clientConn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			clientConn.SetDeadline(time.Now().Add(10 * time.Second))
+			client, err := newSMTPClient(clientConn, "mx.example.net", "localhost")
+			if err != nil {
+				t.Fatal(err)
+			}
+			client.dane = &danePolicy{names: []string{"mx.example.net"}, records: []*dns.TLSA{tt.record}}
+			defer client.close()
+			err = client.startTLS()
+			if (err == nil) != tt.wantOK {
+				t.Fatalf("startTLS() = %v, want success %v", err, tt.wantOK)
+			}
+			if !tt.wantOK {
+				return
+			}
+			if info := client.tlsInfo(); !info.Verified || !info.DANE {
+				t.Errorf("tlsInfo() = %+v, want verified by DANE", info)
+			}
+			if err := client.checkRequireTLS(); err != nil {
+				t.Errorf("checkRequireTLS() = %v, want nil for a DANE-authenticated session", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,531 @@
+// Package delivery hands messages directly to the MX servers of their
+// recipients. It resolves MX records, speaks ESMTP to each server in priority
+// order, upgrades with STARTTLS (authenticated with DANE when configured),
+// passes SIZE, 8BITMIME, DSN and REQUIRETLS parameters to servers that
+// advertise them, and reports the outcome per recipient.
+//
+// A Deliverer is configured once and may send any number of messages:
+//
+//	d, err := delivery.New(delivery.Options{LocalName: "mail.example.com"})
+//	results, err := d.Send(ctx, &delivery.Message{
+//		From:       "bounces@example.com",
+//		Recipients: []string{"alice@example.net"},
+//		Data:       rfc5322Message,
+//	})
+//
+// Addresses are expected to be validated by the caller; the domain of a
+// recipient is everything after its last "@".
+package delivery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default timeouts, see Options
+const (
+	DefaultDialTimeout    = 10 * time.Second
+	DefaultCommandTimeout = 30 * time.Second
+	DefaultDataTimeout    = 5 * time.Minute
+)
+
+// Options configure a Deliverer. The zero value is usable
+type Options struct {
+	LocalName string // name sent in EHLO, default "localhost"
+	Port      string // SMTP port of the MX servers, default "25"
+
+	DialTimeout    time.Duration // connecting to an MX
+	CommandTimeout time.Duration // a single SMTP command
+	DataTimeout    time.Duration // transmitting the message after DATA
+
+	// DANE authenticates MX certificates with TLSA records, see NewDANE. nil disables DANE
+	DANE *DANE
+
+	Hooks Hooks
+}
+
+// Hooks let callers observe delivery. Every field is optional
+type Hooks struct {
+	// Logf receives progress and diagnostic messages, in log.Printf style
+	Logf func(format string, args ...interface{})
+
+	// Attempt is called with the outcome of every recipient of every attempt,
+	// including attempts on an MX that failed and were retried on the next one
+	Attempt func(r *RecipientResult, startedAt, finishedAt time.Time)
+}
+
+// Message is one message and the recipients to hand it to
+type Message struct {
+	From       string   // envelope sender (MAIL FROM), "" for a null reverse path
+	Recipients []string // envelope recipients (RCPT TO)
+
+	// VERP, when set, gives every recipient its own envelope sender that
+	// encodes this tag and the recipient, see VERPAddress. Each of them is
+	// sent in its own transaction over the same connection
+	VERP string
+
+	DSN        *DSNOptions // NOTIFY, RET and ENVID for servers that advertise DSN
+	RequireTLS bool        // REQUIRETLS, see requiretls.go
+
+	// Data is the RFC 5322 message. Instead, Render may produce it per
+	// session once the server's extensions are known: eightBitMIME reports
+	// whether the server advertised 8BITMIME and uses8bit in the result
+	// whether the data needs BODY=8BITMIME. An *SMTPError returned by Render
+	// fails every recipient of the session with that error
+	Data   []byte
+	Render func(eightBitMIME bool) (data []byte, uses8bit bool, err error)
+}
+
+// render returns the message data for a session
+func (m *Message) render(eightBitMIME bool) ([]byte, bool, error) {
+	if m.Render != nil {
+		return m.Render(eightBitMIME)
+	}
+	for _, c := range m.Data {
+		if c >= 0x80 {
+			return m.Data, true, nil
+		}
+	}
+	return m.Data, false, nil
+}
+
+// Deliverer sends messages to the MX servers of their recipients. It is safe
+// for concurrent use
+type Deliverer struct {
+	opts Options
+}
+
+// New returns a Deliverer for opts
+func New(opts Options) (*Deliverer, error) {
+	if opts.LocalName == "" {
+		opts.LocalName = "localhost"
+	}
+	if opts.Port == "" {
+		opts.Port = "25"
+	}
+	if _, err := strconv.ParseUint(opts.Port, 10, 16); err != nil {
+		return nil, fmt.Errorf("invalid port %q", opts.Port)
+	}
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = DefaultDialTimeout
+	}
+	if opts.CommandTimeout <= 0 {
+		opts.CommandTimeout = DefaultCommandTimeout
+	}
+	if opts.DataTimeout <= 0 {
+		opts.DataTimeout = DefaultDataTimeout
+	}
+	return &Deliverer{opts: opts}, nil
+}
+
+// WithHooks returns a Deliverer that shares d's options but reports to h.
+// Fields of h that are nil keep d's hooks
+func (d *Deliverer) WithHooks(h Hooks) *Deliverer {
+	opts := d.opts
+	if h.Logf != nil {
+		opts.Hooks.Logf = h.Logf
+	}
+	if h.Attempt != nil {
+		opts.Hooks.Attempt = h.Attempt
+	}
+	return &Deliverer{opts: opts}
+}
+
+func (d *Deliverer) logf(format string, args ...interface{}) {
+	if d.opts.Hooks.Logf != nil {
+		d.opts.Hooks.Logf(format, args...)
+	}
+}
+
+// record reports the outcome of one attempt to the Attempt hook
+func (d *Deliverer) record(results []*RecipientResult, startedAt time.Time) {
+	if d.opts.Hooks.Attempt == nil {
+		return
+	}
+	finishedAt := time.Now()
+	for _, r := range results {
+		d.opts.Hooks.Attempt(r, startedAt, finishedAt)
+	}
+}
+
+// Send delivers msg to every recipient, grouped by domain, and returns one
+// result per recipient. Failures are reported in the results; an error is
+// returned only when msg itself cannot be sent. When ctx is done, the open
+// session is aborted and recipients not yet delivered are deferred
+func (d *Deliverer) Send(ctx context.Context, msg *Message) ([]*RecipientResult, error) {
+	if len(msg.Recipients) == 0 {
+		return nil, errors.New("message has no recipients")
+	}
+	if msg.Data == nil && msg.Render == nil {
+		return nil, errors.New("message has neither Data nor Render")
+	}
+	if msg.VERP != "" && !strings.Contains(msg.From, "@") {
+		return nil, errors.New("VERP requires an envelope sender with a domain")
+	}
+	for _, recipient := range msg.Recipients {
+		if !strings.Contains(recipient, "@") {
+			return nil, fmt.Errorf("recipient %q has no domain", recipient)
+		}
+	}
+
+	recipientsByDomain := make(map[string][]string)
+	for _, recipient := range msg.Recipients {
+		domain := strings.ToLower(recipient[strings.LastIndex(recipient, "@")+1:])
+		recipientsByDomain[domain] = append(recipientsByDomain[domain], recipient)
+	}
+	domains := make([]string, 0, len(recipientsByDomain))
+	for domain := range recipientsByDomain {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+
+	d.logf("Sending email from %s to %d recipient(s) across %d domain(s)...\n",
+		msg.From, len(msg.Recipients), len(domains))
+
+	var results []*RecipientResult
+	for _, domain := range domains {
+		results = append(results, d.sendToDomain(ctx, domain, recipientsByDomain[domain], msg)...)
+	}
+	return results, nil
+}
+
+// sendToDomain attempts to deliver the message to recipients in a specific
+// domain and returns one result per recipient
+func (d *Deliverer) sendToDomain(ctx context.Context, domain string, recipients []string, msg *Message) []*RecipientResult {
+	// remaining are the recipients not yet handled by an MX. With VERP a
+	// session can fail after delivering some of them
+	remaining := recipients
+	var done []*RecipientResult
+
+	// failAll reports the same failure for every remaining recipient in the domain
+	failAll := func(mx string, err error) []*RecipientResult {
+		results := make([]*RecipientResult, 0, len(remaining))
+		for _, recipient := range remaining {
+			r := FailedResult(recipient, mx, err)
+			r.DSN = msg.DSN.Result(recipient, false)
+			results = append(results, r)
+		}
+		return results
+	}
+
+	// Resolve MX records for the domain
+	startedAt := time.Now()
+	if err := ctx.Err(); err != nil {
+		results := failAll("", err)
+		d.record(results, startedAt)
+		return results
+	}
+	mxRecords, secureMX, err := d.lookupMX(ctx, domain)
+	if err != nil {
+		var results []*RecipientResult
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			// The domain does not exist, retrying will not help
+			results = failAll("", &SMTPError{Code: 550, Enhanced: "5.1.2",
+				Message: fmt.Sprintf("domain %s does not exist", domain)})
+		} else {
+			results = failAll("", fmt.Errorf("error resolving MX records for %s: %v", domain, err))
+		}
+		d.record(results, startedAt)
+		return results
+	}
+
+	if len(mxRecords) == 0 {
+		results := failAll("", &SMTPError{Code: 550, Enhanced: "5.1.2", Message: fmt.Sprintf("no MX records found for domain %s", domain)})
+		d.record(results, startedAt)
+		return results
+	}
+
+	// Sort MX records by priority (lower priority number = higher priority)
+	sort.Slice(mxRecords, func(i, j int) bool {
+		return mxRecords[i].Pref < mxRecords[j].Pref
+	})
+
+	// Try to connect to ALL MX servers in priority order
+	// We'll attempt each one until we find a server that successfully accepts the email
+	var lastErr error
+	var lastHost string
+	var attemptedServers []string
+
+	d.logf("Found %d MX server(s) for domain %s, will try all valid SMTP domains\n", len(mxRecords), domain)
+
+	for i, mx := range mxRecords {
+		if ctx.Err() != nil {
+			lastErr = ctx.Err()
+			break
+		}
+		host := strings.TrimSuffix(mx.Host, ".")
+		attemptedServers = append(attemptedServers, fmt.Sprintf("%s (priority %d)", host, mx.Pref))
+
+		d.logf("[%d/%d] Attempting MX server %s (priority %d) for domain %s...\n",
+			i+1, len(mxRecords), host, mx.Pref, domain)
+
+		attemptStarted := time.Now()
+		results, err := d.deliverToHost(ctx, domain, host, secureMX, msg, remaining)
+		d.record(results, attemptStarted)
+		done = append(done, results...)
+		if err == nil {
+			d.logf("Finished delivery to domain %s via %s (priority %d)\n", domain, host, mx.Pref)
+			return done
+		}
+		for _, r := range results {
+			remaining = removeString(remaining, r.Recipient)
+		}
+		d.record(failAll(host, err), attemptStarted)
+
+		lastErr, lastHost = err, host
+		var smtpErr *SMTPError
+		if errors.As(err, &smtpErr) && smtpErr.Permanent() {
+			// The message itself was refused, another MX of the same domain will refuse it too
+			d.logf("Permanent failure from %s: %v, not trying further MX servers\n", host, err)
+			return append(done, failAll(host, err)...)
+		}
+		d.logf("Warning: delivery via %s failed: %v, trying next MX server...\n", host, err)
+	}
+
+	// If we reach here, all MX servers failed
+	d.logf("All %d MX server(s) failed for domain %s\n", len(mxRecords), domain)
+	d.logf("Attempted servers: %s\n", strings.Join(attemptedServers, ", "))
+	var requireTLSErr *requireTLSError
+	if errors.As(lastErr, &requireTLSErr) {
+		return append(done, failAll(lastHost, errRequireTLS(domain, requireTLSErr))...)
+	}
+	return append(done, failAll(lastHost, fmt.Errorf("failed to send email to domain %s after trying all %d MX server(s). Last error: %w",
+		domain, len(mxRecords), lastErr))...)
+}
+
+// lookupMX resolves the MX records of domain and reports whether they are
+// DNSSEC-secure. With DANE they come from its validating resolver, otherwise
+// from the system resolver, which is never considered secure
+func (d *Deliverer) lookupMX(ctx context.Context, domain string) ([]*net.MX, bool, error) {
+	if d.opts.DANE != nil {
+		return d.opts.DANE.lookupMX(ctx, domain)
+	}
+	mxs, err := net.DefaultResolver.LookupMX(ctx, domain)
+	return mxs, false, err
+}
+
+// deliverToHost runs the SMTP transactions for recipients against host, one
+// per envelope (see envelope.go). Recipients refused at RCPT TO are reported
+// in the results; an error is returned when the session or a transaction
+// failed, together with the results of the transactions completed before it,
+// so the caller can try the remaining recipients on the next MX. The message
+// is rendered once the server's extensions are known. secureMX tells whether
+// host came from a DNSSEC-secure MX lookup
+func (d *Deliverer) deliverToHost(ctx context.Context, domain, host string, secureMX bool, m *Message, recipients []string) ([]*RecipientResult, error) {
+	// RFC 8689 section 4.2.1: a REQUIRETLS message only goes to an MX from a
+	// DNSSEC-validated lookup, whose name the certificate is then checked
+	// against. MTA-STS, the other way to trust the MX, is not implemented
+	if m.RequireTLS && !secureMX {
+		return nil, &requireTLSError{host: host, reason: "the MX records of " + domain + " are not DNSSEC-validated"}
+	}
+
+	policy, err := d.opts.DANE.policyFor(ctx, domain, host, secureMX, d.logf)
+	if err != nil {
+		return nil, fmt.Errorf("DANE: %s not usable: %w", host, err)
+	}
+
+	client, err := d.openSession(ctx, host, true, policy)
+	var tlsErr *tlsHandshakeError
+	if errors.As(err, &tlsErr) && m.RequireTLS {
+		return nil, &requireTLSError{host: host, reason: err.Error()}
+	}
+	if errors.As(err, &tlsErr) && policy != nil {
+		// TLSA records make TLS mandatory, RFC 7672 section 2.2
+		return nil, err
+	}
+	if errors.As(err, &tlsErr) {
+		// Opportunistic TLS: a broken STARTTLS must not make the domain unreachable
+		d.logf("Warning: %v, retrying %s without STARTTLS\n", err, host)
+		client, err = d.openSession(ctx, host, false, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		d.logf("Cleaning up: closing connection to %s\n", host)
+		client.close()
+	}()
+
+	if m.RequireTLS {
+		if err := client.checkRequireTLS(); err != nil {
+			client.quit()
+			return nil, err
+		}
+	}
+
+	tlsInfo := client.tlsInfo()
+	dsnSupported, _ := client.extension("DSN")
+	if m.DSN != nil && !dsnSupported {
+		d.logf("WARNING: %s does not advertise DSN, sending without NOTIFY/RET/ENVID\n", host)
+	}
+
+	// Without 8BITMIME the message must be rendered in 7bit
+	eightBitMIME, _ := client.extension("8BITMIME")
+	message, uses8bit, err := m.render(eightBitMIME)
+	if err != nil {
+		client.quit()
+		return nil, err
+	}
+
+	// Refuse before MAIL FROM rather than after transmitting the whole message
+	var mailParams []string
+	if uses8bit {
+		mailParams = append(mailParams, "BODY=8BITMIME")
+	}
+	if sizeSupported, sizeParam := client.extension("SIZE"); sizeSupported {
+		if limit, err := strconv.ParseInt(sizeParam, 10, 64); err == nil && limit > 0 && int64(len(message)) > limit {
+			d.logf("Message of %d bytes exceeds SIZE %d advertised by %s\n", len(message), limit, host)
+			return nil, errMessageTooLarge(len(message), limit, host)
+		}
+		mailParams = append(mailParams, fmt.Sprintf("SIZE=%d", len(message)))
+	}
+	if dsnSupported {
+		mailParams = append(mailParams, m.DSN.mailParams()...)
+	}
+	if m.RequireTLS {
+		mailParams = append(mailParams, "REQUIRETLS")
+	}
+	// transaction runs MAIL FROM, RCPT TO and DATA for one envelope
+	transaction := func(env envelope) ([]*RecipientResult, error) {
+		if err := client.mail(env.from, mailParams...); err != nil {
+			return nil, fmt.Errorf("MAIL FROM rejected: %w", err)
+		}
+
+		var results, accepted []*RecipientResult
+		for _, recipient := range env.recipients {
+			var rcptParams []string
+			if dsnSupported {
+				rcptParams = m.DSN.rcptParams(recipient)
+			}
+			if err := client.rcpt(recipient, rcptParams...); err != nil {
+				d.logf("Recipient %s rejected by %s: %v\n", recipient, host, err)
+				r := FailedResult(recipient, host, err)
+				r.DSN = m.DSN.Result(recipient, false)
+				r.TLS = tlsInfo
+				r.RcptRejected = true
+				results = append(results, r)
+				continue
+			}
+			accepted = append(accepted, &RecipientResult{
+				Recipient: recipient,
+				Status:    StatusDelivered,
+				MX:        host,
+				Code:      250,
+				DSN:       m.DSN.Result(recipient, dsnSupported),
+				TLS:       tlsInfo,
+			})
+		}
+
+		if len(accepted) == 0 {
+			d.logf("No recipients accepted by %s, skipping DATA\n", host)
+			client.reset()
+			return results, nil
+		}
+
+		d.logf("Sending %d byte message to %s for %d recipient(s)\n", len(message), host, len(accepted))
+		client.setDeadline(d.opts.DataTimeout)
+		err := client.data(message)
+		client.setDeadline(d.opts.CommandTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("message rejected after DATA: %w", err)
+		}
+		return append(results, accepted...), nil
+	}
+
+	var results []*RecipientResult
+	for _, env := range m.envelopes(recipients) {
+		envResults, err := transaction(env)
+		if err != nil {
+			// Earlier transactions were delivered, the caller only retries the rest
+			return results, err
+		}
+		if env.from != m.From {
+			for _, r := range envResults {
+				r.Envelope = env.from
+			}
+		}
+		results = append(results, envResults...)
+	}
+
+	if err := client.quit(); err != nil {
+		d.logf("Warning: QUIT to %s failed after the last transaction: %v\n", host, err)
+	}
+	return results, nil
+}
+
+// tlsHandshakeError marks a failed STARTTLS upgrade so delivery can be retried in plain text
+type tlsHandshakeError struct {
+	err error
+}
+
+func (e *tlsHandshakeError) Error() string { return e.err.Error() }
+func (e *tlsHandshakeError) Unwrap() error { return e.err }
+
+// openSession connects to host, sends EHLO and upgrades with STARTTLS when
+// the server offers it and tryTLS is set. With a DANE policy STARTTLS is
+// mandatory and the certificate is checked against its records. The
+// connection is closed as soon as ctx is done
+func (d *Deliverer) openSession(ctx context.Context, host string, tryTLS bool, dane *danePolicy) (*smtpClient, error) {
+	addr := net.JoinHostPort(host, d.opts.Port)
+
+	// Dial with timeout to prevent hanging
+	dialer := &net.Dialer{
+		Timeout: d.opts.DialTimeout,
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", addr, err)
+	}
+	unwatch := context.AfterFunc(ctx, func() { conn.Close() })
+
+	// Set read and write timeouts to prevent hanging
+	conn.SetDeadline(time.Now().Add(d.opts.CommandTimeout))
+
+	client, err := newSMTPClient(conn, host, d.opts.LocalName)
+	if err != nil {
+		unwatch()
+		conn.Close()
+		return nil, fmt.Errorf("bad greeting from %s: %w", addr, err)
+	}
+	client.unwatch = unwatch
+	client.logf = d.logf
+	d.logf("Connected to %s, attempting SMTP conversation...\n", addr)
+
+	if err := client.hello(); err != nil {
+		client.close()
+		return nil, fmt.Errorf("EHLO/HELO rejected by %s: %w", addr, err)
+	}
+
+	client.dane = dane
+	if ok, _ := client.extension("STARTTLS"); !ok && dane != nil {
+		client.quit()
+		return nil, fmt.Errorf("%s does not offer STARTTLS, which its TLSA records make mandatory", addr)
+	}
+	if ok, _ := client.extension("STARTTLS"); ok && tryTLS {
+		if err := client.startTLS(); err != nil {
+			client.close()
+			return nil, &tlsHandshakeError{err: fmt.Errorf("STARTTLS with %s failed: %w", addr, err)}
+		}
+		d.logf("STARTTLS established with %s (certificate verified: %v)\n", addr, client.tlsVerified)
+	}
+
+	client.setDeadline(d.opts.CommandTimeout)
+	return client, nil
+}
+
+// removeString returns slice without the first occurrence of item
+func removeString(slice []string, item string) []string {
+	for i, s := range slice {
+		if s == item {
+			return append(append([]string{}, slice[:i]...), slice[i+1:]...)
+		}
+	}
+	return slice
+}
@@ -0,0 +1,128 @@
+package delivery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+// listenScripted serves one scripted SMTP session on a local port and
+// returns a Deliverer that connects to it
+func listenScripted(t *testing.T, steps []smtpStep) (*Deliverer, <-chan []string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			received <- nil
+			return
+		}
+		received <- <-scriptedSession(t, conn, "220 mx.example.net ESMTP\r\n", steps)
+	}()
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	d, err := New(Options{LocalName: "mail.example.com", Port: port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d, received
+}
+
+func TestSizeLimit(t *testing.T) {
+	message := []byte("Subject: size\r\n\r\n" + strings.Repeat("x", 100) + "\r\n")
+
+	t.Run("too large", func(t *testing.T) {
+		d, received := listenScripted(t, []smtpStep{
+			{"EHLO", "250-mx.example.net\r\n250 SIZE 64\r\n"},
+		})
+		results, err := d.deliverToHost(context.Background(), "example.net", "127.0.0.1", false,
+			&Message{From: "alice@example.com", Recipients: []string{"bob@example.net"}, Data: message},
+			[]string{"bob@example.net"})
+		if len(results) != 0 {
+			t.Errorf("got results %v before MAIL FROM", results)
+		}
+		var smtpErr *SMTPError
+		if !errors.As(err, &smtpErr) || smtpErr.Code != 552 || smtpErr.Enhanced != "5.3.4" || smtpErr.Reason != ReasonMessageTooLarge {
+			t.Fatalf("deliverToHost() = %v, want 552 5.3.4 message_too_large", err)
+		}
+		if r := FailedResult("bob@example.net", "127.0.0.1", err); r.Status != StatusBounced || r.Reason != ReasonMessageTooLarge {
+			t.Errorf("result %+v, want bounced with reason %s", r, ReasonMessageTooLarge)
+		}
+		// Refused before the transaction, the message was never transmitted
+		if lines := <-received; len(lines) != 1 {
+			t.Errorf("server received %q, want EHLO only", lines)
+		}
+	})
+
+	for _, tt := range []struct {
+		name string
+		ehlo string
+	}{
+		{"within limit", "250-mx.example.net\r\n250 SIZE 10240\r\n"},
+		{"no fixed limit", "250-mx.example.net\r\n250 SIZE\r\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			d, received := listenScripted(t, []smtpStep{
+				{"EHLO", tt.ehlo},
+				{fmt.Sprintf("MAIL FROM:<alice@example.com> SIZE=%d\r\n", len(message)), "250 ok\r\n"},
+				{"RCPT TO:<bob@example.net>", "250 ok\r\n"},
+				{"DATA", "354 go ahead\r\n"},
+				{dataStep, "250 queued\r\n"},
+				{"QUIT", "221 bye\r\n"},
+			})
+			results, err := d.deliverToHost(context.Background(), "example.net", "127.0.0.1", false,
+				&Message{From: "alice@example.com", Recipients: []string{"bob@example.net"}, Data: message},
+				[]string{"bob@example.net"})
+			if err != nil {
+				t.Fatalf("deliverToHost() = %v", err)
+			}
+			if len(results) != 1 || results[0].Status != StatusDelivered {
+				t.Errorf("results %v, want delivered", results)
+			}
+			<-received
+		})
+	}
+
+	t.Run("not advertised", func(t *testing.T) {
+		d, received := listenScripted(t, []smtpStep{
+			{"EHLO", "250 mx.example.net\r\n"},
+			{"MAIL FROM:<alice@example.com>\r\n", "250 ok\r\n"},
+			{"RCPT TO:<bob@example.net>", "550 5.1.1 no such user\r\n"},
+			{"RSET", "250 ok\r\n"},
+			{"QUIT", "221 bye\r\n"},
+		})
+		results, err := d.deliverToHost(context.Background(), "example.net", "127.0.0.1", false,
+			&Message{From: "alice@example.com", Recipients: []string{"bob@example.net"}, Data: message},
+			[]string{"bob@example.net"})
+		if err != nil {
+			t.Fatalf("deliverToHost() = %v", err)
+		}
+		if len(results) != 1 || results[0].Status != StatusBounced || !results[0].RcptRejected || results[0].Enhanced != "5.1.1" {
+			t.Errorf("results %+v, want bounced at RCPT TO", results[0])
+		}
+		<-received
+	})
+}
+
+func TestRequireTLSNeedsSecureMX(t *testing.T) {
+	// Refused before connecting: nothing listens on the port
+	d, err := New(Options{LocalName: "mail.example.com", Port: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.deliverToHost(context.Background(), "example.net", "127.0.0.1", false,
+		&Message{From: "alice@example.com", Recipients: []string{"bob@example.net"}, RequireTLS: true, Data: []byte("Subject: x\r\n\r\nx\r\n")},
+		[]string{"bob@example.net"})
+	var requireTLSErr *requireTLSError
+	if !errors.As(err, &requireTLSErr) || !strings.Contains(err.Error(), "not DNSSEC-validated") {
+		t.Fatalf("deliverToHost() = %v, want a REQUIRETLS refusal of the unvalidated MX", err)
+	}
+}
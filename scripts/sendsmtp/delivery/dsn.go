@@ -0,0 +1,117 @@
+package delivery
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Delivery Status Notification request (RFC 3461)
+//
+//	"dsn": {
+//	  "notify": ["FAILURE", "DELAY"],          // default NOTIFY for every recipient
+//	  "recipients": {                          // per-recipient NOTIFY overrides
+//	    "boss@example.com": ["SUCCESS", "FAILURE"]
+//	  },
+//	  "ret": "HDRS",                           // FULL or HDRS
+//	  "envid": "mail-uid-1234"                 // returned in bounces for correlation
+//	}
+type DSNOptions struct {
+	Notify     []string            `json:"notify,omitempty"`
+	Recipients map[string][]string `json:"recipients,omitempty"`
+	Ret        string              `json:"ret,omitempty"`
+	EnvID      string              `json:"envid,omitempty"`
+}
+
+// MaxEnvIDLength is the RFC 3461 section 4.4 limit on the ENVID value
+const MaxEnvIDLength = 100
+
+// DSNResult records which DSN parameters were sent for a recipient. Honored is
+// false when the options were requested but the server did not advertise DSN,
+// in which case the remote side falls back to its default notification behavior
+type DSNResult struct {
+	Notify  string `json:"notify,omitempty"`
+	Ret     string `json:"ret,omitempty"`
+	EnvID   string `json:"envid,omitempty"`
+	Honored bool   `json:"honored"`
+}
+
+// notifyFor returns the NOTIFY keywords requested for recipient
+func (o *DSNOptions) notifyFor(recipient string) []string {
+	if o == nil {
+		return nil
+	}
+	for addr, notify := range o.Recipients {
+		if strings.EqualFold(addr, recipient) {
+			return notify
+		}
+	}
+	return o.Notify
+}
+
+// ForRecipient narrows the options to a message sent to recipient alone
+func (o *DSNOptions) ForRecipient(recipient string) *DSNOptions {
+	if o == nil {
+		return nil
+	}
+	return &DSNOptions{Notify: o.notifyFor(recipient), Ret: o.Ret, EnvID: o.EnvID}
+}
+
+// mailParams returns the MAIL FROM parameters for the message
+func (o *DSNOptions) mailParams() []string {
+	if o == nil {
+		return nil
+	}
+	var params []string
+	if o.Ret != "" {
+		params = append(params, "RET="+strings.ToUpper(o.Ret))
+	}
+	if o.EnvID != "" {
+		params = append(params, "ENVID="+xtext(o.EnvID))
+	}
+	return params
+}
+
+// rcptParams returns the RCPT TO parameters for recipient. ORCPT is always
+// included when NOTIFY is so that bounces name the address we sent to
+func (o *DSNOptions) rcptParams(recipient string) []string {
+	notify := o.notifyFor(recipient)
+	if len(notify) == 0 {
+		return nil
+	}
+	return []string{
+		"NOTIFY=" + strings.ToUpper(strings.Join(notify, ",")),
+		"ORCPT=rfc822;" + xtext(recipient),
+	}
+}
+
+// Result describes what was requested for recipient and whether it reached the server
+func (o *DSNOptions) Result(recipient string, honored bool) *DSNResult {
+	if o == nil {
+		return nil
+	}
+	r := &DSNResult{
+		Notify:  strings.ToUpper(strings.Join(o.notifyFor(recipient), ",")),
+		Ret:     strings.ToUpper(o.Ret),
+		EnvID:   o.EnvID,
+		Honored: honored,
+	}
+	if r.Notify == "" && r.Ret == "" && r.EnvID == "" {
+		return nil
+	}
+	return r
+}
+
+// xtext encodes s as RFC 3461 xtext: "+", "=" and characters outside
+// printable ASCII become +XX hex escapes
+func xtext(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 33 || c > 126 || c == '+' || c == '=' {
+			fmt.Fprintf(&b, "+%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
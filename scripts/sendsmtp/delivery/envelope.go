@@ -0,0 +1,37 @@
+package delivery
+
+import (
+	"strings"
+)
+
+// envelope is one SMTP transaction: a MAIL FROM and its RCPT TOs
+type envelope struct {
+	from       string
+	recipients []string
+}
+
+// envelopes splits recipients into the transactions needed to deliver them.
+// With VERP every recipient gets its own envelope sender, and so its own
+// transaction over the same connection
+func (m *Message) envelopes(recipients []string) []envelope {
+	if m.VERP == "" {
+		return []envelope{{from: m.From, recipients: recipients}}
+	}
+	envelopes := make([]envelope, 0, len(recipients))
+	for _, recipient := range recipients {
+		envelopes = append(envelopes, envelope{
+			from:       VERPAddress(m.From, m.VERP, recipient),
+			recipients: []string{recipient},
+		})
+	}
+	return envelopes
+}
+
+// VERPAddress encodes tag and recipient into the local part of base:
+//
+//	bounces+<tag>=<recipient local part>=<recipient domain>@example.com
+func VERPAddress(base, tag, recipient string) string {
+	at := strings.LastIndex(base, "@")
+	rcptAt := strings.LastIndex(recipient, "@")
+	return base[:at] + "+" + tag + "=" + recipient[:rcptAt] + "=" + recipient[rcptAt+1:] + base[at:]
+}
@@ -0,0 +1,43 @@
+package delivery
+
+import (
+	"reflect"
+	"testing"
+)
+
+// The same addresses are decoded by postsmtp's decodeVERP in postsmtp/verp_test.go
+func TestVERPAddress(t *testing.T) {
+	const uid = "6f1c2a9e-3b4d-4e5f-8a7b-9c0d1e2f3a4b"
+	tests := []struct {
+		base, recipient, want string
+	}{
+		{"bounces@mymail.example", "bob@example.net", "bounces+" + uid + "=bob=example.net@mymail.example"},
+		{"alice@example.com", "carol.smith@mail.example.org", "alice+" + uid + "=carol.smith=mail.example.org@example.com"},
+		{"bounces+news@mymail.example", "bob@example.net", "bounces+news+" + uid + "=bob=example.net@mymail.example"},
+		{"bounces@mymail.example", "bob+lists@example.net", "bounces+" + uid + "=bob+lists=example.net@mymail.example"},
+		{"bounces@mymail.example", "a=b@example.net", "bounces+" + uid + "=a=b=example.net@mymail.example"},
+	}
+	for _, tt := range tests {
+		if got := VERPAddress(tt.base, uid, tt.recipient); got != tt.want {
+			t.Errorf("VERPAddress(%q, %q) = %q, want %q", tt.base, tt.recipient, got, tt.want)
+		}
+	}
+}
+
+func TestEnvelopes(t *testing.T) {
+	recipients := []string{"bob@example.net", "carol@example.net"}
+
+	m := &Message{From: "bounces@mymail.example"}
+	if got := m.envelopes(recipients); len(got) != 1 || got[0].from != m.From || !reflect.DeepEqual(got[0].recipients, recipients) {
+		t.Errorf("without VERP got %+v, want a single transaction", got)
+	}
+
+	m.VERP = "6f1c2a9e-3b4d-4e5f-8a7b-9c0d1e2f3a4b"
+	want := []envelope{
+		{from: "bounces+6f1c2a9e-3b4d-4e5f-8a7b-9c0d1e2f3a4b=bob=example.net@mymail.example", recipients: []string{"bob@example.net"}},
+		{from: "bounces+6f1c2a9e-3b4d-4e5f-8a7b-9c0d1e2f3a4b=carol=example.net@mymail.example", recipients: []string{"carol@example.net"}},
+	}
+	if got := m.envelopes(recipients); !reflect.DeepEqual(got, want) {
+		t.Errorf("with VERP got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,54 @@
+package delivery
+
+import (
+	"fmt"
+)
+
+// REQUIRETLS (RFC 8689). With Message.RequireTLS set the message is only
+// handed to an MX from a DNSSEC-validated MX lookup, which needs DANE enabled
+// (see dane.go), that completed STARTTLS with a certificate that validated
+// against the system roots and the MX name (or DANE), and that advertises
+// REQUIRETLS after STARTTLS. MAIL FROM then carries the
+// REQUIRETLS parameter, which obliges every later hop to do the same. There is
+// no fallback to plain text: when no MX of a domain qualifies the recipients
+// bounce with 5.7.30 and reason "requiretls_failed".
+
+// ReasonRequireTLS is reported for recipients no MX could take under REQUIRETLS
+const ReasonRequireTLS = "requiretls_failed"
+
+// requireTLSError is returned by deliverToHost when host cannot take a
+// REQUIRETLS message. It is not an *SMTPError, so the next MX is still tried
+type requireTLSError struct {
+	host   string
+	reason string
+}
+
+func (e *requireTLSError) Error() string {
+	return fmt.Sprintf("%s cannot take a REQUIRETLS message: %s", e.host, e.reason)
+}
+
+// errRequireTLS is the permanent failure once every MX was refused, reported
+// with the status code RFC 8689 section 5 defines for it
+func errRequireTLS(domain string, last *requireTLSError) *SMTPError {
+	return &SMTPError{
+		Code:     550,
+		Enhanced: "5.7.30",
+		Message:  fmt.Sprintf("REQUIRETLS support required, no MX of %s qualifies (last: %v)", domain, last),
+		Reason:   ReasonRequireTLS,
+	}
+}
+
+// checkRequireTLS reports why the session cannot carry a REQUIRETLS message,
+// or nil if it can
+func (c *smtpClient) checkRequireTLS() error {
+	if !c.tls {
+		return &requireTLSError{host: c.host, reason: "STARTTLS was not negotiated"}
+	}
+	if !c.tlsVerified {
+		return &requireTLSError{host: c.host, reason: "the TLS certificate did not validate"}
+	}
+	if ok, _ := c.extension("REQUIRETLS"); !ok {
+		return &requireTLSError{host: c.host, reason: "REQUIRETLS is not advertised"}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package delivery
+
+import (
+	"errors"
+)
+
+// Delivery outcome for a single recipient, as shown to the sender
+const (
+	StatusDelivered  = "delivered"  // accepted by the recipient's MX
+	StatusDeferred   = "deferred"   // temporary failure, may succeed on retry
+	StatusBounced    = "bounced"    // permanent failure, do not retry
+	StatusSuppressed = "suppressed" // on the suppression list, not attempted
+)
+
+// RecipientResult is the outcome of delivery to a single recipient
+type RecipientResult struct {
+	Recipient string     `json:"recipient"`
+	Status    string     `json:"status"`
+	MX        string     `json:"mx,omitempty"`
+	Code      int        `json:"code,omitempty"`
+	Enhanced  string     `json:"enhanced_code,omitempty"`
+	Message   string     `json:"message,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+	DSN       *DSNResult `json:"dsn,omitempty"`
+	TLS       *TLSInfo   `json:"tls,omitempty"`
+	Envelope  string     `json:"envelope_from,omitempty"` // MAIL FROM used, differs per recipient with VERP
+
+	RcptRejected bool `json:"-"` // refused at RCPT TO, i.e. because of the address itself
+}
+
+// TLSInfo describes the STARTTLS protection of the session a result came from
+type TLSInfo struct {
+	Version  string `json:"version"`
+	Verified bool   `json:"verified"`       // certificate chained to a trusted root and matched the MX name
+	DANE     bool   `json:"dane,omitempty"` // certificate authenticated by DNSSEC-signed TLSA records instead
+}
+
+// FailedResult builds the result for a recipient whose delivery failed with err.
+// SMTP replies are classified by their code, anything else (DNS, network,
+// timeouts) is treated as temporary
+func FailedResult(recipient, mx string, err error) *RecipientResult {
+	r := &RecipientResult{Recipient: recipient, Status: StatusDeferred, MX: mx, Message: err.Error()}
+	var smtpErr *SMTPError
+	if errors.As(err, &smtpErr) {
+		r.Code = smtpErr.Code
+		r.Enhanced = smtpErr.Enhanced
+		r.Message = smtpErr.Message
+		r.Reason = smtpErr.Reason
+		if smtpErr.Permanent() {
+			r.Status = StatusBounced
+		}
+	}
+	return r
+}
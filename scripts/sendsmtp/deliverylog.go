@@ -0,0 +1,148 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"time"
+
+	_ "github.com/lib/pq"
+
+	"sendsmtp/delivery"
+)
+
+// The delivery log is the PostgreSQL side of sendsmtp. It shares the backend's
+// database (DB_HOST, DB_PORT, DB_USER, DB_PASSWORD, DB_NAME, DB_SSLMODE) and
+// is enabled whenever DB_HOST is set. A database outage never blocks sending:
+// the log is skipped with a warning instead.
+
+// uuidPattern matches the mail uid the backend generates for the mail row
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// dbConfig holds database configuration
+type dbConfig struct {
+	Host     string
+	Port     string
+	User     string
+	Password string
+	Name     string
+	SSLMode  string
+}
+
+// dbConfigFromEnv reads the same variables as the backend and postsmtp
+func dbConfigFromEnv() *dbConfig {
+	return &dbConfig{
+		Host:     getEnvOrDefault("DB_HOST", "localhost"),
+		Port:     getEnvOrDefault("DB_PORT", "5432"),
+		User:     getEnvOrDefault("DB_USER", "postgres"),
+		Password: getEnvOrDefault("DB_PASSWORD", ""),
+		Name:     getEnvOrDefault("DB_NAME", "postgres"),
+		SSLMode:  getEnvOrDefault("DB_SSLMODE", "disable"),
+	}
+}
+
+// ConnectionString returns a PostgreSQL connection string
+func (c *dbConfig) ConnectionString() string {
+	return fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
+		c.Host, c.Port, c.User, c.Password, c.Name, c.SSLMode)
+}
+
+// openDatabase connects to PostgreSQL if DB_HOST is configured. It returns
+// nil (and logs why) when the database is not configured or unreachable
+func openDatabase() *sql.DB {
+	if os.Getenv("DB_HOST") == "" {
+		return nil
+	}
+	conn, err := sql.Open("postgres", dbConfigFromEnv().ConnectionString())
+	if err != nil {
+		log.Printf("WARNING: failed to open database, delivery log disabled: %v\n", err)
+		return nil
+	}
+	if err := conn.Ping(); err != nil {
+		log.Printf("WARNING: failed to ping database, delivery log disabled: %v\n", err)
+		conn.Close()
+		return nil
+	}
+	return conn
+}
+
+// deliveryLog records every attempt to hand a message to an MX in the
+// delivery_attempts table. A nil *deliveryLog records nothing
+type deliveryLog struct {
+	conn *sql.DB
+}
+
+// deliveryAttempt is one row of delivery_attempts
+type deliveryAttempt struct {
+	MailUID    string // uid of the backend's mail row, may be empty
+	MessageID  string
+	Result     *delivery.RecipientResult
+	StartedAt  time.Time
+	FinishedAt time.Time
+}
+
+// checkTables fails unless all tables exist. sendsmtp does not create its
+// tables: postsmtp's migrations do, so they must have run
+func checkTables(conn *sql.DB, tables ...string) error {
+	for _, table := range tables {
+		var exists bool
+		if err := conn.QueryRow("SELECT to_regclass($1) IS NOT NULL", table).Scan(&exists); err != nil {
+			return fmt.Errorf("failed to look up table %s: %v", table, err)
+		}
+		if !exists {
+			return fmt.Errorf("table %s does not exist, run postsmtp migrate up", table)
+		}
+	}
+	return nil
+}
+
+// newDeliveryLog checks for the delivery_attempts table
+func newDeliveryLog(conn *sql.DB) (*deliveryLog, error) {
+	if conn == nil {
+		return nil, nil
+	}
+	if err := checkTables(conn, "delivery_attempts"); err != nil {
+		return nil, err
+	}
+	return &deliveryLog{conn: conn}, nil
+}
+
+// record stores one attempt. Errors are logged, never returned, because the
+// outcome of the delivery itself does not depend on the log
+func (l *deliveryLog) record(a *deliveryAttempt) {
+	if l == nil {
+		return
+	}
+	_, err := l.conn.Exec(`
+		INSERT INTO delivery_attempts
+			(mail_uid, message_id, recipient, status, mx_host, reply_code, enhanced_code, reply_text,
+			 tls, tls_verified, tls_version, started_at, finished_at)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), NULLIF($6, 0), NULLIF($7, ''), NULLIF($8, ''), $9, $10, $11, $12, $13)`,
+		a.row()...,
+	)
+	if err != nil {
+		log.Printf("WARNING: failed to record delivery attempt for %s: %v\n", a.Result.Recipient, err)
+	}
+}
+
+// row returns the values of the delivery_attempts columns in insert order.
+// Empty strings and a zero reply code are turned into NULL by the statement
+func (a *deliveryAttempt) row() []interface{} {
+	r := a.Result
+
+	var mailUID interface{}
+	if a.MailUID != "" {
+		mailUID = a.MailUID
+	}
+	var tlsVersion interface{}
+	tlsUsed, tlsVerified := false, false
+	if r.TLS != nil {
+		tlsUsed, tlsVerified, tlsVersion = true, r.TLS.Verified, r.TLS.Version
+	}
+	return []interface{}{
+		mailUID, a.MessageID, r.Recipient, r.Status, r.MX, r.Code, r.Enhanced, r.Message,
+		tlsUsed, tlsVerified, tlsVersion, a.StartedAt.UTC(), a.FinishedAt.UTC(),
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"sendsmtp/delivery"
+)
+
+func TestDeliveryAttemptRow(t *testing.T) {
+	berlin := time.FixedZone("CEST", 2*60*60)
+	started := time.Date(2025, 10, 13, 11, 0, 0, 0, berlin)
+	finished := started.Add(1500 * time.Millisecond)
+	startedUTC := time.Date(2025, 10, 13, 9, 0, 0, 0, time.UTC)
+	finishedUTC := startedUTC.Add(1500 * time.Millisecond)
+
+	tests := []struct {
+		name    string
+		attempt deliveryAttempt
+		want    []interface{}
+	}{
+		{
+			"delivered over verified TLS",
+			deliveryAttempt{
+				MailUID:   "5f0c6d3e-8a41-4c1b-9d2e-7b3a1c9e4f20",
+				MessageID: "<1@example.com>",
+				Result: &delivery.RecipientResult{
+					Recipient: "bob@example.net", Status: delivery.StatusDelivered, MX: "mx.example.net",
+					Code: 250, Enhanced: "2.0.0", Message: "queued as 4A1B",
+					TLS: &delivery.TLSInfo{Version: "TLS 1.3", Verified: true},
+				},
+				StartedAt: started, FinishedAt: finished,
+			},
+			[]interface{}{"5f0c6d3e-8a41-4c1b-9d2e-7b3a1c9e4f20", "<1@example.com>", "bob@example.net", "delivered",
+				"mx.example.net", 250, "2.0.0", "queued as 4A1B", true, true, "TLS 1.3", startedUTC, finishedUTC},
+		},
+		{
+			"deferred in plain text without a mail row",
+			deliveryAttempt{
+				MessageID: "<2@example.com>",
+				Result: &delivery.RecipientResult{
+					Recipient: "carol@example.org", Status: delivery.StatusDeferred, MX: "mx.example.org",
+					Code: 451, Enhanced: "4.7.1", Message: "greylisted",
+				},
+				StartedAt: started, FinishedAt: finished,
+			},
+			[]interface{}{nil, "<2@example.com>", "carol@example.org", "deferred",
+				"mx.example.org", 451, "4.7.1", "greylisted", false, false, nil, startedUTC, finishedUTC},
+		},
+		{
+			// Never attempted: no MX and no reply code, stored as NULL
+			"suppressed",
+			deliveryAttempt{
+				MailUID:   "5f0c6d3e-8a41-4c1b-9d2e-7b3a1c9e4f20",
+				MessageID: "<3@example.com>",
+				Result: suppressedResult("dave@example.org", &suppression{
+					Reason: SuppressHardBounce, CreatedAt: startedUTC,
+				}),
+				StartedAt: started, FinishedAt: started,
+			},
+			[]interface{}{"5f0c6d3e-8a41-4c1b-9d2e-7b3a1c9e4f20", "<3@example.com>", "dave@example.org", "suppressed",
+				"", 0, "", "recipient is on the suppression list (hard_bounce since 2025-10-13T09:00:00Z)",
+				false, false, nil, startedUTC, startedUTC},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.attempt.row()
+			if len(got) != 13 {
+				t.Fatalf("row has %d values, the INSERT has 13 columns", len(got))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("row() =\n%#v\nwant\n%#v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"sendsmtp/delivery"
+)
+
+// The "dsn" input field is a delivery.DSNOptions, which also turns it into
+// the NOTIFY, RET, ENVID and ORCPT parameters on the wire
+
+// validateDSN checks the DSN keywords and values against RFC 3461
+func validateDSN(o *delivery.DSNOptions, recipients []string) ValidationErrors {
+	var errs ValidationErrors
+	if o == nil {
+		return nil
+	}
+
+	switch strings.ToUpper(o.Ret) {
+	case "", "FULL", "HDRS":
+	default:
+		errs.add(ErrInvalidDSN, "dsn.ret", "RET must be FULL or HDRS, got %q", o.Ret)
+	}
+
+	if len(o.EnvID) > delivery.MaxEnvIDLength {
+		errs.add(ErrInvalidDSN, "dsn.envid", "ENVID is %d bytes, limit is %d", len(o.EnvID), delivery.MaxEnvIDLength)
+	}
+	for i := 0; i < len(o.EnvID); i++ {
+		if c := o.EnvID[i]; c < 32 || c > 126 {
+			errs.add(ErrInvalidDSN, "dsn.envid", "ENVID must be printable ASCII")
+			break
+		}
+	}
+
+	if reason := checkNotify(o.Notify); reason != "" {
+		errs.add(ErrInvalidDSN, "dsn.notify", "%s", reason)
+	}
+
+	addrs := make([]string, 0, len(o.Recipients))
+	for addr := range o.Recipients {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		field := "dsn.recipients." + addr
+		if !containsFold(recipients, addr) {
+			errs.add(ErrInvalidDSN, field, "%s is not a recipient of this message", addr)
+			continue
+		}
+		if reason := checkNotify(o.Recipients[addr]); reason != "" {
+			errs.add(ErrInvalidDSN, field, "%s", reason)
+		}
+	}
+
+	return errs
+}
+
+// checkNotify validates a NOTIFY list: NEVER alone, or any of SUCCESS, FAILURE, DELAY
+func checkNotify(notify []string) string {
+	seen := make(map[string]bool)
+	for _, n := range notify {
+		keyword := strings.ToUpper(n)
+		switch keyword {
+		case "NEVER", "SUCCESS", "FAILURE", "DELAY":
+		default:
+			return fmt.Sprintf("unknown NOTIFY keyword %q", n)
+		}
+		if seen[keyword] {
+			return fmt.Sprintf("NOTIFY keyword %s repeated", keyword)
+		}
+		seen[keyword] = true
+	}
+	if seen["NEVER"] && len(seen) > 1 {
+		return "NOTIFY=NEVER cannot be combined with other keywords"
+	}
+	return ""
+}
+
+func containsFold(slice []string, item string) bool {
+	for _, s := range slice {
+		if strings.EqualFold(s, item) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"mime/quotedprintable"
+	"strings"
+	"unicode/utf8"
+)
+
+// Content-Transfer-Encoding values chosen for a body part
+const (
+	Encoding7Bit            = "7bit"
+	Encoding8Bit            = "8bit"
+	EncodingQuotedPrintable = "quoted-printable"
+	EncodingBase64          = "base64"
+)
+
+// maxLineLength is the RFC 5322 limit on a line, excluding CRLF
+const maxLineLength = 998
+
+// base64LineLength is the RFC 2045 output line length for base64
+const base64LineLength = 76
+
+// textStats describes what a body contains, which decides how it can travel
+type textStats struct {
+	nonASCII   int  // bytes >= 0x80
+	controls   int  // NUL, a CR outside CRLF and other control bytes except LF and TAB
+	longLines  bool // a line exceeds maxLineLength
+	validUTF8  bool
+	totalBytes int
+}
+
+func analyzeText(text string) textStats {
+	stats := textStats{validUTF8: utf8.ValidString(text), totalBytes: len(text)}
+	lineLength := 0
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c == '\n':
+			lineLength = 0
+			continue
+		case c == '\r' && i+1 < len(text) && text[i+1] == '\n':
+			continue
+		case c >= 0x80:
+			stats.nonASCII++
+		case c < 32 && c != '\t' || c == 127:
+			stats.controls++
+		}
+		lineLength++
+		if lineLength > maxLineLength {
+			stats.longLines = true
+		}
+	}
+	return stats
+}
+
+// chooseEncoding picks the Content-Transfer-Encoding for a text part:
+//   - 7bit when the text is plain ASCII with lines inside the limit
+//   - 8bit when the only problem is non-ASCII text and the server advertised 8BITMIME
+//   - base64 when more than a third of the bytes would need escaping, which is
+//     smaller than quoted-printable for mostly non-Latin text
+//   - quoted-printable otherwise, keeping mostly-ASCII text readable on the wire
+func chooseEncoding(stats textStats, allow8bit bool) string {
+	if stats.controls == 0 && !stats.longLines {
+		if stats.nonASCII == 0 {
+			return Encoding7Bit
+		}
+		if allow8bit && stats.validUTF8 {
+			return Encoding8Bit
+		}
+	}
+	if stats.nonASCII+stats.controls > stats.totalBytes/3 {
+		return EncodingBase64
+	}
+	return EncodingQuotedPrintable
+}
+
+// charsetFor returns the charset parameter for a text part
+func charsetFor(stats textStats) string {
+	if stats.nonASCII == 0 {
+		return "us-ascii"
+	}
+	return "utf-8"
+}
+
+// encodeBody applies the transfer encoding and returns CRLF terminated lines
+func encodeBody(text, encoding string) []byte {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+
+	var b bytes.Buffer
+	switch encoding {
+	case EncodingBase64:
+		b.Write(encodeBase64Lines([]byte(strings.ReplaceAll(text, "\n", "\r\n"))))
+	case EncodingQuotedPrintable:
+		// The writer produces CRLF line endings and soft line breaks at 76 columns
+		w := quotedprintable.NewWriter(&b)
+		w.Write([]byte(text))
+		w.Close()
+		if !bytes.HasSuffix(b.Bytes(), []byte("\r\n")) {
+			b.WriteString("\r\n")
+		}
+	default:
+		b.WriteString(strings.ReplaceAll(text, "\n", "\r\n"))
+		if !strings.HasSuffix(text, "\n") {
+			b.WriteString("\r\n")
+		}
+	}
+	return b.Bytes()
+}
+
+// encodeBase64Lines encodes binary data as base64 in CRLF terminated lines
+func encodeBase64Lines(data []byte) []byte {
+	var b bytes.Buffer
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > base64LineLength {
+		b.WriteString(encoded[:base64LineLength])
+		b.WriteString("\r\n")
+		encoded = encoded[base64LineLength:]
+	}
+	b.WriteString(encoded)
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime/quotedprintable"
+	"strings"
+	"testing"
+)
+
+func TestChooseEncoding(t *testing.T) {
+	tests := []struct {
+		name      string
+		text      string
+		allow8bit bool
+		want      string
+		charset   string
+	}{
+		{"ASCII", "Hello Bob,\r\nsee you at 12:30.\r\n", false, Encoding7Bit, "us-ascii"},
+		{"LF line endings", "one\ntwo\n", false, Encoding7Bit, "us-ascii"},
+		{"tab", "a\tb", false, Encoding7Bit, "us-ascii"},
+		{"empty", "", false, Encoding7Bit, "us-ascii"},
+		{"line at the limit", strings.Repeat("a", 998) + "\r\nshort", false, Encoding7Bit, "us-ascii"},
+		{"line over the limit", strings.Repeat("a", 999), false, EncodingQuotedPrintable, "us-ascii"},
+		{"long line with 8BITMIME", strings.Repeat("ä", 600), true, EncodingBase64, "utf-8"},
+		{"lone CR", "first\rsecond", false, EncodingQuotedPrintable, "us-ascii"},
+		{"lone CR with 8BITMIME", "Grüße\rfrom München, a mostly ASCII line", true, EncodingQuotedPrintable, "utf-8"},
+		{"trailing CR", "text ending in a bare carriage return\r", false, EncodingQuotedPrintable, "us-ascii"},
+		{"NUL", "before\x00after", false, EncodingQuotedPrintable, "us-ascii"},
+		{"DEL", "before\x7fafter", false, EncodingQuotedPrintable, "us-ascii"},
+		{"mostly ASCII", "Regards from the café down the street", false, EncodingQuotedPrintable, "utf-8"},
+		{"mostly ASCII with 8BITMIME", "Regards from the café down the street", true, Encoding8Bit, "utf-8"},
+		{"non-Latin", "こんにちは、世界", false, EncodingBase64, "utf-8"},
+		{"non-Latin with 8BITMIME", "こんにちは、世界", true, Encoding8Bit, "utf-8"},
+		{"invalid UTF-8 with 8BITMIME", "a Latin-1 caf\xe9 in otherwise ASCII text", true, EncodingQuotedPrintable, "utf-8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats := analyzeText(tt.text)
+			if got := chooseEncoding(stats, tt.allow8bit); got != tt.want {
+				t.Errorf("chooseEncoding(%+v, %v) = %s, want %s", stats, tt.allow8bit, got, tt.want)
+			}
+			if got := charsetFor(stats); got != tt.charset {
+				t.Errorf("charsetFor() = %s, want %s", got, tt.charset)
+			}
+		})
+	}
+}
+
+func TestEncodeBody(t *testing.T) {
+	texts := []string{
+		"Hello Bob,\nsee you at 12:30.",
+		"Grüße aus München\r\n",
+		"こんにちは、世界\n" + strings.Repeat("長い行", 400),
+		strings.Repeat("x", 2000) + "\n= sign and trailing space \n",
+		"nul\x00byte",
+	}
+	for _, text := range texts {
+		for _, encoding := range []string{Encoding7Bit, Encoding8Bit, EncodingQuotedPrintable, EncodingBase64} {
+			stats := analyzeText(text)
+			if (encoding == Encoding7Bit || encoding == Encoding8Bit) && (stats.longLines || stats.controls > 0) {
+				continue
+			}
+			if encoding == Encoding7Bit && stats.nonASCII > 0 {
+				continue
+			}
+			encoded := encodeBody(text, encoding)
+
+			for _, line := range bytes.SplitAfter(encoded, []byte("\r\n")) {
+				if len(line) > maxLineLength+2 {
+					t.Errorf("%s: line of %d bytes", encoding, len(line))
+				}
+				if bytes.ContainsAny(bytes.TrimSuffix(line, []byte("\r\n")), "\r\n") {
+					t.Errorf("%s: bare line break in %q", encoding, line)
+				}
+			}
+			if !bytes.HasSuffix(encoded, []byte("\r\n")) {
+				t.Errorf("%s: body does not end in CRLF", encoding)
+			}
+
+			var decoded []byte
+			switch encoding {
+			case EncodingQuotedPrintable:
+				decoded, _ = io.ReadAll(quotedprintable.NewReader(bytes.NewReader(encoded)))
+			case EncodingBase64:
+				decoded, _ = base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(encoded)), ""))
+			default:
+				decoded = encoded
+			}
+			want := strings.ReplaceAll(strings.ReplaceAll(text, "\r\n", "\n"), "\n", "\r\n")
+			if got := strings.TrimSuffix(string(decoded), "\r\n"); got != strings.TrimSuffix(want, "\r\n") {
+				t.Errorf("%s of %.20q decodes to %.40q", encoding, text, got)
+			}
+		}
+	}
+}
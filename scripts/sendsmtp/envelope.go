@@ -0,0 +1,24 @@
+package main
+
+// Envelope sender (MAIL FROM). By default it is the header From. With
+//
+//	"envelope_from": "bounces@example.com"
+//
+// bounces go to a separate mailbox, and with "verp": true every recipient gets
+// its own envelope sender that encodes the mail_uid and the recipient
+// (Variable Envelope Return Path):
+//
+//	bounces+<mail_uid>=<recipient local part>=<recipient domain>@example.com
+//
+// e.g. bounces+6f1c...=bob=example.net@example.com, which postsmtp decodes on
+// arrival to tie a bounce to the message and recipient it is about. Because
+// MAIL FROM differs per recipient, VERP sends one SMTP transaction per
+// recipient over the same connection (see delivery.Message).
+
+// envelopeFrom returns the base envelope sender
+func (m *JSONMail) envelopeFrom() string {
+	if m.EnvelopeFrom != "" {
+		return m.EnvelopeFrom
+	}
+	return m.From
+}
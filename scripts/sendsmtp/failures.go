@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+
+	"sendsmtp/delivery"
+)
+
+// Reasons for failures sendsmtp detects itself before a server is involved,
+// in addition to those of package delivery
+const (
+	ReasonSMIMEFailed   = "smime_failed"
+	ReasonPGPFailed     = "pgp_failed"
+	ReasonPGPKeyMissing = "pgp_key_missing"
+)
+
+// errSMIMEFailed is the permanent failure for a message that could not be
+// signed or encrypted, e.g. because a certificate expired after validation
+func errSMIMEFailed(err error) *delivery.SMTPError {
+	return &delivery.SMTPError{
+		Code:     554,
+		Enhanced: "5.7.5",
+		Message:  fmt.Sprintf("S/MIME failed: %v", err),
+		Reason:   ReasonSMIMEFailed,
+	}
+}
+
+// errPGPFailed is the permanent failure for a message that could not be
+// signed or encrypted with OpenPGP
+func errPGPFailed(err error) *delivery.SMTPError {
+	return &delivery.SMTPError{
+		Code:     554,
+		Enhanced: "5.7.5",
+		Message:  fmt.Sprintf("OpenPGP failed: %v", err),
+		Reason:   ReasonPGPFailed,
+	}
+}
+
+// errPGPKeyMissing is reported when encryption was required (missing_key
+// "fail") and a recipient has no OpenPGP key
+func errPGPKeyMissing(message string) *delivery.SMTPError {
+	return &delivery.SMTPError{
+		Code:     554,
+		Enhanced: "5.7.0",
+		Message:  message,
+		Reason:   ReasonPGPKeyMissing,
+	}
+}
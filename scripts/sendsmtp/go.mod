@@ -2,4 +2,19 @@ module sendsmtp
 
 go 1.25.1
 
-require github.com/ImBubbles/MySMTP v0.0.28
+require (
+	github.com/ProtonMail/go-crypto v1.5.2
+	github.com/lib/pq v1.10.9
+	github.com/miekg/dns v1.1.62
+	github.com/smallstep/pkcs7 v0.2.3
+)
+
+require (
+	github.com/cloudflare/circl v1.6.3 // indirect
+	golang.org/x/crypto v0.41.0 // indirect
+	golang.org/x/mod v0.18.0 // indirect
+	golang.org/x/net v0.42.0 // indirect
+	golang.org/x/sync v0.7.0 // indirect
+	golang.org/x/sys v0.35.0 // indirect
+	golang.org/x/tools v0.22.0 // indirect
+)
@@ -1,4 +1,4 @@
-// sendsmtp - A binary to send email via JSON using MySMTP API directly
+// sendsmtp - A binary to send email via JSON directly to recipient mail servers
 //
 // JSONMail struct format:
 //
@@ -9,42 +9,222 @@
 //	  "bcc": ["bcc@example.com"],              // Optional: array of BCC recipients
 //	  "subject": "Email Subject",              // Optional: email subject
 //	  "body": "Email body content",            // Optional: email body/content
+//	  "html": "<p>Email body content</p>",     // Optional: HTML body, sent as multipart/alternative with "body"
 //	  "headers": {                             // Optional: custom headers as key-value pairs
 //	    "X-Custom-Header": "value"
-//	  }
+//	  },
+//	  "dsn": {                                 // Optional: RFC 3461 delivery status notifications
+//	    "notify": ["FAILURE", "DELAY"],        //   default NOTIFY for all recipients
+//	    "recipients": {"boss@example.com": ["SUCCESS", "FAILURE"]},
+//	    "ret": "HDRS",                         //   FULL or HDRS
+//	    "envid": "mail-uid-1234"               //   envelope id echoed back in bounces
+//	  },
+//	  "mail_uid": "6f1c...-...",               // Optional: uid of the backend's mail row, links the delivery log
+//	  "smime": {"sign": true},                 // Optional: S/MIME signing and/or encryption, see SMIMEOptions
+//	  "pgp": {"encrypt": true},                // Optional: PGP/MIME signing and/or encryption, see PGPOptions
+//	  "envelope_from": "bounces@example.com",  // Optional: MAIL FROM, defaults to "from"
+//	  "verp": true,                            // Optional: per-recipient VERP envelope sender (needs mail_uid)
+//	  "require_tls": true,                     // Optional: REQUIRETLS, never deliver without validated TLS
+//	  "unsubscribe": {"list": "newsletter"},   // Optional: List-Unsubscribe one-click link, see UnsubscribeOptions
+//	  "send_at": "2030-01-01T09:00:00Z"        // Optional: schedule instead of sending now
 //	}
 //
+// For mail merge, "template", "vars" and "recipients" replace to/cc/bcc,
+// subject, body and html (see MergeRecipient). Each recipient then receives a
+// personalized message and stdout carries {"status":...,"messages":[...]}
+// with one result per message.
+//
+// Scheduled sending: with "send_at" (RFC 3339) in the future the message is
+// rendered, validated and stored in the outbound queue instead of being sent,
+// and stdout carries {"status":"scheduled","id":...,"send_at":...}. Until the
+// worker picks it up the message can be cancelled or replaced:
+//
+//	sendsmtp -cancel <id>
+//	sendsmtp -edit <id> -json '{...}'
+//	sendsmtp -list
+//	sendsmtp -worker [-poll 15s]     # delivers due messages, run as a service
+//
+// The worker files the result of each message in the queue's done/ or, when
+// a recipient was not delivered, failed/ directory (see queue.go).
+//
+// Suppression list: recipients whose mailbox was reported bad (a 5.1.x
+// status, or without one a 550, 551 or 553 reply to RCPT TO), or that postsmtp
+// saw in a bounce or complaint report at a VERP or bounce address about mail
+// sendsmtp sent, are not attempted again and get the status "suppressed".
+// Administrators manage the list with:
+//
+//	sendsmtp -suppressions
+//	sendsmtp -suppress <address>
+//	sendsmtp -unsuppress <address>
+//
+// With "unsubscribe" the recipient can opt out with one click; the link is
+// served by:
+//
+//	sendsmtp -serve-unsubscribe :8025
+//
+// OpenPGP keys for "pgp" are stored in the database per address:
+//
+//	sendsmtp -import-key <address> < key.asc
+//
+// Input is validated before any connection is made: addresses must be bare
+// local@domain mailboxes, header names must be RFC 5322 ftext and header values
+// may not contain line breaks or control characters. Rejected input is reported
+// on stdout as {"status":"invalid","errors":[{"code":...,"field":...,"message":...}]}
+// and the process exits with status 2.
+//
 // Usage:
 //
 //	sendsmtp -json '{"from":"sender@example.com","to":["recipient@example.com"],"subject":"Test","body":"Hello"}'
 //	echo '{"from":"sender@example.com","to":["recipient@example.com"]}' | sendsmtp
 //	sendsmtp < email.json
 //
-// The application uses MySMTP API to send emails directly to recipient mail servers
-// by resolving MX records and connecting to the appropriate SMTP servers.
+// The application sends emails directly to recipient mail servers by resolving
+// MX records and speaking ESMTP to the appropriate servers, upgrading with
+// STARTTLS when offered; the SMTP side lives in package sendsmtp/delivery,
+// which other Go tools can import. Each body part is sent as 7bit when it is
+// plain ASCII, as 8bit when the server advertises 8BITMIME, and as
+// quoted-printable or base64 otherwise, so no line exceeds 998 characters. DSN
+// parameters are only passed to servers that advertise the DSN extension.
+// SENDSMTP_DANE (off, on or require) enables DANE authentication of MX servers
+// with MX and TLSA records looked up through the DNSSEC-validating resolver in
+// SENDSMTP_DANE_RESOLVER (default 127.0.0.1:53), see delivery/dane.go. With
+// "require_tls" only MX servers from a DNSSEC-validated MX lookup, which needs
+// SENDSMTP_DANE on or require, with a validated certificate and that advertise
+// REQUIRETLS are used. The message size is declared with SIZE= in MAIL FROM,
+// and a message larger than the SIZE a server advertises is failed permanently
+// before transmission with reason "message_too_large".
+//
+// Once every domain has been attempted the per-recipient outcome is printed on
+// stdout as {"status":"sent|partial|failed","message_id":...,"results":[...]}
+// and the process exits with status 1 unless every recipient was delivered.
+// When DB_HOST is set every attempt is also recorded in the delivery_attempts
+// table, linked to "mail_uid"; the delivery_status view holds the latest
+// delivered/deferred/bounced state per recipient. sendsmtp does not create
+// its tables; postsmtp's migrations do, and a missing table disables the
+// feature using it with a warning.
 package main
 
 import (
 	"bufio"
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
-	"net"
 	"os"
-	"sort"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/ImBubbles/MySMTP/mail"
-	"github.com/ImBubbles/MySMTP/smtp"
+	"sendsmtp/delivery"
 )
 
 func main() {
 	var (
-		jsonArg = flag.String("json", "", "JSON string conforming to JSONMail struct")
+		jsonArg   = flag.String("json", "", "JSON string conforming to JSONMail struct")
+		cancelID  = flag.String("cancel", "", "Cancel the scheduled message with this queue id")
+		editID    = flag.String("edit", "", "Replace the scheduled message with this queue id by the JSON input")
+		listQueue = flag.Bool("list", false, "List scheduled messages")
+		worker    = flag.Bool("worker", false, "Run the queue worker, sending scheduled messages when they are due")
+		poll      = flag.Duration("poll", 15*time.Second, "How often the queue worker checks for due messages")
+
+		listSuppressed = flag.Bool("suppressions", false, "List suppressed recipients")
+		suppressAddr   = flag.String("suppress", "", "Add an address to the suppression list")
+		unsuppressAddr = flag.String("unsuppress", "", "Remove an address from the suppression list")
+
+		importKey = flag.String("import-key", "", "Store the armored OpenPGP key read from stdin for this address")
+
+		serveUnsub = flag.String("serve-unsubscribe", "", "Serve the List-Unsubscribe URL on this address, e.g. :8025")
 	)
 	flag.Parse()
 
+	outbound := newQueue(queueDir())
+
+	switch {
+	case *cancelID != "":
+		if err := outbound.cancel(*cancelID); err != nil {
+			printJSON(map[string]string{"status": "error", "id": *cancelID, "message": err.Error()})
+			os.Exit(1)
+		}
+		printJSON(map[string]string{"status": "cancelled", "id": *cancelID})
+		return
+	case *listQueue:
+		entries, err := outbound.list()
+		if err != nil {
+			log.Fatalf("Error listing queue: %v\n", err)
+		}
+		printJSON(map[string]interface{}{"status": "ok", "scheduled": entries})
+		return
+	}
+
+	// Everything below may use the database; connect to it once
+	svc := openServices()
+
+	switch {
+	case *listSuppressed:
+		entries, err := svc.suppressionList().list()
+		if err != nil {
+			log.Fatalf("Error: %v\n", err)
+		}
+		printJSON(map[string]interface{}{"status": "ok", "suppressions": entries})
+		return
+	case *suppressAddr != "":
+		if reason := checkAddress(*suppressAddr); reason != "" {
+			log.Fatalf("Error: invalid address %q: %s\n", *suppressAddr, reason)
+		}
+		if err := svc.suppressionList().add(*suppressAddr, SuppressManual, "admin", ""); err != nil {
+			log.Fatalf("Error: %v\n", err)
+		}
+		printJSON(map[string]string{"status": "suppressed", "address": normalizeAddress(*suppressAddr)})
+		return
+	case *unsuppressAddr != "":
+		removed, err := svc.suppressionList().remove(*unsuppressAddr)
+		if err != nil {
+			log.Fatalf("Error: %v\n", err)
+		}
+		if !removed {
+			printJSON(map[string]string{"status": "not_found", "address": normalizeAddress(*unsuppressAddr)})
+			os.Exit(1)
+		}
+		printJSON(map[string]string{"status": "removed", "address": normalizeAddress(*unsuppressAddr)})
+		return
+	case *importKey != "":
+		if reason := checkAddress(*importKey); reason != "" {
+			log.Fatalf("Error: invalid address %q: %s\n", *importKey, reason)
+		}
+		armored, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			log.Fatalf("Error reading key from stdin: %v\n", err)
+		}
+		fingerprint, err := svc.pgpKeys().importKey(*importKey, string(armored))
+		if err != nil {
+			log.Fatalf("Error: %v\n", err)
+		}
+		printJSON(map[string]string{"status": "imported", "address": normalizeAddress(*importKey), "fingerprint": fingerprint})
+		return
+	case *serveUnsub != "":
+		if err := serveUnsubscribe(*serveUnsub, svc.suppressionList()); err != nil {
+			log.Fatalf("Unsubscribe server failed: %v\n", err)
+		}
+		return
+	case *worker:
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		deliverer, err := newDeliverer()
+		if err != nil {
+			log.Fatalf("Error: %v\n", err)
+		}
+		send := func(ctx context.Context, entry *queueEntry) (interface{}, bool) {
+			return sendQueued(ctx, entry, deliverer, svc)
+		}
+		if err := outbound.run(ctx, *poll, send); err != nil {
+			log.Fatalf("Queue worker failed: %v\n", err)
+		}
+		return
+	}
+
 	// Get JSON input
 	var jsonStr string
 	if *jsonArg != "" {
@@ -71,219 +251,280 @@ func main() {
 	}
 
 	// Parse JSON to verify it's valid
-	jsonMail, err := mail.ParseJSONMail(jsonStr)
+	jsonMail, err := parseJSONMail(jsonStr)
 	if err != nil {
 		log.Fatalf("Error parsing JSON: %v\n", err)
 	}
 
-	// Validate required fields
-	if jsonMail.From == "" {
-		log.Fatal("Error: 'from' field is required\n")
-	}
-	if len(jsonMail.To) == 0 && len(jsonMail.CC) == 0 && len(jsonMail.BCC) == 0 {
-		log.Fatal("Error: at least one recipient is required (to, cc, or bcc)\n")
+	// Templates are rendered and the input validated up front; a scheduled
+	// message is queued in this prepared form
+	messages, errs := prepareMail(jsonMail)
+	if errs != nil {
+		exitWithValidationErrors(errs)
 	}
 
-	// Collect all recipients (to, cc, bcc) and group by domain
-	allRecipients := append([]string{}, jsonMail.To...)
-	allRecipients = append(allRecipients, jsonMail.CC...)
-	allRecipients = append(allRecipients, jsonMail.BCC...)
-
-	// Group recipients by domain
-	recipientsByDomain := make(map[string][]string)
-	for _, recipient := range allRecipients {
-		parts := strings.Split(recipient, "@")
-		if len(parts) != 2 {
-			log.Fatalf("Error: invalid email address format: %s\n", recipient)
+	if *editID != "" {
+		entry, err := outbound.edit(*editID, jsonMail, messages)
+		if err != nil {
+			printJSON(map[string]string{"status": "error", "id": *editID, "message": err.Error()})
+			os.Exit(1)
 		}
-		domain := parts[1]
-		recipientsByDomain[domain] = append(recipientsByDomain[domain], recipient)
+		printJSON(map[string]interface{}{"status": "scheduled", "id": entry.ID, "send_at": entry.SendAt})
+		return
 	}
 
-	log.Printf("Sending email from %s to %d recipient(s) across %d domain(s)...\n",
-		jsonMail.From, len(allRecipients), len(recipientsByDomain))
-
-	// Send to each domain by resolving MX records and connecting directly
-	for domain, recipients := range recipientsByDomain {
-		err := sendToDomain(domain, recipients, jsonMail)
+	if jsonMail.SendAt != nil && jsonMail.SendAt.After(time.Now()) {
+		entry, err := outbound.schedule(jsonMail, messages, *jsonMail.SendAt)
 		if err != nil {
-			log.Fatalf("Error: failed to send email to domain %s: %v\n", domain, err)
+			log.Fatalf("Error scheduling message: %v\n", err)
 		}
+		printJSON(map[string]interface{}{"status": "scheduled", "id": entry.ID, "send_at": entry.SendAt})
+		return
 	}
 
-	fmt.Println("Email sent successfully to all recipients!")
+	// Only sending needs the delivery setup; a broken SENDSMTP_DANE does not
+	// keep the queue and suppression commands above from working
+	deliverer, err := newDeliverer()
+	if err != nil {
+		log.Fatalf("Error: %v\n", err)
+	}
+	result, ok := deliverMessages(context.Background(), jsonMail.Template != "", messages, deliverer, svc)
+	printJSON(result)
+	if !ok {
+		os.Exit(1)
+	}
+	log.Println("Email sent successfully to all recipients!")
 }
 
-// sendToDomain attempts to send email to recipients in a specific domain
-func sendToDomain(domain string, recipients []string, jsonMail *mail.JSONMail) error {
-	// Resolve MX records for the domain
-	mxRecords, err := net.LookupMX(domain)
-	if err != nil {
-		return fmt.Errorf("error resolving MX records for %s: %v", domain, err)
+// prepareMail validates the input and returns the messages to deliver: the
+// message itself, or one rendered message per recipient for a template
+func prepareMail(jsonMail *JSONMail) ([]*JSONMail, ValidationErrors) {
+	// A template request expands into one message per recipient, all of which
+	// are rendered and validated before the first one is sent
+	if jsonMail.Template != "" {
+		messages, errs := renderMerge(jsonMail)
+		if errs != nil {
+			return nil, errs
+		}
+		log.Printf("Rendered template %q for %d recipient(s)\n", jsonMail.Template, len(messages))
+		return messages, nil
+	}
+
+	// Validate addresses, subject and custom headers before anything reaches the wire
+	if errs := validateJSONMail(jsonMail); errs != nil {
+		return nil, errs
 	}
+	return []*JSONMail{jsonMail}, nil
+}
 
-	if len(mxRecords) == 0 {
-		return fmt.Errorf("no MX records found for domain %s", domain)
+// deliverMessages sends the output of prepareMail: a batch of personalized
+// messages for a template, otherwise the single message. It returns the
+// document to report, a BatchResult or a SendResult, and whether every
+// recipient was delivered
+func deliverMessages(ctx context.Context, batch bool, messages []*JSONMail, d *delivery.Deliverer, svc *services) (interface{}, bool) {
+	if batch {
+		result := deliverBatch(ctx, messages, d, svc)
+		return result, result.Status == "sent"
 	}
+	sendResult := sendMail(ctx, messages[0], d, svc)
+	return sendResult, sendResult.Status == "sent"
+}
 
-	// Sort MX records by priority (lower priority number = higher priority)
-	sort.Slice(mxRecords, func(i, j int) bool {
-		return mxRecords[i].Pref < mxRecords[j].Pref
-	})
+// sendMail delivers a validated message to every recipient that is not suppressed
+func sendMail(ctx context.Context, jsonMail *JSONMail, d *delivery.Deliverer, svc *services) *SendResult {
+	// Collect all recipients (to, cc, bcc) and group by domain
+	allRecipients := jsonMail.recipients()
+
+	// The same Message-ID is used for every domain so replies and bounces can be correlated
+	messageID := jsonMail.messageID()
 
-	// Create a modified JSONMail with only recipients for this domain
-	domainJsonMail := &mail.JSONMail{
-		From:    jsonMail.From,
-		To:      []string{},
-		CC:      []string{},
-		BCC:     []string{},
-		Subject: jsonMail.Subject,
-		Body:    jsonMail.Body,
-		Headers: jsonMail.Headers,
-	}
-
-	// Validate and log email content before sending
-	if domainJsonMail.Body == "" {
-		log.Printf("WARNING: Email body is empty for domain %s!\n", domain)
-	}
-	if domainJsonMail.Subject == "" {
-		log.Printf("WARNING: Email subject is empty for domain %s!\n", domain)
-	}
-	log.Printf("Preparing to send email - From: %s, Body length: %d, Subject: %s\n",
-		domainJsonMail.From, len(domainJsonMail.Body), domainJsonMail.Subject)
-
-	// Add recipients for this domain to the appropriate field
-	// Maintain original To/CC/BCC structure for proper SMTP handling
-	for _, recipient := range recipients {
-		if contains(jsonMail.To, recipient) {
-			domainJsonMail.To = append(domainJsonMail.To, recipient)
-		} else if contains(jsonMail.CC, recipient) {
-			domainJsonMail.CC = append(domainJsonMail.CC, recipient)
-		} else if contains(jsonMail.BCC, recipient) {
-			domainJsonMail.BCC = append(domainJsonMail.BCC, recipient)
+	// Suppressed recipients are reported without being attempted. They stay
+	// in the To/Cc header, which other recipients see unchanged
+	var results []*delivery.RecipientResult
+	suppressed := svc.suppressionList().lookup(allRecipients, jsonMail.unsubscribeList())
+	for _, recipient := range allRecipients {
+		if entry, ok := suppressed[recipient]; ok {
+			log.Printf("Skipping suppressed recipient %s (%s)\n", recipient, entry.Reason)
+			r := suppressedResult(recipient, entry)
+			now := time.Now()
+			svc.attempts().record(&deliveryAttempt{MailUID: jsonMail.MailUID, MessageID: messageID, Result: r, StartedAt: now, FinishedAt: now})
+			results = append(results, r)
 		}
 	}
 
-	// Try to connect to ALL MX servers in priority order
-	// We'll attempt each one until we find a server that successfully accepts the email
-	var lastErr error
-	var attemptedServers []string
+	var pending []string
+	for _, recipient := range allRecipients {
+		if _, ok := suppressed[recipient]; !ok {
+			pending = append(pending, recipient)
+		}
+	}
 
-	log.Printf("Found %d MX server(s) for domain %s, will try all valid SMTP domains\n", len(mxRecords), domain)
+	// OpenPGP may refuse the message or split it into an encrypted and a
+	// plaintext variant, each delivered to its own recipients. Encrypted mail
+	// goes to each bcc recipient as a separate copy
+	var variants []*mailVariant
+	var refused []*delivery.RecipientResult
+	if jsonMail.SMIME.enabled() {
+		variants = prepareSMIME(jsonMail, pending)
+	} else {
+		variants, refused = preparePGP(jsonMail, pending, svc.pgpKeys())
+	}
+	for _, r := range refused {
+		now := time.Now()
+		svc.attempts().record(&deliveryAttempt{MailUID: jsonMail.MailUID, MessageID: messageID, Result: r, StartedAt: now, FinishedAt: now})
+		results = append(results, r)
+	}
 
-	for i, mx := range mxRecords {
-		host := strings.TrimSuffix(mx.Host, ".")
-		addr := net.JoinHostPort(host, "25")
-		attemptedServers = append(attemptedServers, fmt.Sprintf("%s (priority %d)", host, mx.Pref))
+	if jsonMail.Body == "" && jsonMail.HTML == "" {
+		log.Printf("WARNING: Email body is empty!\n")
+	}
+	if jsonMail.Subject == "" {
+		log.Printf("WARNING: Email subject is empty!\n")
+	}
 
-		log.Printf("[%d/%d] Attempting MX server %s (priority %d) for domain %s...\n",
-			i+1, len(mxRecords), host, mx.Pref, domain)
+	// Every attempt on every MX goes to the delivery log
+	d = d.WithHooks(delivery.Hooks{
+		Attempt: func(r *delivery.RecipientResult, startedAt, finishedAt time.Time) {
+			svc.attempts().record(&deliveryAttempt{
+				MailUID:    jsonMail.MailUID,
+				MessageID:  messageID,
+				Result:     r,
+				StartedAt:  startedAt,
+				FinishedAt: finishedAt,
+			})
+		},
+	})
 
-		// Dial with timeout to prevent hanging
-		dialer := &net.Dialer{
-			Timeout: 10 * time.Second,
+	for _, variant := range variants {
+		msg := &delivery.Message{
+			From:       variant.mail.envelopeFrom(),
+			Recipients: variant.recipients,
+			DSN:        variant.mail.DSN,
+			RequireTLS: variant.mail.RequireTLS,
+			// The header shows every To and Cc recipient, not only those of
+			// the variant, and is rendered once the server's extensions are known
+			Render: func(eightBitMIME bool) ([]byte, bool, error) {
+				return renderMessage(variant.mail, messageID, eightBitMIME)
+			},
 		}
-		conn, err := dialer.Dial("tcp", addr)
-		if err != nil {
-			lastErr = fmt.Errorf("failed to connect to %s: %v", addr, err)
-			log.Printf("Warning: %v, trying next MX server...\n", lastErr)
-			continue
+		if variant.mail.VERP {
+			msg.VERP = variant.mail.MailUID
 		}
 
-		// Set read and write timeouts to prevent hanging
-		readDeadline := time.Now().Add(30 * time.Second)
-		writeDeadline := time.Now().Add(30 * time.Second)
-		conn.SetReadDeadline(readDeadline)
-		conn.SetWriteDeadline(writeDeadline)
-
-		log.Printf("Connected to %s, attempting SMTP conversation...\n", addr)
-		log.Printf("Email details - From: %s, To: %v, CC: %v, BCC: %v, Subject: %s\n",
-			domainJsonMail.From, domainJsonMail.To, domainJsonMail.CC, domainJsonMail.BCC, domainJsonMail.Subject)
-		log.Printf("Email body length: %d bytes, Body preview: %s\n",
-			len(domainJsonMail.Body),
-			func() string {
-				if len(domainJsonMail.Body) > 100 {
-					return domainJsonMail.Body[:100] + "..."
-				}
-				return domainJsonMail.Body
-			}())
-
-		// Send email using MySMTP API v0.0.16 (includes ClientConn fixes and improvements)
-		// NewClientConnFromJSONMail handles the SMTP conversation and sends the email
-		// The connection must remain open during the SMTP conversation
-		// The ClientConn performs HELO, MAIL FROM, RCPT TO, DATA, and QUIT synchronously
-		// With v0.0.16, the ClientConn includes latest improvements and better connection handling
-
-		// Attempt SMTP conversation - connection must stay open until conversation completes
-		// NewClientConnFromJSONMail should perform the full SMTP conversation synchronously
-		// Log detailed information about what we're sending
-		log.Printf("Creating ClientConn with email data:\n")
-		log.Printf("  From: %s\n", domainJsonMail.From)
-		log.Printf("  To: %v\n", domainJsonMail.To)
-		log.Printf("  CC: %v\n", domainJsonMail.CC)
-		log.Printf("  BCC: %v\n", domainJsonMail.BCC)
-		log.Printf("  Subject: %s\n", domainJsonMail.Subject)
-		log.Printf("  Body: %q (length: %d)\n",
-			func() string {
-				if len(domainJsonMail.Body) > 50 {
-					return domainJsonMail.Body[:50] + "..."
-				}
-				return domainJsonMail.Body
-			}(),
-			len(domainJsonMail.Body))
-		log.Printf("  Headers: %v\n", domainJsonMail.Headers)
-
-		log.Printf("Initiating SMTP conversation via NewClientConnFromJSONMail...\n")
-		clientConn, smtpErr := smtp.NewClientConnFromJSONMail(conn, domainJsonMail)
-
-		// Log the result before checking errors
-		if smtpErr != nil {
-			log.Printf("ERROR: SMTP error during conversation: %v\n", smtpErr)
-			log.Printf("ERROR DETAILS: %+v\n", smtpErr)
-		}
-		if clientConn == nil {
-			log.Printf("ERROR: ClientConn is nil after creation\n")
-		} else {
-			log.Printf("ClientConn created successfully\n")
-			// Check if ClientConn has connection info
-			if connInfo := clientConn.GetConn(); connInfo != nil {
-				log.Printf("ClientConn has underlying connection\n")
+		variantResults, err := d.Send(ctx, msg)
+		if err != nil {
+			// Input was validated, so this is a bug rather than a delivery failure
+			log.Printf("Error: %v\n", err)
+			for _, recipient := range variant.recipients {
+				variantResults = append(variantResults, delivery.FailedResult(recipient, "", err))
 			}
 		}
+		svc.suppressionList().suppressBounces(variantResults)
+		results = append(results, variantResults...)
+	}
 
-		// Only close connection after SMTP conversation completes (success or failure)
-		// ClientConn handles QUIT command which closes the connection, but we ensure cleanup
-		defer func() {
-			if conn != nil {
-				log.Printf("Cleaning up: closing connection to %s\n", addr)
-				conn.Close()
-			}
-		}()
-
-		if clientConn == nil || smtpErr != nil {
-			if smtpErr != nil {
-				lastErr = fmt.Errorf("failed to create client connection or SMTP conversation failed: %v", smtpErr)
-			} else {
-				lastErr = fmt.Errorf("failed to create client connection or SMTP conversation failed")
-			}
-			log.Printf("Warning: SMTP conversation failed on %s: %v, trying next MX server...\n", addr, lastErr)
-			continue
+	sendResult := newSendResult(messageID, results)
+	for _, r := range results {
+		if r.Status != delivery.StatusDelivered {
+			log.Printf("Error: %s %s: %s\n", r.Recipient, r.Status, r.Message)
 		}
+	}
+	return sendResult
+}
 
-		// If we get here, the ClientConn was created successfully
-		// The ClientConn manages the SMTP conversation synchronously during creation
-		// After NewClientConnFromJSONMail returns successfully, the email should be sent
-		// The SMTP conversation (HELO, MAIL FROM, RCPT TO, DATA, QUIT) is complete
-		log.Printf("Email sent successfully to domain %s via %s (priority %d)\n", domain, host, mx.Pref)
-		log.Printf("Successfully used %s out of %d available MX server(s)\n", host, len(mxRecords))
-		return nil // Success!
+// deliverBatch sends several independent messages one after another and
+// collects their results; a failure of one message does not stop the others
+func deliverBatch(ctx context.Context, messages []*JSONMail, d *delivery.Deliverer, svc *services) *BatchResult {
+	results := make([]*SendResult, 0, len(messages))
+	for i, m := range messages {
+		log.Printf("Batch message %d/%d to %v\n", i+1, len(messages), m.recipients())
+		results = append(results, sendMail(ctx, m, d, svc))
 	}
+	return newBatchResult(results)
+}
+
+// newDeliverer configures delivery from the environment: SMTP_CLIENT_HOSTNAME
+// is the name sent in EHLO, SENDSMTP_DANE and SENDSMTP_DANE_RESOLVER set up DANE
+func newDeliverer() (*delivery.Deliverer, error) {
+	dane, err := delivery.NewDANE(
+		strings.ToLower(getEnvOrDefault("SENDSMTP_DANE", delivery.DANEOff)),
+		getEnvOrDefault("SENDSMTP_DANE_RESOLVER", "127.0.0.1:53"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("SENDSMTP_DANE: %v", err)
+	}
+	return delivery.New(delivery.Options{
+		LocalName: getEnvOrDefault("SMTP_CLIENT_HOSTNAME", "localhost"),
+		DANE:      dane,
+		Hooks:     delivery.Hooks{Logf: log.Printf},
+	})
+}
+
+// services bundles the database backed parts of sending. Each of them is
+// optional: a nil field (or a nil *services) disables it
+type services struct {
+	log          *deliveryLog
+	suppressions *suppressionList
+	pgp          *pgpKeyStore
+}
+
+// openServices connects the delivery log, suppression list and OpenPGP keys if a database
+// is configured. Delivery goes ahead without them when the database is unavailable
+func openServices() *services {
+	conn := openDatabase()
+	if conn == nil {
+		return nil
+	}
+	svc := &services{}
+	var err error
+	if svc.log, err = newDeliveryLog(conn); err != nil {
+		log.Printf("WARNING: delivery log disabled: %v\n", err)
+	}
+	if svc.suppressions, err = newSuppressionList(conn); err != nil {
+		log.Printf("WARNING: suppression list disabled: %v\n", err)
+	}
+	if svc.pgp, err = newPGPKeyStore(conn); err != nil {
+		log.Printf("WARNING: OpenPGP keys disabled: %v\n", err)
+	}
+	return svc
+}
+
+func (svc *services) attempts() *deliveryLog {
+	if svc == nil {
+		return nil
+	}
+	return svc.log
+}
+
+func (svc *services) suppressionList() *suppressionList {
+	if svc == nil {
+		return nil
+	}
+	return svc.suppressions
+}
+
+func (svc *services) pgpKeys() *pgpKeyStore {
+	if svc == nil {
+		return nil
+	}
+	return svc.pgp
+}
+
+// printJSON writes a result document on stdout for the calling process
+func printJSON(v interface{}) {
+	out, err := json.Marshal(v)
+	if err != nil {
+		log.Fatalf("Error encoding results: %v\n", err)
+	}
+	fmt.Println(string(out))
+}
 
-	// If we reach here, all MX servers failed
-	log.Printf("All %d MX server(s) failed for domain %s\n", len(mxRecords), domain)
-	log.Printf("Attempted servers: %s\n", strings.Join(attemptedServers, ", "))
-	return fmt.Errorf("failed to send email to domain %s after trying all %d MX server(s). Last error: %v",
-		domain, len(mxRecords), lastErr)
+// exitWithValidationErrors reports rejected input as JSON on stdout so callers
+// can act on the error codes, then exits with status 2
+func exitWithValidationErrors(errs ValidationErrors) {
+	log.Printf("Error: input rejected: %v\n", errs)
+	printJSON(newInvalidResult(errs))
+	os.Exit(2)
 }
 
 func contains(slice []string, item string) bool {
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+
+	"sendsmtp/delivery"
+)
+
+// JSONMail is the sendsmtp input document, see the package documentation for its format
+type JSONMail struct {
+	From    string               `json:"from"`
+	To      []string             `json:"to"`
+	CC      []string             `json:"cc"`
+	BCC     []string             `json:"bcc"`
+	Subject string               `json:"subject"`
+	Body    string               `json:"body"`
+	HTML    string               `json:"html,omitempty"`
+	Headers map[string]string    `json:"headers"`
+	DSN     *delivery.DSNOptions `json:"dsn,omitempty"`
+	SendAt  *time.Time           `json:"send_at,omitempty"`
+	MailUID string               `json:"mail_uid,omitempty"`
+	SMIME   *SMIMEOptions        `json:"smime,omitempty"`
+	PGP     *PGPOptions          `json:"pgp,omitempty"`
+
+	// Refuse delivery without validated TLS, see delivery/requiretls.go
+	RequireTLS bool `json:"require_tls,omitempty"`
+
+	// One-click unsubscribe, see UnsubscribeOptions
+	Unsubscribe *UnsubscribeOptions `json:"unsubscribe,omitempty"`
+
+	// Envelope sender, see envelope.go
+	EnvelopeFrom string `json:"envelope_from,omitempty"`
+	VERP         bool   `json:"verp,omitempty"`
+
+	// Mail merge, see MergeRecipient
+	Template   string                 `json:"template,omitempty"`
+	Vars       map[string]interface{} `json:"vars,omitempty"`
+	Recipients []MergeRecipient       `json:"recipients,omitempty"`
+
+	pgp     *pgpSealer // OpenPGP keys resolved by preparePGP, nil when not sealed
+	smimeTo []string   // S/MIME recipients of this copy, set by prepareSMIME
+}
+
+// parseJSONMail decodes the input document
+func parseJSONMail(jsonStr string) (*JSONMail, error) {
+	var m JSONMail
+	if err := json.Unmarshal([]byte(jsonStr), &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// recipients returns every envelope recipient (to, cc and bcc)
+func (m *JSONMail) recipients() []string {
+	all := append([]string{}, m.To...)
+	all = append(all, m.CC...)
+	return append(all, m.BCC...)
+}
+
+// mailVariant is a copy of a message and the recipients that receive it. An
+// encrypted message is sent as several variants, see encryptionGroups, and
+// the OpenPGP plaintext policy adds an unencrypted one
+type mailVariant struct {
+	mail       *JSONMail
+	recipients []string
+}
+
+// encryptionGroups splits recipients into the groups that share one encrypted
+// copy: the to and cc recipients together, and each bcc recipient on its own.
+// Every copy lists the keys it is encrypted to, so a shared copy would reveal
+// the bcc recipients to everyone else
+func encryptionGroups(m *JSONMail, recipients []string) [][]string {
+	var visible []string
+	var groups [][]string
+	for _, recipient := range recipients {
+		if containsFold(m.BCC, recipient) && !containsFold(m.To, recipient) && !containsFold(m.CC, recipient) {
+			groups = append(groups, []string{recipient})
+		} else {
+			visible = append(visible, recipient)
+		}
+	}
+	if len(visible) > 0 {
+		groups = append([][]string{visible}, groups...)
+	}
+	return groups
+}
+
+// unsubscribeList is the list recipients may have unsubscribed from, if any
+func (m *JSONMail) unsubscribeList() string {
+	if m.Unsubscribe == nil {
+		return ""
+	}
+	return m.Unsubscribe.List
+}
+
+// header returns the custom header value for name, matched case-insensitively
+func (m *JSONMail) header(name string) string {
+	for k, v := range m.Headers {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return ""
+}
+
+// messageID returns the caller supplied Message-ID or generates one
+func (m *JSONMail) messageID() string {
+	if id := m.header("Message-ID"); id != "" {
+		return id
+	}
+	return newMessageID(m.From)
+}
+
+// newMessageID returns a unique Message-ID value in the sender's domain
+func newMessageID(from string) string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	domain := from[strings.LastIndex(from, "@")+1:]
+	return fmt.Sprintf("<%s@%s>", hex.EncodeToString(buf), domain)
+}
+
+// buildMessage renders the RFC 5322 message sent in DATA. Bcc recipients are
+// part of the envelope only and never appear in the header. allow8bit reports
+// whether the server advertised 8BITMIME; the second result reports whether
+// any part was sent as 8bit, in which case MAIL FROM must carry BODY=8BITMIME.
+// An error is only returned when S/MIME or OpenPGP signing or encryption fails
+func buildMessage(m *JSONMail, messageID string, allow8bit bool) ([]byte, bool, error) {
+	var b bytes.Buffer
+
+	date := m.header("Date")
+	if date == "" {
+		date = time.Now().Format(time.RFC1123Z)
+	}
+	writeHeader(&b, "Date", date)
+	writeHeader(&b, "From", m.From)
+	if len(m.To) > 0 {
+		writeHeader(&b, "To", strings.Join(m.To, ", "))
+	}
+	if len(m.CC) > 0 {
+		writeHeader(&b, "Cc", strings.Join(m.CC, ", "))
+	}
+	writeHeader(&b, "Subject", mime.QEncoding.Encode("UTF-8", m.Subject))
+	writeHeader(&b, "Message-ID", messageID)
+
+	// Custom headers were validated by validateHeaders, emit them in a stable order
+	names := make([]string, 0, len(m.Headers))
+	for name := range m.Headers {
+		if strings.EqualFold(name, "Message-ID") || strings.EqualFold(name, "Date") {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeHeader(&b, name, m.Headers[name])
+	}
+	if m.Unsubscribe != nil {
+		link, post := m.Unsubscribe.headers(m.recipients()[0])
+		writeHeader(&b, "List-Unsubscribe", link)
+		writeHeader(&b, "List-Unsubscribe-Post", post)
+	}
+
+	writeHeader(&b, "MIME-Version", "1.0")
+
+	if !m.SMIME.enabled() && m.pgp == nil {
+		entity, uses8bit := buildBody(m, allow8bit)
+		b.Write(entity)
+		return b.Bytes(), uses8bit, nil
+	}
+
+	// Signed content must survive any relay unchanged, so it is always 7bit
+	entity, _ := buildBody(m, false)
+	var err error
+	if m.pgp != nil {
+		entity, err = m.pgp.seal(entity)
+	} else {
+		recipients := m.smimeTo
+		if recipients == nil {
+			recipients = m.recipients()
+		}
+		entity, err = m.SMIME.seal(m.From, recipients, entity)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	b.Write(entity)
+	return b.Bytes(), false, nil
+}
+
+// renderMessage is buildMessage as a delivery.Message Render func: a message
+// that cannot be signed or encrypted fails its recipients permanently
+func renderMessage(m *JSONMail, messageID string, allow8bit bool) ([]byte, bool, error) {
+	message, uses8bit, err := buildMessage(m, messageID, allow8bit)
+	if err != nil {
+		if m.pgp != nil {
+			return nil, false, errPGPFailed(err)
+		}
+		return nil, false, errSMIMEFailed(err)
+	}
+	return message, uses8bit, nil
+}
+
+// buildBody renders the MIME entity of the message: its Content-* headers, a
+// blank line and the body. A plain text body, an HTML body, or both as
+// multipart/alternative
+func buildBody(m *JSONMail, allow8bit bool) ([]byte, bool) {
+	var b bytes.Buffer
+
+	var parts []textPart
+	if m.Body != "" || m.HTML == "" {
+		parts = append(parts, newTextPart("text/plain", m.Body, allow8bit))
+	}
+	if m.HTML != "" {
+		parts = append(parts, newTextPart("text/html", m.HTML, allow8bit))
+	}
+
+	uses8bit := false
+	for _, part := range parts {
+		uses8bit = uses8bit || part.encoding == Encoding8Bit
+	}
+
+	if len(parts) == 1 {
+		parts[0].writeHeaders(&b)
+		b.WriteString("\r\n")
+		b.Write(parts[0].body)
+		return b.Bytes(), uses8bit
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	writeHeader(&b, "Content-Type", mime.FormatMediaType("multipart/alternative", map[string]string{"boundary": mw.Boundary()}))
+	b.WriteString("\r\n")
+	for _, part := range parts {
+		w, _ := mw.CreatePart(part.header())
+		w.Write(part.body)
+	}
+	mw.Close()
+	b.Write(body.Bytes())
+	return b.Bytes(), uses8bit
+}
+
+// textPart is a single text body with its transfer encoding already applied
+type textPart struct {
+	contentType string
+	charset     string
+	encoding    string
+	body        []byte
+}
+
+// newTextPart picks charset and Content-Transfer-Encoding for text and encodes it
+func newTextPart(contentType, text string, allow8bit bool) textPart {
+	stats := analyzeText(text)
+	encoding := chooseEncoding(stats, allow8bit)
+	return textPart{
+		contentType: contentType,
+		charset:     charsetFor(stats),
+		encoding:    encoding,
+		body:        encodeBody(text, encoding),
+	}
+}
+
+func (p textPart) header() textproto.MIMEHeader {
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Type", mime.FormatMediaType(p.contentType, map[string]string{"charset": p.charset}))
+	h.Set("Content-Transfer-Encoding", p.encoding)
+	return h
+}
+
+func (p textPart) writeHeaders(b *bytes.Buffer) {
+	h := p.header()
+	writeHeader(b, "Content-Type", h.Get("Content-Type"))
+	writeHeader(b, "Content-Transfer-Encoding", h.Get("Content-Transfer-Encoding"))
+}
+
+func writeHeader(b *bytes.Buffer, name, value string) {
+	b.WriteString(name)
+	b.WriteString(": ")
+	b.WriteString(value)
+	b.WriteString("\r\n")
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"mime"
+	"mime/multipart"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/lib/pq"
+	"sendsmtp/delivery"
+)
+
+// OpenPGP (RFC 3156 PGP/MIME) signing and encryption
+//
+//	"pgp": {
+//	  "sign": true,               // multipart/signed with the sender's key
+//	  "encrypt": true,            // multipart/encrypted to every recipient's key
+//	  "missing_key": "fail"       // or "plaintext", see below
+//	}
+//
+// Keys live in the pgp_keys table, one row per address, and are added with
+// "sendsmtp -import-key <address> < key.asc". Signing needs the sender's
+// private key; a passphrase protected key is unlocked with SENDSMTP_PGP_PASSPHRASE.
+//
+// missing_key decides what happens when encryption is requested and some
+// recipients have no usable key:
+//
+//	fail       nothing is sent, every recipient is reported with reason "pgp_key_missing"
+//	plaintext  recipients with a key get the encrypted message, the others the
+//	           same message unencrypted (still signed if "sign" is set)
+//
+// A message is either S/MIME or PGP/MIME, not both.
+type PGPOptions struct {
+	Sign       bool   `json:"sign,omitempty"`
+	Encrypt    bool   `json:"encrypt,omitempty"`
+	MissingKey string `json:"missing_key,omitempty"`
+}
+
+// Values of PGPOptions.MissingKey
+const (
+	PGPMissingKeyFail      = "fail"
+	PGPMissingKeyPlaintext = "plaintext"
+)
+
+// pgpHash is the digest requested for signatures, named in micalg
+const pgpHash = crypto.SHA256
+
+// enabled reports whether the message is signed or encrypted
+func (o *PGPOptions) enabled() bool {
+	return o != nil && (o.Sign || o.Encrypt)
+}
+
+// missingKeyPolicy returns the missing_key policy, failing by default
+func (o *PGPOptions) missingKeyPolicy() string {
+	if o == nil || o.MissingKey == "" {
+		return PGPMissingKeyFail
+	}
+	return o.MissingKey
+}
+
+// validate checks the options themselves; keys are looked up when sending
+func (o *PGPOptions) validate(smime *SMIMEOptions) ValidationErrors {
+	var errs ValidationErrors
+	if o == nil {
+		return nil
+	}
+	switch o.MissingKey {
+	case "", PGPMissingKeyFail, PGPMissingKeyPlaintext:
+	default:
+		errs.add(ErrInvalidPGP, "pgp.missing_key", "missing_key must be %q or %q, got %q",
+			PGPMissingKeyFail, PGPMissingKeyPlaintext, o.MissingKey)
+	}
+	if o.enabled() && smime.enabled() {
+		errs.add(ErrInvalidPGP, "pgp", "a message cannot use both S/MIME and PGP/MIME")
+	}
+	return errs
+}
+
+// pgpKeyStore is the pgp_keys table. A nil *pgpKeyStore has no keys
+type pgpKeyStore struct {
+	conn *sql.DB
+}
+
+// newPGPKeyStore checks for the pgp_keys table
+func newPGPKeyStore(conn *sql.DB) (*pgpKeyStore, error) {
+	if conn == nil {
+		return nil, nil
+	}
+	if err := checkTables(conn, "pgp_keys"); err != nil {
+		return nil, err
+	}
+	return &pgpKeyStore{conn: conn}, nil
+}
+
+// importKey stores an armored public or private key for address, replacing
+// any previous key. The key must carry a user id for address
+func (s *pgpKeyStore) importKey(address, armored string) (string, error) {
+	if s == nil {
+		return "", fmt.Errorf("OpenPGP keys require a database (set DB_HOST)")
+	}
+	entity, err := readArmoredEntity(armored)
+	if err != nil {
+		return "", err
+	}
+	if !entityHasAddress(entity, address) {
+		return "", fmt.Errorf("key has no user id for %s", address)
+	}
+
+	var public bytes.Buffer
+	w, err := armor.Encode(&public, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return "", err
+	}
+	if err := entity.Serialize(w); err != nil {
+		return "", fmt.Errorf("error encoding public key: %v", err)
+	}
+	w.Close()
+
+	var private interface{}
+	if entity.PrivateKey != nil {
+		private = armored
+	}
+	fingerprint := strings.ToUpper(hex.EncodeToString(entity.PrimaryKey.Fingerprint))
+
+	_, err = s.conn.Exec(`
+		INSERT INTO pgp_keys (address, fingerprint, public_key, private_key)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (address) DO UPDATE
+		SET fingerprint = EXCLUDED.fingerprint, public_key = EXCLUDED.public_key,
+			private_key = EXCLUDED.private_key, updated_at = CURRENT_TIMESTAMP`,
+		normalizeAddress(address), fingerprint, public.String(), private,
+	)
+	if err != nil {
+		return "", fmt.Errorf("error storing key for %s: %v", address, err)
+	}
+	log.Printf("Imported OpenPGP key %s for %s (private key: %v)\n", fingerprint, address, entity.PrivateKey != nil)
+	return fingerprint, nil
+}
+
+// publicKeys returns the usable encryption keys of those addresses that have one
+func (s *pgpKeyStore) publicKeys(addresses []string) (map[string]*openpgp.Entity, error) {
+	if s == nil {
+		return nil, fmt.Errorf("OpenPGP keys require a database (set DB_HOST)")
+	}
+	normalized := make([]string, len(addresses))
+	for i, addr := range addresses {
+		normalized[i] = normalizeAddress(addr)
+	}
+
+	rows, err := s.conn.Query("SELECT address, public_key FROM pgp_keys WHERE address = ANY($1)", pq.Array(normalized))
+	if err != nil {
+		return nil, fmt.Errorf("error looking up OpenPGP keys: %v", err)
+	}
+	defer rows.Close()
+
+	byAddress := make(map[string]*openpgp.Entity)
+	for rows.Next() {
+		var address, armored string
+		if err := rows.Scan(&address, &armored); err != nil {
+			return nil, err
+		}
+		entity, err := readArmoredEntity(armored)
+		if err != nil {
+			log.Printf("WARNING: unusable OpenPGP key for %s: %v\n", address, err)
+			continue
+		}
+		if _, ok := entity.EncryptionKey(time.Now()); !ok {
+			log.Printf("WARNING: OpenPGP key for %s has no valid encryption key\n", address)
+			continue
+		}
+		byAddress[address] = entity
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*openpgp.Entity)
+	for _, addr := range addresses {
+		if entity, ok := byAddress[normalizeAddress(addr)]; ok {
+			keys[addr] = entity
+		}
+	}
+	return keys, nil
+}
+
+// signingKey returns the sender's unlocked private key
+func (s *pgpKeyStore) signingKey(address string) (*openpgp.Entity, error) {
+	if s == nil {
+		return nil, fmt.Errorf("OpenPGP keys require a database (set DB_HOST)")
+	}
+	var private sql.NullString
+	err := s.conn.QueryRow("SELECT private_key FROM pgp_keys WHERE address = $1", normalizeAddress(address)).Scan(&private)
+	if err == sql.ErrNoRows || (err == nil && !private.Valid) {
+		return nil, fmt.Errorf("no OpenPGP private key for %s", address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error looking up OpenPGP key for %s: %v", address, err)
+	}
+
+	entity, err := readArmoredEntity(private.String)
+	if err != nil {
+		return nil, fmt.Errorf("unusable OpenPGP key for %s: %v", address, err)
+	}
+	if err := entity.DecryptPrivateKeys([]byte(os.Getenv("SENDSMTP_PGP_PASSPHRASE"))); err != nil {
+		return nil, fmt.Errorf("cannot unlock OpenPGP key for %s (check SENDSMTP_PGP_PASSPHRASE): %v", address, err)
+	}
+	if _, ok := entity.SigningKey(time.Now()); !ok {
+		return nil, fmt.Errorf("OpenPGP key for %s has no valid signing key", address)
+	}
+	return entity, nil
+}
+
+// preparePGP resolves the keys for a message and splits recipients into the
+// variants to deliver, with a separately encrypted copy for each bcc recipient.
+// Recipients that cannot be sent to are returned as results
+func preparePGP(m *JSONMail, recipients []string, keys *pgpKeyStore) ([]*mailVariant, []*delivery.RecipientResult) {
+	if !m.PGP.enabled() || len(recipients) == 0 {
+		return []*mailVariant{{mail: m, recipients: recipients}}, nil
+	}
+
+	failAll := func(reason func(recipient string) error) []*delivery.RecipientResult {
+		results := make([]*delivery.RecipientResult, 0, len(recipients))
+		for _, recipient := range recipients {
+			r := delivery.FailedResult(recipient, "", reason(recipient))
+			r.DSN = m.DSN.Result(recipient, false)
+			results = append(results, r)
+		}
+		return results
+	}
+
+	var signer *openpgp.Entity
+	if m.PGP.Sign {
+		var err error
+		if signer, err = keys.signingKey(m.From); err != nil {
+			log.Printf("Error: %v\n", err)
+			return nil, failAll(func(string) error { return errPGPFailed(err) })
+		}
+	}
+
+	// withSealer returns a copy of m that buildMessage seals with s
+	withSealer := func(s *pgpSealer) *JSONMail {
+		copied := *m
+		copied.pgp = s
+		return &copied
+	}
+
+	if !m.PGP.Encrypt {
+		return []*mailVariant{{mail: withSealer(&pgpSealer{signer: signer}), recipients: recipients}}, nil
+	}
+
+	found, err := keys.publicKeys(recipients)
+	if err != nil {
+		log.Printf("Error: %v\n", err)
+		return nil, failAll(func(string) error { return errPGPFailed(err) })
+	}
+	var keyed, missing []string
+	for _, recipient := range recipients {
+		if _, ok := found[recipient]; ok {
+			keyed = append(keyed, recipient)
+		} else {
+			missing = append(missing, recipient)
+		}
+	}
+
+	if len(missing) > 0 && m.PGP.missingKeyPolicy() == PGPMissingKeyFail {
+		log.Printf("Not sending: no OpenPGP key for %s and missing_key is %q\n", strings.Join(missing, ", "), PGPMissingKeyFail)
+		return nil, failAll(func(recipient string) error {
+			if contains(missing, recipient) {
+				return errPGPKeyMissing(fmt.Sprintf("no OpenPGP key for %s", recipient))
+			}
+			return errPGPKeyMissing(fmt.Sprintf("not sent, no OpenPGP key for %s", strings.Join(missing, ", ")))
+		})
+	}
+
+	var variants []*mailVariant
+	for _, group := range encryptionGroups(m, keyed) {
+		to := make([]*openpgp.Entity, len(group))
+		for i, recipient := range group {
+			to[i] = found[recipient]
+		}
+		variants = append(variants, &mailVariant{mail: withSealer(&pgpSealer{signer: signer, to: to}), recipients: group})
+	}
+	if len(missing) > 0 {
+		log.Printf("Sending unencrypted to %s, which have no OpenPGP key\n", strings.Join(missing, ", "))
+		var sealer *pgpSealer
+		if signer != nil {
+			sealer = &pgpSealer{signer: signer}
+		}
+		variants = append(variants, &mailVariant{mail: withSealer(sealer), recipients: missing})
+	}
+	return variants, nil
+}
+
+// pgpSealer holds the resolved keys for one message variant: it signs when
+// signer is set and encrypts when to is not empty
+type pgpSealer struct {
+	signer *openpgp.Entity
+	to     []*openpgp.Entity
+}
+
+// seal turns a MIME entity into its multipart/signed or multipart/encrypted form
+func (p *pgpSealer) seal(entity []byte) ([]byte, error) {
+	config := &packet.Config{DefaultHash: pgpHash}
+	if len(p.to) == 0 {
+		return p.sign(entity, config)
+	}
+
+	// RFC 3156 section 6.2: the signature travels inside the encrypted data
+	var encrypted bytes.Buffer
+	aw, err := armor.Encode(&encrypted, "PGP MESSAGE", nil)
+	if err != nil {
+		return nil, err
+	}
+	pw, err := openpgp.Encrypt(aw, p.to, p.signer, nil, config)
+	if err != nil {
+		return nil, fmt.Errorf("error encrypting message: %v", err)
+	}
+	if _, err := pw.Write(entity); err != nil {
+		return nil, fmt.Errorf("error encrypting message: %v", err)
+	}
+	if err := pw.Close(); err != nil {
+		return nil, fmt.Errorf("error encrypting message: %v", err)
+	}
+	aw.Close()
+	log.Printf("Encrypted message to %d OpenPGP key(s) (signed: %v)\n", len(p.to), p.signer != nil)
+
+	boundary := multipart.NewWriter(nil).Boundary()
+	var b bytes.Buffer
+	writeHeader(&b, "Content-Type", mime.FormatMediaType("multipart/encrypted", map[string]string{
+		"protocol": "application/pgp-encrypted",
+		"boundary": boundary,
+	}))
+	b.WriteString("\r\n")
+	b.WriteString("This is an OpenPGP/MIME encrypted message (RFC 3156).\r\n\r\n")
+	b.WriteString("--" + boundary + "\r\n")
+	writeHeader(&b, "Content-Type", "application/pgp-encrypted")
+	writeHeader(&b, "Content-Description", "PGP/MIME version identification")
+	b.WriteString("\r\nVersion: 1\r\n\r\n")
+	b.WriteString("--" + boundary + "\r\n")
+	writeHeader(&b, "Content-Type", `application/octet-stream; name="encrypted.asc"`)
+	writeHeader(&b, "Content-Description", "OpenPGP encrypted message")
+	writeHeader(&b, "Content-Disposition", `inline; filename="encrypted.asc"`)
+	b.WriteString("\r\n")
+	b.Write(crlfLines(encrypted.Bytes()))
+	b.WriteString("--" + boundary + "--\r\n")
+	return b.Bytes(), nil
+}
+
+// sign wraps entity in multipart/signed with a detached application/pgp-signature
+func (p *pgpSealer) sign(entity []byte, config *packet.Config) ([]byte, error) {
+	var signature bytes.Buffer
+	if err := openpgp.DetachSign(&signature, p.signer, bytes.NewReader(entity), config); err != nil {
+		return nil, fmt.Errorf("error signing message: %v", err)
+	}
+
+	// micalg must name the hash actually used, which the key's preferences may override
+	pkt, err := packet.Read(bytes.NewReader(signature.Bytes()))
+	if err != nil {
+		return nil, fmt.Errorf("error reading signature: %v", err)
+	}
+	sig, ok := pkt.(*packet.Signature)
+	if !ok {
+		return nil, fmt.Errorf("unexpected signature packet %T", pkt)
+	}
+	micalg := "pgp-" + strings.ToLower(strings.ReplaceAll(sig.Hash.String(), "-", ""))
+
+	var armored bytes.Buffer
+	aw, err := armor.Encode(&armored, openpgp.SignatureType, nil)
+	if err != nil {
+		return nil, err
+	}
+	aw.Write(signature.Bytes())
+	aw.Close()
+	log.Printf("Signed message with OpenPGP key %X\n", p.signer.PrimaryKey.Fingerprint)
+
+	boundary := multipart.NewWriter(nil).Boundary()
+	var b bytes.Buffer
+	writeHeader(&b, "Content-Type", mime.FormatMediaType("multipart/signed", map[string]string{
+		"protocol": "application/pgp-signature",
+		"micalg":   micalg,
+		"boundary": boundary,
+	}))
+	b.WriteString("\r\n")
+	b.WriteString("This is an OpenPGP/MIME signed message (RFC 3156).\r\n\r\n")
+	b.WriteString("--" + boundary + "\r\n")
+	// As for S/MIME, the CRLF before the boundary is not part of the signed data
+	b.Write(entity)
+	b.WriteString("\r\n--" + boundary + "\r\n")
+	writeHeader(&b, "Content-Type", `application/pgp-signature; name="signature.asc"`)
+	writeHeader(&b, "Content-Description", "OpenPGP digital signature")
+	writeHeader(&b, "Content-Disposition", `attachment; filename="signature.asc"`)
+	b.WriteString("\r\n")
+	b.Write(crlfLines(armored.Bytes()))
+	b.WriteString("--" + boundary + "--\r\n")
+	return b.Bytes(), nil
+}
+
+// readArmoredEntity parses the first key of an ASCII armored key block
+func readArmoredEntity(armored string) (*openpgp.Entity, error) {
+	entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(armored))
+	if err != nil {
+		return nil, fmt.Errorf("invalid OpenPGP key: %v", err)
+	}
+	if len(entities) == 0 {
+		return nil, fmt.Errorf("no OpenPGP key found")
+	}
+	return entities[0], nil
+}
+
+// entityHasAddress reports whether one of the key's user ids is for address
+func entityHasAddress(entity *openpgp.Entity, address string) bool {
+	for _, identity := range entity.Identities {
+		if identity.UserId != nil && strings.EqualFold(identity.UserId.Email, address) {
+			return true
+		}
+	}
+	return false
+}
+
+// crlfLines converts the LF line endings of armored output to CRLF
+func crlfLines(data []byte) []byte {
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	data = bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
+	if !bytes.HasSuffix(data, []byte("\r\n")) {
+		data = append(data, '\r', '\n')
+	}
+	return data
+}
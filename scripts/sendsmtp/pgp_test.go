@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+)
+
+// newTestEntity generates an unprotected OpenPGP key for address
+func newTestEntity(t *testing.T, name, address string) *openpgp.Entity {
+	t.Helper()
+	entity, err := openpgp.NewEntity(name, "", address, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entity
+}
+
+// buildPGPMessage renders m sealed by sealer
+func buildPGPMessage(t *testing.T, m *JSONMail, sealer *pgpSealer) []byte {
+	t.Helper()
+	if errs := validateJSONMail(m); errs != nil {
+		t.Fatalf("unexpected validation errors: %v", errs)
+	}
+	m.pgp = sealer
+	message, uses8bit, err := buildMessage(m, "<pgp@example.com>", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uses8bit {
+		t.Error("sealed message must not use 8bit")
+	}
+	return message
+}
+
+func TestPGPSignedMessageVerifies(t *testing.T) {
+	alice := newTestEntity(t, "Alice", "alice@example.com")
+	m := &JSONMail{
+		From:    "alice@example.com",
+		To:      []string{"bob@example.net"},
+		Subject: "Signed",
+		Body:    "Grüße from a signed message\n",
+		PGP:     &PGPOptions{Sign: true},
+	}
+	message := buildPGPMessage(t, m, &pgpSealer{signer: alice})
+
+	mediaType, params, body := readEntity(t, message)
+	if mediaType != "multipart/signed" || params["protocol"] != "application/pgp-signature" || params["micalg"] != "pgp-sha256" {
+		t.Fatalf("got %s %v, want multipart/signed with pgp-signature and pgp-sha256", mediaType, params)
+	}
+	signed, signature := splitSigned(t, body, params["boundary"], "application/pgp-signature")
+	if !bytes.HasPrefix(signature, []byte("-----BEGIN PGP SIGNATURE-----\r\n")) {
+		t.Errorf("signature part is not ASCII armored: %.40q", signature)
+	}
+
+	keyring := openpgp.EntityList{alice}
+	signer, err := openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(signed), bytes.NewReader(signature), nil)
+	if err != nil {
+		t.Fatalf("signature does not verify: %v", err)
+	}
+	if signer.PrimaryKey.KeyId != alice.PrimaryKey.KeyId {
+		t.Errorf("signed by %X, want Alice", signer.PrimaryKey.KeyId)
+	}
+	if innerType, _, text := readEntity(t, signed); innerType != "text/plain" || !bytes.Contains(text, []byte("from a signed message")) {
+		t.Errorf("signed entity is %s %q, want the text/plain body", innerType, text)
+	}
+
+	// Any change to the signed part must break the signature
+	forged := bytes.Replace(signed, []byte("signed"), []byte("forged"), 1)
+	if _, err := openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(forged), bytes.NewReader(signature), nil); err == nil {
+		t.Error("tampered content verified")
+	}
+}
+
+func TestPGPEncryptedMessageDecrypts(t *testing.T) {
+	alice := newTestEntity(t, "Alice", "alice@example.com")
+	bob := newTestEntity(t, "Bob", "bob@example.net")
+	carol := newTestEntity(t, "Carol", "carol@example.org")
+
+	for _, tt := range []struct {
+		name   string
+		signer *openpgp.Entity
+	}{
+		{"signed and encrypted", alice},
+		{"encrypted only", nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &JSONMail{
+				From:    "alice@example.com",
+				To:      []string{"bob@example.net", "carol@example.org"},
+				Subject: "Secret",
+				Body:    "plain text",
+				HTML:    "<p>html</p>",
+				PGP:     &PGPOptions{Sign: tt.signer != nil, Encrypt: true},
+			}
+			message := buildPGPMessage(t, m, &pgpSealer{signer: tt.signer, to: []*openpgp.Entity{bob, carol}})
+			if bytes.Contains(message, []byte("plain text")) {
+				t.Fatal("body is visible in the encrypted message")
+			}
+
+			// RFC 3156 section 4: a version part, then the encrypted data
+			mediaType, params, body := readEntity(t, message)
+			if mediaType != "multipart/encrypted" || params["protocol"] != "application/pgp-encrypted" {
+				t.Fatalf("got %s %v, want multipart/encrypted with pgp-encrypted", mediaType, params)
+			}
+			mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+			version, err := mr.NextPart()
+			if err != nil {
+				t.Fatal(err)
+			}
+			versionBody, _ := io.ReadAll(version)
+			if version.Header.Get("Content-Type") != "application/pgp-encrypted" || strings.TrimSpace(string(versionBody)) != "Version: 1" {
+				t.Errorf("first part %v %q, want application/pgp-encrypted Version: 1", version.Header, versionBody)
+			}
+			data, err := mr.NextPart()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dataType, _, _ := mime.ParseMediaType(data.Header.Get("Content-Type")); dataType != "application/octet-stream" {
+				t.Errorf("second part is %s, want application/octet-stream", dataType)
+			}
+			armored, _ := io.ReadAll(data)
+			if _, err := mr.NextPart(); err != io.EOF {
+				t.Errorf("more than two parts: %v", err)
+			}
+
+			// Every recipient can decrypt it on their own
+			for _, recipient := range []*openpgp.Entity{bob, carol} {
+				block, err := armor.Decode(bytes.NewReader(armored))
+				if err != nil || block.Type != "PGP MESSAGE" {
+					t.Fatalf("encrypted part is not an armored PGP MESSAGE: %v", err)
+				}
+				md, err := openpgp.ReadMessage(block.Body, openpgp.EntityList{recipient, alice}, nil, nil)
+				if err != nil {
+					t.Fatalf("%s cannot decrypt: %v", recipient.PrimaryIdentity().UserId.Email, err)
+				}
+				inner, err := io.ReadAll(md.UnverifiedBody)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// The signature is inside the encrypted data (RFC 3156 section 6.2)
+				if md.IsSigned != (tt.signer != nil) {
+					t.Errorf("IsSigned = %v", md.IsSigned)
+				}
+				if md.IsSigned && (md.SignatureError != nil || md.SignedByKeyId != alice.PrimaryKey.KeyId) {
+					t.Errorf("inner signature does not verify: %v", md.SignatureError)
+				}
+				if innerType, _, _ := readEntity(t, inner); innerType != "multipart/alternative" {
+					t.Errorf("encrypted entity is %s, want multipart/alternative", innerType)
+				}
+			}
+		})
+	}
+}
+
+func TestEncryptionGroupsSeparateBcc(t *testing.T) {
+	tests := []struct {
+		name       string
+		m          *JSONMail
+		recipients []string
+		want       [][]string
+	}{
+		{
+			name:       "to, cc and two bcc",
+			m:          &JSONMail{To: []string{"bob@example.net"}, CC: []string{"carol@example.org"}, BCC: []string{"dave@example.com", "erin@example.com"}},
+			recipients: []string{"bob@example.net", "carol@example.org", "dave@example.com", "erin@example.com"},
+			want:       [][]string{{"bob@example.net", "carol@example.org"}, {"dave@example.com"}, {"erin@example.com"}},
+		},
+		{
+			name:       "only bcc",
+			m:          &JSONMail{BCC: []string{"dave@example.com", "erin@example.com"}},
+			recipients: []string{"dave@example.com", "erin@example.com"},
+			want:       [][]string{{"dave@example.com"}, {"erin@example.com"}},
+		},
+		{
+			name:       "bcc that is also in to is not hidden",
+			m:          &JSONMail{To: []string{"Bob@Example.net"}, BCC: []string{"bob@example.net"}},
+			recipients: []string{"bob@example.net"},
+			want:       [][]string{{"bob@example.net"}},
+		},
+		{
+			name:       "keyed subset",
+			m:          &JSONMail{To: []string{"bob@example.net"}, BCC: []string{"dave@example.com"}},
+			recipients: []string{"dave@example.com"},
+			want:       [][]string{{"dave@example.com"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := encryptionGroups(tt.m, tt.recipients); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"sendsmtp/delivery"
+)
+
+// Outbound queue for messages with a future send_at. Every entry is a JSON
+// file that moves between subdirectories of the queue directory
+// (SENDSMTP_QUEUE_DIR, default ./queue):
+//
+//	scheduled/   waiting for send_at, may still be cancelled or edited
+//	editing/     claimed by -edit while the replacement is written
+//	processing/  claimed by the worker, no longer cancellable
+//	done/        delivered to every recipient, with the result attached
+//	failed/      not delivered to every recipient, with the result attached
+//	cancelled/   cancelled by -cancel
+//
+// A state change is a rename, which is atomic within a file system, so the
+// worker picking up an entry and a concurrent cancel or edit cannot both win.
+// Because the files are the only state, scheduled messages survive restarts.
+// Run a single worker per queue directory.
+//
+// An entry holds the messages as prepared when they were scheduled, so
+// templates are rendered and input is validated only once. S/MIME
+// certificates and OpenPGP keys are looked up when the message is sent; a
+// message that cannot be signed or encrypted then ends up in failed/.
+const (
+	queueScheduled  = "scheduled"
+	queueEditing    = "editing"
+	queueProcessing = "processing"
+	queueDone       = "done"
+	queueFailed     = "failed"
+	queueCancelled  = "cancelled"
+	queueTmp        = "tmp"
+)
+
+// errNotScheduled is returned when an entry is unknown or was already picked up
+var errNotScheduled = errors.New("message is not scheduled (unknown id, already sent or cancelled)")
+
+var queueIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// queueEntry is the on-disk form of a scheduled message
+type queueEntry struct {
+	ID         string          `json:"id"`
+	SendAt     time.Time       `json:"send_at"`
+	CreatedAt  time.Time       `json:"created_at"`
+	UpdatedAt  time.Time       `json:"updated_at"`
+	Mail       *JSONMail       `json:"mail"`     // the request as submitted
+	Messages   []*JSONMail     `json:"messages"` // what prepareMail made of it
+	FinishedAt *time.Time      `json:"finished_at,omitempty"`
+	Result     json.RawMessage `json:"result,omitempty"`
+}
+
+// queue is a spool directory of scheduled messages
+type queue struct {
+	dir string
+}
+
+func newQueue(dir string) *queue {
+	return &queue{dir: dir}
+}
+
+// queueDir returns the directory the outbound queue is kept in
+func queueDir() string {
+	return getEnvOrDefault("SENDSMTP_QUEUE_DIR", "queue")
+}
+
+func (q *queue) path(state, id string) string {
+	return filepath.Join(q.dir, state, id+".json")
+}
+
+// init creates the state directories
+func (q *queue) init() error {
+	for _, state := range []string{queueScheduled, queueEditing, queueProcessing, queueDone, queueFailed, queueCancelled, queueTmp} {
+		if err := os.MkdirAll(filepath.Join(q.dir, state), 0o750); err != nil {
+			return fmt.Errorf("error creating queue directory: %v", err)
+		}
+	}
+	return nil
+}
+
+// schedule stores the request m and its prepared messages to be sent at sendAt
+func (q *queue) schedule(m *JSONMail, messages []*JSONMail, sendAt time.Time) (*queueEntry, error) {
+	if err := q.init(); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	entry := &queueEntry{
+		ID:        hex.EncodeToString(buf),
+		SendAt:    sendAt.UTC(),
+		CreatedAt: now,
+		UpdatedAt: now,
+		Mail:      m,
+		Messages:  messages,
+	}
+	if err := q.write(queueScheduled, entry); err != nil {
+		return nil, err
+	}
+	log.Printf("Scheduled message %s for %s\n", entry.ID, entry.SendAt.Format(time.RFC3339))
+	return entry, nil
+}
+
+// cancel withdraws a scheduled message. It fails with errNotScheduled once
+// the worker has picked the message up
+func (q *queue) cancel(id string) error {
+	if !queueIDPattern.MatchString(id) {
+		return errNotScheduled
+	}
+	if err := q.init(); err != nil {
+		return err
+	}
+	if err := os.Rename(q.path(queueScheduled, id), q.path(queueCancelled, id)); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return errNotScheduled
+		}
+		return fmt.Errorf("error cancelling message %s: %v", id, err)
+	}
+	log.Printf("Cancelled scheduled message %s\n", id)
+	return nil
+}
+
+// edit replaces the request and prepared messages (and send time, if m has
+// one) of a scheduled entry
+func (q *queue) edit(id string, m *JSONMail, messages []*JSONMail) (*queueEntry, error) {
+	if !queueIDPattern.MatchString(id) {
+		return nil, errNotScheduled
+	}
+	if err := q.init(); err != nil {
+		return nil, err
+	}
+
+	// Claim the entry first so the worker cannot pick it up half written
+	editing := q.path(queueEditing, id)
+	if err := os.Rename(q.path(queueScheduled, id), editing); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, errNotScheduled
+		}
+		return nil, fmt.Errorf("error claiming message %s: %v", id, err)
+	}
+
+	entry, err := q.read(editing)
+	if err != nil {
+		// Put the original back untouched
+		os.Rename(editing, q.path(queueScheduled, id))
+		return nil, err
+	}
+	entry.Mail = m
+	entry.Messages = messages
+	entry.UpdatedAt = time.Now().UTC()
+	if m.SendAt != nil {
+		entry.SendAt = m.SendAt.UTC()
+	}
+
+	if err := q.write(queueScheduled, entry); err != nil {
+		os.Rename(editing, q.path(queueScheduled, id))
+		return nil, err
+	}
+	os.Remove(editing)
+	log.Printf("Updated scheduled message %s, sending at %s\n", id, entry.SendAt.Format(time.RFC3339))
+	return entry, nil
+}
+
+// list returns the scheduled entries ordered by send time. An entry that
+// cannot be decoded is moved to failed, so it cannot hold up the others
+func (q *queue) list() ([]*queueEntry, error) {
+	if err := q.init(); err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(q.dir, queueScheduled, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*queueEntry, 0, len(files))
+	for _, file := range files {
+		entry, err := q.read(file)
+		if err != nil {
+			// Picked up or cancelled since the directory was listed
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			log.Printf("ERROR: %v, moving it to %s\n", err, queueFailed)
+			if err := os.Rename(file, filepath.Join(q.dir, queueFailed, filepath.Base(file))); err != nil {
+				log.Printf("Error moving queue entry %s: %v\n", file, err)
+			}
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].SendAt.Before(entries[j].SendAt) })
+	return entries, nil
+}
+
+// claim moves a due entry to processing. false means another process
+// (cancel, edit or a second worker) got there first
+func (q *queue) claim(id string) bool {
+	return os.Rename(q.path(queueScheduled, id), q.path(queueProcessing, id)) == nil
+}
+
+// complete records the result of a processed entry in done, or in failed
+// unless ok
+func (q *queue) complete(entry *queueEntry, result interface{}, ok bool) error {
+	raw, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	entry.FinishedAt = &now
+	entry.Result = raw
+	state := queueDone
+	if !ok {
+		state = queueFailed
+		log.Printf("ERROR: scheduled message %s was not delivered to every recipient: %s\n", entry.ID, raw)
+	}
+	if err := q.write(state, entry); err != nil {
+		return err
+	}
+	return os.Remove(q.path(queueProcessing, entry.ID))
+}
+
+// recover returns entries left in processing or editing by a crashed process
+// to scheduled. A message that was mid-delivery may be sent twice, which is
+// preferred over silently losing it
+func (q *queue) recover() error {
+	for _, state := range []string{queueProcessing, queueEditing} {
+		files, err := filepath.Glob(filepath.Join(q.dir, state, "*.json"))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			id := strings.TrimSuffix(filepath.Base(file), ".json")
+			target := q.path(queueScheduled, id)
+			if _, err := os.Stat(target); err == nil {
+				// An edit finished writing the replacement, the claimed copy is stale
+				os.Remove(file)
+				continue
+			}
+			log.Printf("Recovering message %s left in %s\n", id, state)
+			if err := os.Rename(file, target); err != nil {
+				return fmt.Errorf("error recovering message %s: %v", id, err)
+			}
+		}
+	}
+	return nil
+}
+
+// sendFunc delivers a claimed entry and returns the result to record; ok
+// reports whether every recipient was delivered
+type sendFunc func(ctx context.Context, entry *queueEntry) (result interface{}, ok bool)
+
+// run is the worker loop: every poll interval it claims due entries and
+// delivers them with send, until ctx is cancelled
+func (q *queue) run(ctx context.Context, poll time.Duration, send sendFunc) error {
+	if err := q.init(); err != nil {
+		return err
+	}
+	if err := q.recover(); err != nil {
+		return err
+	}
+	log.Printf("Queue worker started on %s, polling every %s\n", q.dir, poll)
+
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+	for {
+		q.processDue(ctx, time.Now(), send)
+
+		select {
+		case <-ctx.Done():
+			log.Println("Queue worker stopped")
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// processDue claims and sends every entry due at now and returns how many it sent
+func (q *queue) processDue(ctx context.Context, now time.Time, send sendFunc) int {
+	entries, err := q.list()
+	if err != nil {
+		log.Printf("Error listing queue: %v\n", err)
+	}
+	sent := 0
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			break
+		}
+		if entry.SendAt.After(now) {
+			// Sorted by send time, nothing further is due
+			break
+		}
+		if !q.claim(entry.ID) {
+			continue
+		}
+		log.Printf("Sending scheduled message %s (due %s)\n", entry.ID, entry.SendAt.Format(time.RFC3339))
+		// A message already being sent is finished when the worker is stopped
+		result, ok := send(context.WithoutCancel(ctx), entry)
+		if err := q.complete(entry, result, ok); err != nil {
+			log.Printf("Error recording result of message %s: %v\n", entry.ID, err)
+		}
+		sent++
+	}
+	return sent
+}
+
+// sendQueued delivers the prepared messages of an entry
+func sendQueued(ctx context.Context, entry *queueEntry, d *delivery.Deliverer, svc *services) (interface{}, bool) {
+	return deliverMessages(ctx, entry.Mail.Template != "", entry.Messages, d, svc)
+}
+
+func (q *queue) read(file string) (*queueEntry, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var entry queueEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, fmt.Errorf("error decoding queue entry %s: %v", file, err)
+	}
+	return &entry, nil
+}
+
+// write stores entry in state through a temporary file, so readers never see
+// a partially written entry
+func (q *queue) write(state string, entry *queueEntry) error {
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := q.path(queueTmp, entry.ID)
+	if err := os.WriteFile(tmp, data, 0o640); err != nil {
+		return fmt.Errorf("error writing queue entry %s: %v", entry.ID, err)
+	}
+	if err := os.Rename(tmp, q.path(state, entry.ID)); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("error storing queue entry %s: %v", entry.ID, err)
+	}
+	return nil
+}
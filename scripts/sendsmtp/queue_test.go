@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// scheduleMail queues a copy of validMail with the given subject
+func scheduleMail(t *testing.T, q *queue, subject string, sendAt time.Time) *queueEntry {
+	t.Helper()
+	m := validMail()
+	m.Subject = subject
+	messages, errs := prepareMail(m)
+	if errs != nil {
+		t.Fatalf("prepareMail() = %v", errs)
+	}
+	entry, err := q.schedule(m, messages, sendAt)
+	if err != nil {
+		t.Fatalf("schedule() = %v", err)
+	}
+	return entry
+}
+
+func TestQueueScheduleCancelEdit(t *testing.T) {
+	q := newQueue(t.TempDir())
+	now := time.Now()
+	later := scheduleMail(t, q, "later", now.Add(2*time.Hour))
+	sooner := scheduleMail(t, q, "sooner", now.Add(time.Hour))
+
+	entries, err := q.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].ID != sooner.ID || entries[1].ID != later.ID {
+		t.Fatalf("list() = %v, want sooner before later", entries)
+	}
+	if len(entries[0].Messages) != 1 || entries[0].Messages[0].Subject != "sooner" {
+		t.Errorf("prepared messages %v not kept", entries[0].Messages)
+	}
+
+	// Editing replaces the request and its prepared form, and the send time
+	m := validMail()
+	m.Subject = "edited"
+	sendAt := now.Add(3 * time.Hour)
+	m.SendAt = &sendAt
+	messages, _ := prepareMail(m)
+	if _, err := q.edit(sooner.ID, m, messages); err != nil {
+		t.Fatalf("edit() = %v", err)
+	}
+	entries, _ = q.list()
+	if len(entries) != 2 || entries[1].ID != sooner.ID {
+		t.Fatalf("list() = %v, want the edited entry last", entries)
+	}
+	if edited := entries[1]; edited.Mail.Subject != "edited" || edited.Messages[0].Subject != "edited" || !edited.SendAt.Equal(sendAt.UTC()) {
+		t.Errorf("edited entry %+v", edited)
+	}
+
+	if err := q.cancel(later.ID); err != nil {
+		t.Fatalf("cancel() = %v", err)
+	}
+	if _, err := os.Stat(q.path(queueCancelled, later.ID)); err != nil {
+		t.Errorf("cancelled entry not moved: %v", err)
+	}
+	for _, id := range []string{later.ID, "0123456789abcdef0123456789abcdef", "../scheduled/x"} {
+		if err := q.cancel(id); !errors.Is(err, errNotScheduled) {
+			t.Errorf("cancel(%q) = %v, want errNotScheduled", id, err)
+		}
+		if _, err := q.edit(id, m, messages); !errors.Is(err, errNotScheduled) {
+			t.Errorf("edit(%q) = %v, want errNotScheduled", id, err)
+		}
+	}
+
+	// Once claimed by the worker an entry can no longer be changed
+	if !q.claim(sooner.ID) {
+		t.Fatal("claim() = false")
+	}
+	if err := q.cancel(sooner.ID); !errors.Is(err, errNotScheduled) {
+		t.Errorf("cancel() of a claimed entry = %v, want errNotScheduled", err)
+	}
+	if err := q.recover(); err != nil {
+		t.Fatalf("recover() = %v", err)
+	}
+	if entries, _ := q.list(); len(entries) != 1 || entries[0].ID != sooner.ID {
+		t.Errorf("list() after recover() = %v, want the claimed entry back", entries)
+	}
+}
+
+func TestQueueProcessDue(t *testing.T) {
+	q := newQueue(t.TempDir())
+	now := time.Now()
+	delivered := scheduleMail(t, q, "delivered", now.Add(-time.Minute))
+	bounced := scheduleMail(t, q, "bounced", now.Add(-time.Second))
+	future := scheduleMail(t, q, "future", now.Add(time.Hour))
+	// A corrupt entry due first must not hold up the others
+	corrupt := q.path(queueScheduled, "0123456789abcdef0123456789abcdef")
+	if err := os.WriteFile(corrupt, []byte(`{"id": "0123`), 0o640); err != nil {
+		t.Fatal(err)
+	}
+
+	var sent []string
+	send := func(ctx context.Context, entry *queueEntry) (interface{}, bool) {
+		subject := entry.Messages[0].Subject
+		sent = append(sent, subject)
+		if subject == "bounced" {
+			return SendResult{Status: "failed"}, false
+		}
+		return SendResult{Status: "sent"}, true
+	}
+	if n := q.processDue(context.Background(), now, send); n != 2 {
+		t.Errorf("processDue() sent %d, want 2", n)
+	}
+	if len(sent) != 2 || sent[0] != "delivered" || sent[1] != "bounced" {
+		t.Errorf("sent %v, want the due entries in send time order", sent)
+	}
+	if _, err := os.Stat(q.path(queueFailed, "0123456789abcdef0123456789abcdef")); err != nil {
+		t.Errorf("corrupt entry not moved to failed: %v", err)
+	}
+	if _, err := os.Stat(corrupt); !errors.Is(err, os.ErrNotExist) {
+		t.Error("corrupt entry left in scheduled")
+	}
+
+	for _, tt := range []struct {
+		state, id, status string
+	}{
+		{queueDone, delivered.ID, "sent"},
+		{queueFailed, bounced.ID, "failed"},
+	} {
+		entry, err := q.read(q.path(tt.state, tt.id))
+		if err != nil {
+			t.Errorf("entry %s not in %s: %v", tt.id, tt.state, err)
+			continue
+		}
+		var result SendResult
+		if err := json.Unmarshal(entry.Result, &result); err != nil || result.Status != tt.status || entry.FinishedAt == nil {
+			t.Errorf("entry in %s has result %s, want status %s", tt.state, entry.Result, tt.status)
+		}
+		if _, err := os.Stat(q.path(queueProcessing, tt.id)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("entry %s left in processing", tt.id)
+		}
+	}
+
+	// Nothing else is due until the future entry's send time
+	if n := q.processDue(context.Background(), now, send); n != 0 {
+		t.Errorf("second processDue() sent %d, want 0", n)
+	}
+	if n := q.processDue(context.Background(), future.SendAt, send); n != 1 || sent[2] != "future" {
+		t.Errorf("processDue() at the send time sent %d (%v), want the future entry", n, sent)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sendsmtp/delivery"
+)
+
+// SendResult is printed as JSON on stdout once every domain has been attempted
+type SendResult struct {
+	Status    string                      `json:"status"` // sent, partial or failed
+	MessageID string                      `json:"message_id"`
+	Results   []*delivery.RecipientResult `json:"results"`
+}
+
+// newSendResult summarizes the per-recipient results
+func newSendResult(messageID string, results []*delivery.RecipientResult) *SendResult {
+	delivered := 0
+	for _, r := range results {
+		if r.Status == delivery.StatusDelivered {
+			delivered++
+		}
+	}
+	status := "partial"
+	switch delivered {
+	case len(results):
+		status = "sent"
+	case 0:
+		status = "failed"
+	}
+	return &SendResult{Status: status, MessageID: messageID, Results: results}
+}
+
+// BatchResult is printed instead of SendResult when several messages are sent at once
+type BatchResult struct {
+	Status   string        `json:"status"` // sent, partial or failed
+	Messages []*SendResult `json:"messages"`
+}
+
+// newBatchResult summarizes the per-message results
+func newBatchResult(results []*SendResult) *BatchResult {
+	sent, failed := 0, 0
+	for _, r := range results {
+		switch r.Status {
+		case "sent":
+			sent++
+		case "failed":
+			failed++
+		}
+	}
+	status := "partial"
+	switch {
+	case sent == len(results):
+		status = "sent"
+	case failed == len(results):
+		status = "failed"
+	}
+	return &BatchResult{Status: status, Messages: results}
+}
+
+// InvalidResult is printed when the input is rejected before sending
+type InvalidResult struct {
+	Status string           `json:"status"` // always invalid
+	Errors ValidationErrors `json:"errors"`
+}
+
+func newInvalidResult(errs ValidationErrors) *InvalidResult {
+	return &InvalidResult{Status: "invalid", Errors: errs}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/smallstep/pkcs7"
+)
+
+// S/MIME (RFC 8551) signing and encryption
+//
+//	"smime": {
+//	  "sign": true,       // multipart/signed with the sender's certificate
+//	  "encrypt": true     // application/pkcs7-mime enveloped to every recipient
+//	}
+//
+// Certificates and keys come from the certificate store (SENDSMTP_SMIME_DIR,
+// default ./smime), one pair of files per lowercased address:
+//
+//	alice@example.com.crt  PEM certificate, followed by its intermediates
+//	alice@example.com.key  PEM private key (PKCS#8, PKCS#1 or SEC 1), senders only
+//
+// A signed and encrypted message is signed first, then the signed entity is
+// encrypted. Encryption covers every envelope recipient including bcc, so each
+// of them needs a certificate in the store; RSA is required for encryption.
+// Each bcc recipient gets a copy enveloped to their certificate alone.
+type SMIMEOptions struct {
+	Sign    bool `json:"sign,omitempty"`
+	Encrypt bool `json:"encrypt,omitempty"`
+}
+
+func init() {
+	// The library default is DES-CBC, which current mail clients refuse
+	pkcs7.ContentEncryptionAlgorithm = pkcs7.EncryptionAlgorithmAES256CBC
+}
+
+// smimeDir returns the directory of the S/MIME certificate store
+func smimeDir() string {
+	return getEnvOrDefault("SENDSMTP_SMIME_DIR", "smime")
+}
+
+// enabled reports whether the message is signed or encrypted
+func (o *SMIMEOptions) enabled() bool {
+	return o != nil && (o.Sign || o.Encrypt)
+}
+
+// validate checks that every certificate and key the options need is in the
+// store, so a message is refused up front instead of failing per domain
+func (o *SMIMEOptions) validate(from string, recipients []string) ValidationErrors {
+	var errs ValidationErrors
+	if !o.enabled() {
+		return nil
+	}
+	dir := smimeDir()
+	if o.Sign {
+		if _, _, err := loadSigner(dir, from); err != nil {
+			errs.add(ErrSMIMEUnavailable, "smime.sign", "%v", err)
+		}
+	}
+	if o.Encrypt {
+		for _, recipient := range recipients {
+			if _, err := loadRecipientCertificate(dir, recipient); err != nil {
+				errs.add(ErrSMIMEUnavailable, "smime.encrypt", "%v", err)
+			}
+		}
+	}
+	return errs
+}
+
+// seal signs and/or encrypts a MIME entity (Content-* headers, blank line and
+// body) and returns the entity that replaces it in the message
+func (o *SMIMEOptions) seal(from string, recipients []string, entity []byte) ([]byte, error) {
+	dir := smimeDir()
+	var err error
+	if o.Sign {
+		if entity, err = signEntity(dir, from, entity); err != nil {
+			return nil, err
+		}
+		log.Printf("Signed message with the S/MIME certificate of %s\n", from)
+	}
+	if o.Encrypt {
+		if entity, err = encryptEntity(dir, recipients, entity); err != nil {
+			return nil, err
+		}
+		log.Printf("Encrypted message to %d S/MIME recipient certificate(s)\n", len(recipients))
+	}
+	return entity, nil
+}
+
+// prepareSMIME splits recipients into the variants to deliver: one message
+// unless it is encrypted, then one copy per encryption group
+func prepareSMIME(m *JSONMail, recipients []string) []*mailVariant {
+	if m.SMIME == nil || !m.SMIME.Encrypt || len(recipients) == 0 {
+		return []*mailVariant{{mail: m, recipients: recipients}}
+	}
+	var variants []*mailVariant
+	for _, group := range encryptionGroups(m, recipients) {
+		copied := *m
+		copied.smimeTo = group
+		variants = append(variants, &mailVariant{mail: &copied, recipients: group})
+	}
+	return variants
+}
+
+// signEntity wraps entity in multipart/signed with a detached
+// application/pkcs7-signature over its exact bytes
+func signEntity(dir, from string, entity []byte) ([]byte, error) {
+	chain, key, err := loadSigner(dir, from)
+	if err != nil {
+		return nil, err
+	}
+
+	sd, err := pkcs7.NewSignedData(entity)
+	if err != nil {
+		return nil, fmt.Errorf("error preparing S/MIME signature: %v", err)
+	}
+	sd.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+	if err := sd.AddSignerChain(chain[0], key, chain[1:], pkcs7.SignerInfoConfig{}); err != nil {
+		return nil, fmt.Errorf("error signing with the certificate of %s: %v", from, err)
+	}
+	sd.Detach()
+	signature, err := sd.Finish()
+	if err != nil {
+		return nil, fmt.Errorf("error encoding S/MIME signature: %v", err)
+	}
+
+	// The boundary is random, and neither part can contain it: the entity is
+	// 7bit text with its own boundaries and the signature is base64
+	boundary := multipart.NewWriter(nil).Boundary()
+	var b bytes.Buffer
+	writeHeader(&b, "Content-Type", mime.FormatMediaType("multipart/signed", map[string]string{
+		"protocol": "application/pkcs7-signature",
+		"micalg":   "sha-256",
+		"boundary": boundary,
+	}))
+	b.WriteString("\r\n")
+	b.WriteString("This is a cryptographically signed message in MIME format.\r\n\r\n")
+	b.WriteString("--" + boundary + "\r\n")
+	// The CRLF before a boundary belongs to the delimiter (RFC 2046), so the
+	// signed bytes keep the entity's own final line break
+	b.Write(entity)
+	b.WriteString("\r\n--" + boundary + "\r\n")
+	writeHeader(&b, "Content-Type", "application/pkcs7-signature; name=smime.p7s")
+	writeHeader(&b, "Content-Transfer-Encoding", EncodingBase64)
+	writeHeader(&b, "Content-Disposition", "attachment; filename=smime.p7s")
+	b.WriteString("\r\n")
+	b.Write(encodeBase64Lines(signature))
+	b.WriteString("--" + boundary + "--\r\n")
+	return b.Bytes(), nil
+}
+
+// encryptEntity envelopes entity for every recipient as application/pkcs7-mime
+func encryptEntity(dir string, recipients []string, entity []byte) ([]byte, error) {
+	certs := make([]*x509.Certificate, 0, len(recipients))
+	for _, recipient := range recipients {
+		cert, err := loadRecipientCertificate(dir, recipient)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+
+	enveloped, err := pkcs7.Encrypt(entity, certs)
+	if err != nil {
+		return nil, fmt.Errorf("error encrypting message: %v", err)
+	}
+
+	var b bytes.Buffer
+	writeHeader(&b, "Content-Type", "application/pkcs7-mime; smime-type=enveloped-data; name=smime.p7m")
+	writeHeader(&b, "Content-Transfer-Encoding", EncodingBase64)
+	writeHeader(&b, "Content-Disposition", "attachment; filename=smime.p7m")
+	b.WriteString("\r\n")
+	b.Write(encodeBase64Lines(enveloped))
+	return b.Bytes(), nil
+}
+
+// loadSigner returns the sender's certificate chain and the matching private key
+func loadSigner(dir, address string) ([]*x509.Certificate, crypto.Signer, error) {
+	chain, err := loadCertificates(dir, address)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyFile, err := smimeFile(dir, address, ".key")
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := loadPrivateKey(keyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("no usable S/MIME key for %s: %v", address, err)
+	}
+	pub, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(chain[0].PublicKey) {
+		return nil, nil, fmt.Errorf("S/MIME key for %s does not match its certificate", address)
+	}
+	return chain, key, nil
+}
+
+// loadRecipientCertificate returns the certificate messages to address are encrypted to
+func loadRecipientCertificate(dir, address string) (*x509.Certificate, error) {
+	chain, err := loadCertificates(dir, address)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := chain[0].PublicKey.(*rsa.PublicKey); !ok {
+		return nil, fmt.Errorf("S/MIME certificate for %s is not an RSA certificate, which encryption requires", address)
+	}
+	return chain[0], nil
+}
+
+// loadCertificates reads the PEM certificates stored for address. The first
+// one must be valid now and, if it names email addresses, be issued to address
+func loadCertificates(dir, address string) ([]*x509.Certificate, error) {
+	file, err := smimeFile(dir, address, ".crt")
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("no S/MIME certificate for %s in %s", address, dir)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading S/MIME certificate for %s: %v", address, err)
+	}
+
+	var chain []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid S/MIME certificate for %s: %v", address, err)
+		}
+		chain = append(chain, cert)
+	}
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("no PEM certificate in %s", file)
+	}
+
+	leaf := chain[0]
+	now := time.Now()
+	if now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+		return nil, fmt.Errorf("S/MIME certificate for %s is only valid from %s to %s",
+			address, leaf.NotBefore.Format(time.RFC3339), leaf.NotAfter.Format(time.RFC3339))
+	}
+	if len(leaf.EmailAddresses) > 0 && !containsFold(leaf.EmailAddresses, address) {
+		return nil, fmt.Errorf("S/MIME certificate for %s is issued to %s", address, strings.Join(leaf.EmailAddresses, ", "))
+	}
+	return chain, nil
+}
+
+// loadPrivateKey reads the first PEM private key in file
+func loadPrivateKey(file string) (crypto.Signer, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no PEM private key in %s", file)
+		}
+		var key interface{}
+		switch block.Type {
+		case "PRIVATE KEY":
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			key, err = x509.ParseECPrivateKey(block.Bytes)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key type %T", key)
+		}
+		return signer, nil
+	}
+}
+
+// smimeFile returns the store path for address, refusing addresses that
+// would name a file outside the store
+func smimeFile(dir, address, suffix string) (string, error) {
+	name := normalizeAddress(address)
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("address %q cannot be looked up in the S/MIME store", address)
+	}
+	return filepath.Join(dir, name+suffix), nil
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"mime"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/smallstep/pkcs7"
+)
+
+// testCA issues S/MIME certificates into a temporary certificate store
+type testCA struct {
+	t    *testing.T
+	dir  string
+	cert *x509.Certificate
+	key  crypto.Signer
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "sendsmtp test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	dir := t.TempDir()
+	t.Setenv("SENDSMTP_SMIME_DIR", dir)
+	return &testCA{t: t, dir: dir, cert: cert, key: key, pool: pool}
+}
+
+// issue stores a certificate for address and, if withKey is set, its private key
+func (ca *testCA) issue(address string, key crypto.Signer, withKey bool) *x509.Certificate {
+	ca.t.Helper()
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber:   serial,
+		Subject:        pkix.Name{CommonName: address},
+		EmailAddresses: []string{address},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(24 * time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(filepath.Join(ca.dir, address+".crt"), certPEM, 0o600); err != nil {
+		ca.t.Fatal(err)
+	}
+	if withKey {
+		keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			ca.t.Fatal(err)
+		}
+		keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+		if err := os.WriteFile(filepath.Join(ca.dir, address+".key"), keyPEM, 0o600); err != nil {
+			ca.t.Fatal(err)
+		}
+	}
+	return cert
+}
+
+// readEntity splits a message or entity into its Content-Type and decoded body
+func readEntity(t *testing.T, data []byte) (string, map[string]string, []byte) {
+	t.Helper()
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("unparsable entity: %v", err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatalf("bad Content-Type %q: %v", msg.Header.Get("Content-Type"), err)
+	}
+	body, _ := io.ReadAll(msg.Body)
+	if strings.EqualFold(msg.Header.Get("Content-Transfer-Encoding"), EncodingBase64) {
+		if body, err = base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(body)), "")); err != nil {
+			t.Fatalf("bad base64 body: %v", err)
+		}
+	}
+	return mediaType, params, body
+}
+
+// splitSigned returns the exact signed bytes and the decoded signature of a
+// multipart/signed body whose signature part has the media type protocol
+func splitSigned(t *testing.T, body []byte, boundary, protocol string) ([]byte, []byte) {
+	t.Helper()
+	delimiter := []byte("--" + boundary + "\r\n")
+	start := bytes.Index(body, delimiter)
+	if start < 0 {
+		t.Fatal("multipart/signed body has no first part")
+	}
+	rest := body[start+len(delimiter):]
+	end := bytes.Index(rest, []byte("\r\n--"+boundary+"\r\n"))
+	if end < 0 {
+		t.Fatal("multipart/signed body has no second part")
+	}
+	signed := rest[:end]
+	sigPart := rest[end+len("\r\n--"+boundary+"\r\n"):]
+	sigPart = sigPart[:bytes.Index(sigPart, []byte("--"+boundary+"--"))]
+
+	mediaType, _, signature := readEntity(t, sigPart)
+	if mediaType != protocol {
+		t.Fatalf("second part is %s, want %s", mediaType, protocol)
+	}
+	return signed, signature
+}
+
+func TestSMIMESignedMessageVerifies(t *testing.T) {
+	ca := newTestCA(t)
+	senderKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca.issue("alice@example.com", senderKey, true)
+
+	m := &JSONMail{
+		From:    "alice@example.com",
+		To:      []string{"bob@example.net"},
+		Subject: "Signed",
+		Body:    "Grüße from a signed message\n",
+		SMIME:   &SMIMEOptions{Sign: true},
+	}
+	if errs := validateJSONMail(m); errs != nil {
+		t.Fatalf("unexpected validation errors: %v", errs)
+	}
+	message, uses8bit, err := buildMessage(m, "<1@example.com>", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uses8bit {
+		t.Error("signed message must not use 8bit")
+	}
+
+	mediaType, params, body := readEntity(t, message)
+	if mediaType != "multipart/signed" || params["protocol"] != "application/pkcs7-signature" || params["micalg"] != "sha-256" {
+		t.Fatalf("got %s %v, want multipart/signed with pkcs7-signature and sha-256", mediaType, params)
+	}
+	signed, signature := splitSigned(t, body, params["boundary"], "application/pkcs7-signature")
+
+	p7, err := pkcs7.Parse(signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p7.Content = signed
+	if err := p7.VerifyWithChain(ca.pool); err != nil {
+		t.Fatalf("signature does not verify: %v", err)
+	}
+	if signer := p7.GetOnlySigner(); signer == nil || signer.EmailAddresses[0] != "alice@example.com" {
+		t.Errorf("unexpected signer %v", signer)
+	}
+
+	// Any change to the signed part must break the signature
+	p7.Content = bytes.Replace(signed, []byte("signed"), []byte("forged"), 1)
+	if err := p7.VerifyWithChain(ca.pool); err == nil {
+		t.Error("tampered content verified")
+	}
+}
+
+func TestSMIMEEncryptedMessageDecrypts(t *testing.T) {
+	ca := newTestCA(t)
+	senderKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca.issue("alice@example.com", senderKey, true)
+	bobKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobCert := ca.issue("bob@example.net", bobKey, false)
+
+	m := &JSONMail{
+		From:    "alice@example.com",
+		To:      []string{"bob@example.net"},
+		Subject: "Secret",
+		Body:    "plain text",
+		HTML:    "<p>html</p>",
+		SMIME:   &SMIMEOptions{Sign: true, Encrypt: true},
+	}
+	if errs := validateJSONMail(m); errs != nil {
+		t.Fatalf("unexpected validation errors: %v", errs)
+	}
+	message, _, err := buildMessage(m, "<2@example.com>", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(message, []byte("plain text")) {
+		t.Fatal("body is visible in the encrypted message")
+	}
+
+	mediaType, params, enveloped := readEntity(t, message)
+	if mediaType != "application/pkcs7-mime" || params["smime-type"] != "enveloped-data" {
+		t.Fatalf("got %s %v, want enveloped application/pkcs7-mime", mediaType, params)
+	}
+	p7, err := pkcs7.Parse(enveloped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner, err := p7.Decrypt(bobCert, bobKey)
+	if err != nil {
+		t.Fatalf("recipient cannot decrypt: %v", err)
+	}
+
+	// Signed first, then encrypted
+	mediaType, params, body := readEntity(t, inner)
+	if mediaType != "multipart/signed" {
+		t.Fatalf("decrypted entity is %s, want multipart/signed", mediaType)
+	}
+	signed, signature := splitSigned(t, body, params["boundary"], "application/pkcs7-signature")
+	sig, err := pkcs7.Parse(signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig.Content = signed
+	if err := sig.VerifyWithChain(ca.pool); err != nil {
+		t.Fatalf("inner signature does not verify: %v", err)
+	}
+	if innerType, _, _ := readEntity(t, signed); innerType != "multipart/alternative" {
+		t.Errorf("signed entity is %s, want multipart/alternative", innerType)
+	}
+}
+
+func TestSMIMEEncryptsBccSeparately(t *testing.T) {
+	ca := newTestCA(t)
+	keys := map[string]*rsa.PrivateKey{}
+	certs := map[string]*x509.Certificate{}
+	for _, address := range []string{"bob@example.net", "carol@example.org", "dave@example.com", "erin@example.com"} {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[address] = key
+		certs[address] = ca.issue(address, key, false)
+	}
+
+	m := &JSONMail{
+		From:    "alice@example.com",
+		To:      []string{"bob@example.net"},
+		CC:      []string{"carol@example.org"},
+		BCC:     []string{"dave@example.com", "erin@example.com"},
+		Subject: "Secret",
+		Body:    "plain text",
+		SMIME:   &SMIMEOptions{Encrypt: true},
+	}
+	variants := prepareSMIME(m, m.recipients())
+	want := [][]string{{"bob@example.net", "carol@example.org"}, {"dave@example.com"}, {"erin@example.com"}}
+	if len(variants) != len(want) {
+		t.Fatalf("got %d variants, want %d", len(variants), len(want))
+	}
+	for i, variant := range variants {
+		if !reflect.DeepEqual(variant.recipients, want[i]) {
+			t.Fatalf("variant %d is for %v, want %v", i, variant.recipients, want[i])
+		}
+		message, _, err := buildMessage(variant.mail, "<3@example.com>", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, enveloped := readEntity(t, message)
+
+		// Only the recipients of a copy can open it, so no copy names a
+		// bcc recipient other than its own
+		for address, cert := range certs {
+			p7, err := pkcs7.Parse(enveloped)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = p7.Decrypt(cert, keys[address])
+			if contains(variant.recipients, address) && err != nil {
+				t.Errorf("%s cannot decrypt the copy for %v: %v", address, variant.recipients, err)
+			}
+			if !contains(variant.recipients, address) && err == nil {
+				t.Errorf("%s can decrypt the copy for %v", address, variant.recipients)
+			}
+		}
+	}
+}
+
+func TestSMIMEValidateReportsMissingCertificates(t *testing.T) {
+	ca := newTestCA(t)
+	senderKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca.issue("alice@example.com", senderKey, false)
+	ca.issue("carol@example.org", senderKey, false)
+
+	m := &JSONMail{
+		From:  "alice@example.com",
+		To:    []string{"bob@example.net", "carol@example.org"},
+		SMIME: &SMIMEOptions{Sign: true, Encrypt: true},
+	}
+	errs := validateJSONMail(m)
+
+	want := map[string]string{
+		"smime.sign":    "no usable S/MIME key for alice@example.com",
+		"smime.encrypt": "no S/MIME certificate for bob@example.net",
+	}
+	found := map[string]bool{}
+	for _, e := range errs {
+		if e.Code != ErrSMIMEUnavailable {
+			t.Errorf("unexpected error %v", e)
+			continue
+		}
+		if strings.Contains(e.Message, "carol@example.org") && !strings.Contains(e.Message, "RSA") {
+			t.Errorf("unexpected error for carol: %v", e)
+		}
+		if prefix, ok := want[e.Field]; ok && strings.HasPrefix(e.Message, prefix) {
+			found[e.Field] = true
+		}
+	}
+	for field := range want {
+		if !found[field] {
+			t.Errorf("missing %s error in %v", field, errs)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"sendsmtp/delivery"
+)
+
+// Reasons an address is on the suppression list
+const (
+	SuppressHardBounce  = "hard_bounce" // permanent 5xx at RCPT TO or in a bounce report
+	SuppressComplaint   = "complaint"   // recipient reported the mail as abuse (ARF)
+	SuppressManual      = "manual"      // added by an administrator
+	SuppressUnsubscribe = "unsubscribe" // recipient used a List-Unsubscribe link
+)
+
+// suppression is one row of the suppressions table
+type suppression struct {
+	Address   string    `json:"address"`
+	Reason    string    `json:"reason"`
+	Source    string    `json:"source"`
+	Detail    string    `json:"detail,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// suppressionList is the set of recipients sendsmtp will not deliver to.
+// postsmtp adds to the same table from incoming bounce and complaint reports.
+// A nil *suppressionList suppresses nothing
+type suppressionList struct {
+	conn *sql.DB
+}
+
+// newSuppressionList checks for the suppressions and mail_preferences tables
+func newSuppressionList(conn *sql.DB) (*suppressionList, error) {
+	if conn == nil {
+		return nil, nil
+	}
+	if err := checkTables(conn, "suppressions", "mail_preferences"); err != nil {
+		return nil, err
+	}
+	return &suppressionList{conn: conn}, nil
+}
+
+// lookup returns the suppression entries for those of addresses that are
+// suppressed, or that unsubscribed from list when list is not empty.
+// Lookup failures are logged and treated as "not suppressed" so that an
+// unavailable database does not stop mail
+func (s *suppressionList) lookup(addresses []string, list string) map[string]*suppression {
+	found := make(map[string]*suppression)
+	if s == nil || len(addresses) == 0 {
+		return found
+	}
+
+	byNormalized := make(map[string][]string, len(addresses))
+	normalized := make([]string, 0, len(addresses))
+	for _, addr := range addresses {
+		n := normalizeAddress(addr)
+		if _, seen := byNormalized[n]; !seen {
+			normalized = append(normalized, n)
+		}
+		byNormalized[n] = append(byNormalized[n], addr)
+	}
+
+	rows, err := s.conn.Query(
+		"SELECT address, reason, source, detail, created_at, updated_at FROM suppressions WHERE address = ANY($1)",
+		pq.Array(normalized),
+	)
+	if err != nil {
+		log.Printf("WARNING: suppression lookup failed, sending to every recipient: %v\n", err)
+		return found
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry suppression
+		var detail sql.NullString
+		if err := rows.Scan(&entry.Address, &entry.Reason, &entry.Source, &detail, &entry.CreatedAt, &entry.UpdatedAt); err != nil {
+			log.Printf("WARNING: suppression lookup failed: %v\n", err)
+			return found
+		}
+		entry.Detail = detail.String
+		for _, addr := range byNormalized[entry.Address] {
+			found[addr] = &entry
+		}
+	}
+	if list == "" {
+		return found
+	}
+
+	rows, err = s.conn.Query(
+		"SELECT address, unsubscribed_at FROM mail_preferences WHERE list = $1 AND address = ANY($2)",
+		list, pq.Array(normalized),
+	)
+	if err != nil {
+		log.Printf("WARNING: unsubscribe lookup failed, sending to every recipient: %v\n", err)
+		return found
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		entry := suppression{Reason: SuppressUnsubscribe, Source: "unsubscribe", Detail: "list " + list}
+		if err := rows.Scan(&entry.Address, &entry.CreatedAt); err != nil {
+			log.Printf("WARNING: unsubscribe lookup failed: %v\n", err)
+			return found
+		}
+		entry.UpdatedAt = entry.CreatedAt
+		for _, addr := range byNormalized[entry.Address] {
+			if _, ok := found[addr]; !ok {
+				found[addr] = &entry
+			}
+		}
+	}
+	return found
+}
+
+// add suppresses address, replacing the reason of an existing entry
+func (s *suppressionList) add(address, reason, source, detail string) error {
+	if s == nil {
+		return fmt.Errorf("suppression list requires a database (set DB_HOST)")
+	}
+	_, err := s.conn.Exec(`
+		INSERT INTO suppressions (address, reason, source, detail)
+		VALUES ($1, $2, $3, NULLIF($4, ''))
+		ON CONFLICT (address) DO UPDATE
+		SET reason = EXCLUDED.reason, source = EXCLUDED.source, detail = EXCLUDED.detail, updated_at = CURRENT_TIMESTAMP`,
+		normalizeAddress(address), reason, source, detail,
+	)
+	if err != nil {
+		return fmt.Errorf("error adding %s to suppression list: %v", address, err)
+	}
+	log.Printf("Suppressed %s (%s): %s\n", address, reason, detail)
+	return nil
+}
+
+// remove takes address off the list and reports whether it was listed
+func (s *suppressionList) remove(address string) (bool, error) {
+	if s == nil {
+		return false, fmt.Errorf("suppression list requires a database (set DB_HOST)")
+	}
+	res, err := s.conn.Exec("DELETE FROM suppressions WHERE address = $1", normalizeAddress(address))
+	if err != nil {
+		return false, fmt.Errorf("error removing %s from suppression list: %v", address, err)
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// unsubscribe records a List-Unsubscribe request: the address is suppressed
+// entirely when list is empty, otherwise only mail for list skips it
+func (s *suppressionList) unsubscribe(address, list string) error {
+	if s == nil {
+		return fmt.Errorf("suppression list requires a database (set DB_HOST)")
+	}
+	if list == "" {
+		return s.add(address, SuppressUnsubscribe, "unsubscribe", "one-click unsubscribe")
+	}
+	_, err := s.conn.Exec(`
+		INSERT INTO mail_preferences (address, list)
+		VALUES ($1, $2)
+		ON CONFLICT (address, list) DO NOTHING`,
+		normalizeAddress(address), list,
+	)
+	if err != nil {
+		return fmt.Errorf("error unsubscribing %s from %s: %v", address, list, err)
+	}
+	log.Printf("Unsubscribed %s from %s\n", address, list)
+	return nil
+}
+
+// list returns every suppressed address, newest first
+func (s *suppressionList) list() ([]*suppression, error) {
+	if s == nil {
+		return nil, fmt.Errorf("suppression list requires a database (set DB_HOST)")
+	}
+	rows, err := s.conn.Query("SELECT address, reason, source, detail, created_at, updated_at FROM suppressions ORDER BY updated_at DESC")
+	if err != nil {
+		return nil, fmt.Errorf("error listing suppressions: %v", err)
+	}
+	defer rows.Close()
+
+	entries := []*suppression{}
+	for rows.Next() {
+		var entry suppression
+		var detail sql.NullString
+		if err := rows.Scan(&entry.Address, &entry.Reason, &entry.Source, &detail, &entry.CreatedAt, &entry.UpdatedAt); err != nil {
+			return nil, err
+		}
+		entry.Detail = detail.String
+		entries = append(entries, &entry)
+	}
+	return entries, rows.Err()
+}
+
+// suppressBounces adds recipients that failed permanently because of the
+// address itself. Failures of the message as a whole (size, content policy)
+// or detected locally say nothing about the mailbox and are not suppressed
+func (s *suppressionList) suppressBounces(results []*delivery.RecipientResult) {
+	if s == nil {
+		return
+	}
+	for _, r := range results {
+		if !addressBounced(r) {
+			continue
+		}
+		detail := fmt.Sprintf("%d %s %s", r.Code, r.Enhanced, r.Message)
+		if r.MX != "" {
+			detail += " (" + r.MX + ")"
+		}
+		if err := s.add(r.Recipient, SuppressHardBounce, "sendsmtp", strings.Join(strings.Fields(detail), " ")); err != nil {
+			log.Printf("WARNING: %v\n", err)
+		}
+	}
+}
+
+// addressBounced reports whether r says the mailbox itself is bad: an
+// enhanced code of 5.1.x (RFC 3463 addressing status), or without an enhanced
+// code a 550, 551 or 553 reply to RCPT TO. Other 5xx at RCPT TO, such as
+// 5.7.1 policy or 5.2.2 mailbox full, are about the message or the sender
+func addressBounced(r *delivery.RecipientResult) bool {
+	if r.Status != delivery.StatusBounced || r.Reason != "" {
+		return false
+	}
+	if r.Enhanced != "" {
+		return strings.HasPrefix(r.Enhanced, "5.1.")
+	}
+	return r.RcptRejected && (r.Code == 550 || r.Code == 551 || r.Code == 553)
+}
+
+// suppressedResult is reported for a recipient that was not attempted
+func suppressedResult(recipient string, entry *suppression) *delivery.RecipientResult {
+	return &delivery.RecipientResult{
+		Recipient: recipient,
+		Status:    delivery.StatusSuppressed,
+		Reason:    entry.Reason,
+		Message: fmt.Sprintf("recipient is on the suppression list (%s since %s)",
+			entry.Reason, entry.CreatedAt.Format(time.RFC3339)),
+	}
+}
+
+// normalizeAddress is the form addresses are stored in: the domain is case
+// insensitive, and in practice so is the local part of every major provider
+func normalizeAddress(addr string) string {
+	return strings.ToLower(strings.TrimSpace(addr))
+}
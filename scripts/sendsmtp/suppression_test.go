@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	"sendsmtp/delivery"
+)
+
+func TestAddressBounced(t *testing.T) {
+	tests := []struct {
+		name   string
+		result delivery.RecipientResult
+		want   bool
+	}{
+		{"unknown user", delivery.RecipientResult{Status: delivery.StatusBounced, Code: 550, Enhanced: "5.1.1", RcptRejected: true}, true},
+		{"bad domain", delivery.RecipientResult{Status: delivery.StatusBounced, Code: 550, Enhanced: "5.1.2", RcptRejected: true}, true},
+		{"5.1.x after DATA", delivery.RecipientResult{Status: delivery.StatusBounced, Code: 550, Enhanced: "5.1.1"}, true},
+		{"plain 550 at RCPT", delivery.RecipientResult{Status: delivery.StatusBounced, Code: 550, RcptRejected: true}, true},
+		{"plain 551 at RCPT", delivery.RecipientResult{Status: delivery.StatusBounced, Code: 551, RcptRejected: true}, true},
+		{"plain 553 at RCPT", delivery.RecipientResult{Status: delivery.StatusBounced, Code: 553, RcptRejected: true}, true},
+
+		{"policy at RCPT", delivery.RecipientResult{Status: delivery.StatusBounced, Code: 550, Enhanced: "5.7.1", RcptRejected: true}, false},
+		{"mailbox full at RCPT", delivery.RecipientResult{Status: delivery.StatusBounced, Code: 552, Enhanced: "5.2.2", RcptRejected: true}, false},
+		{"relay denied at RCPT", delivery.RecipientResult{Status: delivery.StatusBounced, Code: 554, Enhanced: "5.7.1", RcptRejected: true}, false},
+		{"plain 552 at RCPT", delivery.RecipientResult{Status: delivery.StatusBounced, Code: 552, RcptRejected: true}, false},
+		{"plain 554 at RCPT", delivery.RecipientResult{Status: delivery.StatusBounced, Code: 554, RcptRejected: true}, false},
+		{"plain 550 after DATA", delivery.RecipientResult{Status: delivery.StatusBounced, Code: 550}, false},
+		{"content rejected", delivery.RecipientResult{Status: delivery.StatusBounced, Code: 554, Enhanced: "5.6.0"}, false},
+		{"too large", delivery.RecipientResult{Status: delivery.StatusBounced, Code: 552, Enhanced: "5.3.4", Reason: delivery.ReasonMessageTooLarge}, false},
+		{"deferred", delivery.RecipientResult{Status: delivery.StatusDeferred, Code: 450, Enhanced: "4.1.1", RcptRejected: true}, false},
+		{"delivered", delivery.RecipientResult{Status: delivery.StatusDelivered, Code: 250}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := addressBounced(&tt.result); got != tt.want {
+				t.Errorf("addressBounced(%+v) = %v, want %v", tt.result, got, tt.want)
+			}
+		})
+	}
+}
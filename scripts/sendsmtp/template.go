@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	texttemplate "text/template"
+)
+
+// Mail merge input. Instead of "to"/"subject"/"body" the message names a
+// template and lists the recipients with their variables:
+//
+//	{
+//	  "from": "noreply@example.com",
+//	  "template": "welcome",
+//	  "vars": {"Product": "MyMail"},             // shared by every recipient
+//	  "recipients": [
+//	    {"to": "alice@example.com", "vars": {"Name": "Alice"}},
+//	    {"to": "bob@example.com", "vars": {"Name": "Bob"}}
+//	  ]
+//	}
+//
+// A template named "welcome" is made of files in the templates directory
+// (SENDSMTP_TEMPLATES_DIR, default ./templates):
+//
+//	welcome.subject.tmpl  text/template, required, rendered on one line
+//	welcome.txt.tmpl      text/template, plain text body
+//	welcome.html.tmpl     html/template, HTML body
+//
+// At least one of the body files must exist. Inside a template the recipient's
+// variables override the shared ones and .To and .From hold the addresses.
+type MergeRecipient struct {
+	To   string                 `json:"to"`
+	Vars map[string]interface{} `json:"vars,omitempty"`
+}
+
+// templateNamePattern keeps template names from escaping the templates directory
+var templateNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// mailTemplate is a parsed template set, ready to render per recipient
+type mailTemplate struct {
+	name    string
+	subject *texttemplate.Template
+	text    *texttemplate.Template
+	html    *htmltemplate.Template
+}
+
+// templatesDir returns the directory templates are loaded from
+func templatesDir() string {
+	return getEnvOrDefault("SENDSMTP_TEMPLATES_DIR", "templates")
+}
+
+// loadTemplate reads and parses every file of the named template. Parse errors
+// are returned here, before any message is rendered or sent
+func loadTemplate(dir, name string) (*mailTemplate, error) {
+	if !templateNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid template name %q", name)
+	}
+
+	t := &mailTemplate{name: name}
+	readFile := func(suffix string) (string, bool, error) {
+		data, err := os.ReadFile(filepath.Join(dir, name+suffix))
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", false, nil
+		}
+		if err != nil {
+			return "", false, err
+		}
+		return string(data), true, nil
+	}
+
+	src, ok, err := readFile(".subject.tmpl")
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("template %q has no %s.subject.tmpl in %s", name, name, dir)
+	}
+	if t.subject, err = texttemplate.New(name + ".subject").Option("missingkey=error").Parse(strings.TrimSpace(src)); err != nil {
+		return nil, err
+	}
+
+	if src, ok, err = readFile(".txt.tmpl"); err != nil {
+		return nil, err
+	} else if ok {
+		if t.text, err = texttemplate.New(name + ".txt").Option("missingkey=error").Parse(src); err != nil {
+			return nil, err
+		}
+	}
+
+	if src, ok, err = readFile(".html.tmpl"); err != nil {
+		return nil, err
+	} else if ok {
+		if t.html, err = htmltemplate.New(name + ".html").Option("missingkey=error").Parse(src); err != nil {
+			return nil, err
+		}
+	}
+
+	if t.text == nil && t.html == nil {
+		return nil, fmt.Errorf("template %q has neither %s.txt.tmpl nor %s.html.tmpl in %s", name, name, name, dir)
+	}
+	return t, nil
+}
+
+// render produces the personalized subject and bodies for one recipient
+func (t *mailTemplate) render(data map[string]interface{}) (subject, text, html string, err error) {
+	var buf bytes.Buffer
+	if err = t.subject.Execute(&buf, data); err != nil {
+		return
+	}
+	subject = strings.TrimSpace(buf.String())
+
+	if t.text != nil {
+		buf.Reset()
+		if err = t.text.Execute(&buf, data); err != nil {
+			return
+		}
+		text = buf.String()
+	}
+
+	if t.html != nil {
+		buf.Reset()
+		if err = t.html.Execute(&buf, data); err != nil {
+			return
+		}
+		html = buf.String()
+	}
+	return
+}
+
+// renderMerge expands a template request into one message per recipient.
+// Every message is rendered and validated before the caller sends any of
+// them, so a broken template or a bad recipient aborts the whole batch
+func renderMerge(m *JSONMail) ([]*JSONMail, ValidationErrors) {
+	var errs ValidationErrors
+
+	if len(m.To) > 0 || len(m.CC) > 0 || len(m.BCC) > 0 || m.Subject != "" || m.Body != "" || m.HTML != "" {
+		errs.add(ErrInvalidTemplate, "template", "to, cc, bcc, subject, body and html cannot be combined with a template, use recipients")
+	}
+	if len(m.Recipients) == 0 {
+		errs.add(ErrNoRecipients, "recipients", "a template requires at least one entry in recipients")
+	}
+	addresses := make([]string, len(m.Recipients))
+	for i, recipient := range m.Recipients {
+		addresses[i] = recipient.To
+	}
+	errs = append(errs, validateDSN(m.DSN, addresses)...)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	tmpl, err := loadTemplate(templatesDir(), m.Template)
+	if err != nil {
+		errs.add(ErrInvalidTemplate, "template", "%v", err)
+		return nil, errs
+	}
+
+	messages := make([]*JSONMail, 0, len(m.Recipients))
+	for i, recipient := range m.Recipients {
+		field := fmt.Sprintf("recipients[%d]", i)
+
+		data := make(map[string]interface{}, len(m.Vars)+len(recipient.Vars)+2)
+		for k, v := range m.Vars {
+			data[k] = v
+		}
+		for k, v := range recipient.Vars {
+			data[k] = v
+		}
+		data["To"] = recipient.To
+		data["From"] = m.From
+
+		subject, text, html, err := tmpl.render(data)
+		if err != nil {
+			errs.add(ErrTemplateRender, field, "%v", err)
+			continue
+		}
+
+		// Every recipient gets a message of its own, so a fixed Message-ID cannot be reused
+		headers := make(map[string]string, len(m.Headers))
+		for k, v := range m.Headers {
+			if !strings.EqualFold(k, "Message-ID") {
+				headers[k] = v
+			}
+		}
+
+		personal := &JSONMail{
+			From:    m.From,
+			To:      []string{recipient.To},
+			Subject: subject,
+			Body:    text,
+			HTML:    html,
+			Headers: headers,
+			DSN:     m.DSN.ForRecipient(recipient.To),
+			MailUID: m.MailUID,
+			SMIME:   m.SMIME,
+			PGP:     m.PGP,
+
+			RequireTLS:   m.RequireTLS,
+			Unsubscribe:  m.Unsubscribe,
+			EnvelopeFrom: m.EnvelopeFrom,
+			VERP:         m.VERP,
+		}
+		for _, e := range validateJSONMail(personal) {
+			e.Field = field + "." + e.Field
+			errs = append(errs, e)
+		}
+		messages = append(messages, personal)
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return messages, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTemplates puts the named files in a temporary templates directory
+func writeTemplates(t *testing.T, files map[string]string) {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("SENDSMTP_TEMPLATES_DIR", dir)
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRenderMerge(t *testing.T) {
+	writeTemplates(t, map[string]string{
+		"welcome.subject.tmpl": "  Welcome to {{.Product}}, {{.Name}}\n",
+		"welcome.txt.tmpl":     "Hi {{.Name}},\nyour address is {{.To}}, mail comes from {{.From}}.\n",
+		"welcome.html.tmpl":    `<p>Hi {{.Name}}, visit <a href="{{.URL}}">{{.Product}}</a></p>`,
+	})
+
+	m := &JSONMail{
+		From:     "noreply@example.com",
+		Template: "welcome",
+		Vars:     map[string]interface{}{"Product": "MyMail", "Name": "friend", "URL": "https://example.com/start"},
+		Headers:  map[string]string{"X-Campaign": "welcome", "Message-ID": "<fixed@example.com>"},
+		Recipients: []MergeRecipient{
+			{To: "alice@example.com", Vars: map[string]interface{}{"Name": "Alice"}},
+			{To: "bob@example.net", Vars: map[string]interface{}{
+				"Name": `<script>alert("x")</script> & Co`,
+				"URL":  "javascript:alert(1)",
+			}},
+			{To: "carol@example.org"},
+		},
+	}
+	messages, errs := renderMerge(m)
+	if errs != nil {
+		t.Fatalf("renderMerge() = %v", errs)
+	}
+	if len(messages) != 3 {
+		t.Fatalf("got %d messages, want 3", len(messages))
+	}
+
+	tests := []struct {
+		to, subject, body, html string
+	}{
+		{
+			"alice@example.com",
+			"Welcome to MyMail, Alice",
+			"Hi Alice,\nyour address is alice@example.com, mail comes from noreply@example.com.\n",
+			`<p>Hi Alice, visit <a href="https://example.com/start">MyMail</a></p>`,
+		},
+		{
+			// The text body is sent as written, the HTML body is escaped and
+			// an unsafe URL is replaced
+			"bob@example.net",
+			`Welcome to MyMail, <script>alert("x")</script> & Co`,
+			"Hi <script>alert(\"x\")</script> & Co,\nyour address is bob@example.net, mail comes from noreply@example.com.\n",
+			`<p>Hi &lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt; &amp; Co, visit <a href="#ZgotmplZ">MyMail</a></p>`,
+		},
+		{
+			"carol@example.org",
+			"Welcome to MyMail, friend",
+			"Hi friend,\nyour address is carol@example.org, mail comes from noreply@example.com.\n",
+			`<p>Hi friend, visit <a href="https://example.com/start">MyMail</a></p>`,
+		},
+	}
+	for i, tt := range tests {
+		got := messages[i]
+		if len(got.To) != 1 || got.To[0] != tt.to {
+			t.Errorf("message %d to %v, want %s", i, got.To, tt.to)
+		}
+		if got.Subject != tt.subject {
+			t.Errorf("message %d subject %q, want %q", i, got.Subject, tt.subject)
+		}
+		if got.Body != tt.body {
+			t.Errorf("message %d body %q, want %q", i, got.Body, tt.body)
+		}
+		if got.HTML != tt.html {
+			t.Errorf("message %d html %q, want %q", i, got.HTML, tt.html)
+		}
+		if got.Headers["X-Campaign"] != "welcome" || got.header("Message-ID") != "" {
+			t.Errorf("message %d headers %v, want X-Campaign without the fixed Message-ID", i, got.Headers)
+		}
+	}
+}
+
+func TestRenderMergeErrors(t *testing.T) {
+	writeTemplates(t, map[string]string{
+		"welcome.subject.tmpl": "Welcome, {{.Name}}",
+		"welcome.txt.tmpl":     "Hi {{.Name}}",
+		"nobody.subject.tmpl":  "No body",
+		"broken.subject.tmpl":  "Hi {{.Name",
+		"broken.txt.tmpl":      "text",
+		"nosubject.txt.tmpl":   "text",
+	})
+
+	recipients := []MergeRecipient{{To: "alice@example.com", Vars: map[string]interface{}{"Name": "Alice"}}}
+	tests := []struct {
+		name  string
+		mail  JSONMail
+		code  ErrorCode
+		field string
+	}{
+		{"combined with to", JSONMail{Template: "welcome", To: []string{"bob@example.net"}, Recipients: recipients}, ErrInvalidTemplate, "template"},
+		{"combined with body", JSONMail{Template: "welcome", Body: "text", Recipients: recipients}, ErrInvalidTemplate, "template"},
+		{"no recipients", JSONMail{Template: "welcome"}, ErrNoRecipients, "recipients"},
+		{"path in name", JSONMail{Template: "../welcome", Recipients: recipients}, ErrInvalidTemplate, "template"},
+		{"unknown template", JSONMail{Template: "missing", Recipients: recipients}, ErrInvalidTemplate, "template"},
+		{"no subject file", JSONMail{Template: "nosubject", Recipients: recipients}, ErrInvalidTemplate, "template"},
+		{"no body file", JSONMail{Template: "nobody", Recipients: recipients}, ErrInvalidTemplate, "template"},
+		{"parse error", JSONMail{Template: "broken", Recipients: recipients}, ErrInvalidTemplate, "template"},
+		{"missing variable", JSONMail{Template: "welcome", Recipients: []MergeRecipient{{To: "alice@example.com"}}}, ErrTemplateRender, "recipients[0]"},
+		{"line break from a variable", JSONMail{Template: "welcome", Recipients: []MergeRecipient{
+			{To: "alice@example.com", Vars: map[string]interface{}{"Name": "Alice\nBcc: eve@evil.test"}},
+		}}, ErrInvalidSubject, "recipients[0].subject"},
+		{"bad recipient", JSONMail{Template: "welcome", Recipients: []MergeRecipient{
+			{To: "alice@example.com", Vars: map[string]interface{}{"Name": "Alice"}},
+			{To: "not an address", Vars: map[string]interface{}{"Name": "Bob"}},
+		}}, ErrInvalidAddress, "recipients[1].to[0]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := tt.mail
+			m.From = "noreply@example.com"
+			messages, errs := renderMerge(&m)
+			if messages != nil {
+				t.Errorf("got %d messages despite errors", len(messages))
+			}
+			if len(errs) != 1 || errs[0].Code != tt.code || errs[0].Field != tt.field {
+				t.Fatalf("got %v, want a single %s error on %q", errs, tt.code, tt.field)
+			}
+		})
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// One-click unsubscribe (RFC 8058). With
+//
+//	"unsubscribe": {"list": "newsletter"}
+//
+// the message carries
+//
+//	List-Unsubscribe: <https://mail.example.com/unsubscribe?token=...>
+//	List-Unsubscribe-Post: List-Unsubscribe=One-Click
+//
+// where the token is signed with SENDSMTP_UNSUBSCRIBE_SECRET and the URL is
+// SENDSMTP_UNSUBSCRIBE_URL. A link stops working after
+// SENDSMTP_UNSUBSCRIBE_MAX_AGE (a Go duration, 8760h by default). "list" is optional: without it the recipient is
+// added to the suppression list, with it only that list is unsubscribed in
+// mail_preferences, and later messages for the list skip the recipient.
+// The token names one recipient, so the message must have exactly one; use a
+// template for bulk mail. sendsmtp -serve-unsubscribe <addr> serves the URL.
+type UnsubscribeOptions struct {
+	List string `json:"list,omitempty"`
+}
+
+// unsubscribeListPattern restricts list names to something safe in URLs and logs
+var unsubscribeListPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// errInvalidToken is returned for tokens that are malformed or not signed with our secret
+var errInvalidToken = errors.New("invalid unsubscribe token")
+
+// errExpiredToken is returned for a valid token older than the maximum age
+var errExpiredToken = errors.New("unsubscribe link has expired")
+
+// defaultUnsubscribeMaxAge keeps links in a year of archived mail working
+const defaultUnsubscribeMaxAge = 365 * 24 * time.Hour
+
+// unsubscribeToken is the signed payload of an unsubscribe link
+type unsubscribeToken struct {
+	Address  string `json:"a"`
+	List     string `json:"l,omitempty"`
+	IssuedAt int64  `json:"t"`
+}
+
+// unsubscribeConfig returns the secret and base URL, either of which may be empty
+func unsubscribeConfig() (secret, baseURL string) {
+	return getEnvOrDefault("SENDSMTP_UNSUBSCRIBE_SECRET", ""), getEnvOrDefault("SENDSMTP_UNSUBSCRIBE_URL", "")
+}
+
+// unsubscribeMaxAge returns how long an unsubscribe link stays valid
+func unsubscribeMaxAge() (time.Duration, error) {
+	value := getEnvOrDefault("SENDSMTP_UNSUBSCRIBE_MAX_AGE", "")
+	if value == "" {
+		return defaultUnsubscribeMaxAge, nil
+	}
+	maxAge, err := time.ParseDuration(value)
+	if err != nil || maxAge <= 0 {
+		return 0, fmt.Errorf("SENDSMTP_UNSUBSCRIBE_MAX_AGE must be a positive duration such as 4380h, got %q", value)
+	}
+	return maxAge, nil
+}
+
+// validate checks the options and that unsubscribe links can be generated
+func (o *UnsubscribeOptions) validate(recipients []string, headers map[string]string) ValidationErrors {
+	var errs ValidationErrors
+	if o == nil {
+		return nil
+	}
+	if o.List != "" && !unsubscribeListPattern.MatchString(o.List) {
+		errs.add(ErrInvalidUnsubscribe, "unsubscribe.list", "list must be 1-64 letters, digits, '.', '_' or '-', got %q", o.List)
+	}
+	if len(recipients) != 1 {
+		errs.add(ErrInvalidUnsubscribe, "unsubscribe", "unsubscribe links name one recipient, the message has %d; use a template for bulk mail", len(recipients))
+	}
+	for name := range headers {
+		if strings.EqualFold(name, "List-Unsubscribe") || strings.EqualFold(name, "List-Unsubscribe-Post") {
+			errs.add(ErrInvalidUnsubscribe, "headers."+name, "%s is generated from unsubscribe and cannot be set directly", name)
+		}
+	}
+	secret, baseURL := unsubscribeConfig()
+	if secret == "" || baseURL == "" {
+		errs.add(ErrInvalidUnsubscribe, "unsubscribe", "SENDSMTP_UNSUBSCRIBE_SECRET and SENDSMTP_UNSUBSCRIBE_URL must be set")
+	} else if u, err := url.Parse(baseURL); err != nil || u.Scheme != "https" || u.Host == "" {
+		errs.add(ErrInvalidUnsubscribe, "unsubscribe", "SENDSMTP_UNSUBSCRIBE_URL must be an https URL (RFC 8058), got %q", baseURL)
+	}
+	return errs
+}
+
+// headers returns the List-Unsubscribe and List-Unsubscribe-Post values for recipient
+func (o *UnsubscribeOptions) headers(recipient string) (string, string) {
+	secret, baseURL := unsubscribeConfig()
+	token := signUnsubscribeToken(secret, &unsubscribeToken{
+		Address:  normalizeAddress(recipient),
+		List:     o.List,
+		IssuedAt: time.Now().Unix(),
+	})
+
+	link := baseURL
+	if strings.Contains(link, "?") {
+		link += "&"
+	} else {
+		link += "?"
+	}
+	link += "token=" + url.QueryEscape(token)
+	return "<" + link + ">", "List-Unsubscribe=One-Click"
+}
+
+// signUnsubscribeToken encodes t as base64url(JSON) "." base64url(HMAC-SHA256)
+func signUnsubscribeToken(secret string, t *unsubscribeToken) string {
+	payload, _ := json.Marshal(t)
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(encoded))
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyUnsubscribeToken checks the signature and age of token at now and decodes it
+func verifyUnsubscribeToken(secret, token string, now time.Time, maxAge time.Duration) (*unsubscribeToken, error) {
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok || secret == "" {
+		return nil, errInvalidToken
+	}
+	got, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(encoded))
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return nil, errInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	var t unsubscribeToken
+	if err := json.Unmarshal(payload, &t); err != nil || t.Address == "" || t.IssuedAt <= 0 {
+		return nil, errInvalidToken
+	}
+	if now.Sub(time.Unix(t.IssuedAt, 0)) > maxAge {
+		return nil, errExpiredToken
+	}
+	return &t, nil
+}
+
+// unsubscribeHandler serves the List-Unsubscribe URL. A POST (the one-click
+// request mail providers send, or the confirmation form) unsubscribes; a GET
+// only shows the form, because link scanners fetch every URL in a message
+type unsubscribeHandler struct {
+	secret       string
+	maxAge       time.Duration
+	suppressions *suppressionList
+}
+
+var unsubscribePage = template.Must(template.New("unsubscribe").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Unsubscribe</title></head>
+<body>
+{{if .Done}}<p>{{.Address}} has been unsubscribed{{if .List}} from {{.List}}{{end}}.</p>
+{{else}}<form method="post">
+<p>Unsubscribe {{.Address}}{{if .List}} from {{.List}}{{end}}?</p>
+<input type="hidden" name="List-Unsubscribe" value="One-Click">
+<button type="submit">Unsubscribe</button>
+</form>{{end}}
+</body></html>
+`))
+
+func (h *unsubscribeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t, err := verifyUnsubscribeToken(h.secret, r.URL.Query().Get("token"), time.Now(), h.maxAge)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		unsubscribePage.Execute(w, map[string]interface{}{"Address": t.Address, "List": t.List})
+	case http.MethodPost:
+		// RFC 8058: the body of a one-click request is List-Unsubscribe=One-Click
+		if r.PostFormValue("List-Unsubscribe") != "One-Click" {
+			http.Error(w, "expected List-Unsubscribe=One-Click", http.StatusBadRequest)
+			return
+		}
+		if err := h.suppressions.unsubscribe(t.Address, t.List); err != nil {
+			log.Printf("Error: %v\n", err)
+			http.Error(w, "unsubscribe failed, please try again later", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		unsubscribePage.Execute(w, map[string]interface{}{"Address": t.Address, "List": t.List, "Done": true})
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveUnsubscribe runs the unsubscribe endpoint on addr until it fails
+func serveUnsubscribe(addr string, suppressions *suppressionList) error {
+	secret, baseURL := unsubscribeConfig()
+	if secret == "" {
+		return fmt.Errorf("SENDSMTP_UNSUBSCRIBE_SECRET is not set")
+	}
+	maxAge, err := unsubscribeMaxAge()
+	if err != nil {
+		return err
+	}
+	if suppressions == nil {
+		return fmt.Errorf("unsubscribe requires a database (set DB_HOST)")
+	}
+	path := "/"
+	if u, err := url.Parse(baseURL); err == nil && u.Path != "" {
+		path = u.Path
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(path, &unsubscribeHandler{secret: secret, maxAge: maxAge, suppressions: suppressions})
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	log.Printf("Serving unsubscribe requests on %s%s\n", addr, path)
+	return server.ListenAndServe()
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUnsubscribeToken(t *testing.T) {
+	const secret = "s3cret"
+	issued := time.Date(2025, 10, 13, 9, 0, 0, 0, time.UTC)
+	token := signUnsubscribeToken(secret, &unsubscribeToken{Address: "bob@example.net", List: "newsletter", IssuedAt: issued.Unix()})
+
+	got, err := verifyUnsubscribeToken(secret, token, issued.Add(time.Hour), defaultUnsubscribeMaxAge)
+	if err != nil {
+		t.Fatalf("verifyUnsubscribeToken() = %v", err)
+	}
+	if got.Address != "bob@example.net" || got.List != "newsletter" || got.IssuedAt != issued.Unix() {
+		t.Errorf("decoded %+v", got)
+	}
+
+	encoded, signature, _ := strings.Cut(token, ".")
+	forged := signUnsubscribeToken("other", &unsubscribeToken{Address: "carol@example.net", IssuedAt: issued.Unix()})
+	forgedPayload, _, _ := strings.Cut(forged, ".")
+	undated := signUnsubscribeToken(secret, &unsubscribeToken{Address: "bob@example.net"})
+
+	tests := []struct {
+		name   string
+		secret string
+		token  string
+		now    time.Time
+		want   error
+	}{
+		{"at the maximum age", secret, token, issued.Add(defaultUnsubscribeMaxAge), nil},
+		{"expired", secret, token, issued.Add(defaultUnsubscribeMaxAge + time.Second), errExpiredToken},
+		{"wrong secret", "other", token, issued, errInvalidToken},
+		{"no secret", "", token, issued, errInvalidToken},
+		{"signed with another secret", secret, forged, issued, errInvalidToken},
+		{"payload swapped", secret, forgedPayload + "." + signature, issued, errInvalidToken},
+		{"signature cut", secret, encoded + "." + signature[:len(signature)-2], issued, errInvalidToken},
+		{"no signature", secret, encoded, issued, errInvalidToken},
+		{"not base64", secret, "!!." + signature, issued, errInvalidToken},
+		{"empty", secret, "", issued, errInvalidToken},
+		{"no issue time", secret, undated, issued, errInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := verifyUnsubscribeToken(tt.secret, tt.token, tt.now, defaultUnsubscribeMaxAge)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("verifyUnsubscribeToken() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnsubscribeHeaders(t *testing.T) {
+	t.Setenv("SENDSMTP_UNSUBSCRIBE_SECRET", "s3cret")
+	t.Setenv("SENDSMTP_UNSUBSCRIBE_URL", "https://mail.example.com/unsubscribe?src=mail")
+
+	link, post := (&UnsubscribeOptions{List: "newsletter"}).headers("Bob@Example.NET")
+	if post != "List-Unsubscribe=One-Click" {
+		t.Errorf("List-Unsubscribe-Post %q", post)
+	}
+	u, err := url.Parse(strings.TrimSuffix(strings.TrimPrefix(link, "<"), ">"))
+	if err != nil || u.Host != "mail.example.com" || u.Query().Get("src") != "mail" {
+		t.Fatalf("List-Unsubscribe %q", link)
+	}
+	got, err := verifyUnsubscribeToken("s3cret", u.Query().Get("token"), time.Now(), time.Minute)
+	if err != nil || got.Address != "bob@example.net" || got.List != "newsletter" {
+		t.Errorf("token decodes to %+v, %v", got, err)
+	}
+}
+
+func TestUnsubscribeMaxAge(t *testing.T) {
+	for _, tt := range []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"", defaultUnsubscribeMaxAge, true},
+		{"720h", 720 * time.Hour, true},
+		{"30d", 0, false},
+		{"-1h", 0, false},
+		{"0", 0, false},
+	} {
+		t.Setenv("SENDSMTP_UNSUBSCRIBE_MAX_AGE", tt.value)
+		got, err := unsubscribeMaxAge()
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("SENDSMTP_UNSUBSCRIBE_MAX_AGE=%q gives %v, %v", tt.value, got, err)
+		}
+	}
+}
+
+func TestUnsubscribeHandler(t *testing.T) {
+	const secret = "s3cret"
+	h := &unsubscribeHandler{secret: secret, maxAge: time.Hour}
+	valid := signUnsubscribeToken(secret, &unsubscribeToken{Address: "bob@example.net", IssuedAt: time.Now().Unix()})
+	expired := signUnsubscribeToken(secret, &unsubscribeToken{Address: "bob@example.net", IssuedAt: time.Now().Add(-2 * time.Hour).Unix()})
+
+	tests := []struct {
+		name   string
+		method string
+		token  string
+		body   string
+		status int
+	}{
+		{"form", http.MethodGet, valid, "", http.StatusOK},
+		{"expired", http.MethodGet, expired, "", http.StatusBadRequest},
+		{"forged", http.MethodGet, valid + "x", "", http.StatusBadRequest},
+		{"post without one-click", http.MethodPost, valid, "unsubscribe=yes", http.StatusBadRequest},
+		{"expired post", http.MethodPost, expired, "List-Unsubscribe=One-Click", http.StatusBadRequest},
+		{"put", http.MethodPut, valid, "", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/unsubscribe?token="+url.QueryEscape(tt.token), strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Errorf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			// A GET must never unsubscribe, it only shows the form
+			if tt.status == http.StatusOK && !strings.Contains(rec.Body.String(), `<form method="post">`) {
+				t.Errorf("GET did not show the confirmation form: %s", rec.Body)
+			}
+		})
+	}
+}
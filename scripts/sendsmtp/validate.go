@@ -0,0 +1,321 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Limits applied to caller supplied input before anything is put on the wire
+const (
+	maxHeaderNameLength = 76        // keeps "Name: " well inside a single 78 column line
+	maxHeaderLineLength = 998       // RFC 5322 section 2.1.1 hard line limit (excluding CRLF)
+	maxHeaderCount      = 100       // custom headers per message
+	maxHeaderBytes      = 32 * 1024 // total size of all custom header lines
+	maxAddressLength    = 254       // RFC 5321 path limit minus the angle brackets
+	maxLocalPartLength  = 64        // RFC 5321 section 4.5.3.1.1
+	maxDomainLength     = 253
+	maxSubjectLength    = maxHeaderLineLength - len("Subject: ")
+)
+
+// ErrorCode identifies the reason an input message was rejected
+type ErrorCode string
+
+const (
+	ErrMissingFrom        ErrorCode = "missing_from"
+	ErrNoRecipients       ErrorCode = "no_recipients"
+	ErrInvalidAddress     ErrorCode = "invalid_address"
+	ErrInvalidSubject     ErrorCode = "invalid_subject"
+	ErrInvalidHeaderName  ErrorCode = "invalid_header_name"
+	ErrInvalidHeaderValue ErrorCode = "invalid_header_value"
+	ErrReservedHeader     ErrorCode = "reserved_header"
+	ErrDuplicateHeader    ErrorCode = "duplicate_header"
+	ErrHeaderTooLong      ErrorCode = "header_too_long"
+	ErrTooManyHeaders     ErrorCode = "too_many_headers"
+	ErrHeadersTooLarge    ErrorCode = "headers_too_large"
+	ErrInvalidDSN         ErrorCode = "invalid_dsn"
+	ErrInvalidTemplate    ErrorCode = "invalid_template"
+	ErrTemplateRender     ErrorCode = "template_render_failed"
+	ErrInvalidMailUID     ErrorCode = "invalid_mail_uid"
+	ErrSMIMEUnavailable   ErrorCode = "smime_unavailable"
+	ErrInvalidPGP         ErrorCode = "invalid_pgp"
+	ErrInvalidEnvelope    ErrorCode = "invalid_envelope_from"
+	ErrInvalidUnsubscribe ErrorCode = "invalid_unsubscribe"
+	ErrInvalidRequireTLS  ErrorCode = "invalid_require_tls"
+)
+
+// ValidationError describes a single problem with the input JSON
+type ValidationError struct {
+	Code    ErrorCode `json:"code"`
+	Field   string    `json:"field"`
+	Message string    `json:"message"`
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s (%s)", e.Field, e.Message, e.Code)
+}
+
+// ValidationErrors collects every problem found so callers can report them all at once
+type ValidationErrors []*ValidationError
+
+func (errs ValidationErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (errs *ValidationErrors) add(code ErrorCode, field, format string, args ...interface{}) {
+	*errs = append(*errs, &ValidationError{Code: code, Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// reservedHeaders are generated from the structured JSON fields and may not be
+// overridden through the free-form headers map
+var reservedHeaders = map[string]bool{
+	"from":                      true,
+	"to":                        true,
+	"cc":                        true,
+	"bcc":                       true,
+	"subject":                   true,
+	"mime-version":              true,
+	"content-type":              true,
+	"content-transfer-encoding": true,
+}
+
+// singleHeaders may occur at most once in a message (RFC 5322 section 3.6).
+// JSON object keys are case sensitive, so "Reply-To" and "reply-to" could
+// otherwise both be supplied
+var singleHeaders = map[string]bool{
+	"date":        true,
+	"sender":      true,
+	"reply-to":    true,
+	"message-id":  true,
+	"in-reply-to": true,
+	"references":  true,
+}
+
+// validateJSONMail checks addresses, subject and custom headers of a parsed
+// JSONMail and returns every violation found, or nil if the message is safe to send
+func validateJSONMail(m *JSONMail) ValidationErrors {
+	var errs ValidationErrors
+
+	if m.From == "" {
+		errs.add(ErrMissingFrom, "from", "'from' field is required")
+	} else if reason := checkAddress(m.From); reason != "" {
+		errs.add(ErrInvalidAddress, "from", "invalid address %q: %s", m.From, reason)
+	}
+
+	if len(m.To) == 0 && len(m.CC) == 0 && len(m.BCC) == 0 {
+		errs.add(ErrNoRecipients, "to", "at least one recipient is required (to, cc, or bcc)")
+	}
+	for field, list := range map[string][]string{"to": m.To, "cc": m.CC, "bcc": m.BCC} {
+		for i, addr := range list {
+			if reason := checkAddress(addr); reason != "" {
+				errs.add(ErrInvalidAddress, fmt.Sprintf("%s[%d]", field, i), "invalid address %q: %s", addr, reason)
+			}
+		}
+	}
+
+	if len(m.Subject) > maxSubjectLength {
+		errs.add(ErrInvalidSubject, "subject", "subject is %d bytes, limit is %d", len(m.Subject), maxSubjectLength)
+	} else if reason := checkHeaderValue(m.Subject, true); reason != "" {
+		errs.add(ErrInvalidSubject, "subject", "%s", reason)
+	}
+
+	if m.MailUID != "" && !uuidPattern.MatchString(m.MailUID) {
+		errs.add(ErrInvalidMailUID, "mail_uid", "mail_uid must be a UUID, got %q", m.MailUID)
+	}
+
+	if m.EnvelopeFrom != "" {
+		if reason := checkAddress(m.EnvelopeFrom); reason != "" {
+			errs.add(ErrInvalidEnvelope, "envelope_from", "invalid address %q: %s", m.EnvelopeFrom, reason)
+		}
+	}
+	if m.VERP {
+		if m.MailUID == "" {
+			errs.add(ErrInvalidEnvelope, "verp", "verp requires mail_uid, which identifies the message in bounce addresses")
+		}
+		// postsmtp takes the tag from the last "+" before the first "=", so the
+		// base local part may carry a "+detail" but no "="
+		if base := m.envelopeFrom(); strings.Contains(base[:strings.LastIndex(base, "@")+1], "=") {
+			errs.add(ErrInvalidEnvelope, "verp", "the local part of %q cannot contain \"=\" when verp is set", base)
+		}
+	}
+
+	// RFC 8689 section 5: "TLS-Required: No" asks for the opposite of REQUIRETLS
+	if m.RequireTLS && m.header("TLS-Required") != "" {
+		errs.add(ErrInvalidRequireTLS, "headers.TLS-Required", "TLS-Required cannot be combined with require_tls")
+	}
+
+	errs = append(errs, validateHeaders(m.Headers)...)
+	errs = append(errs, validateDSN(m.DSN, m.recipients())...)
+	if m.From != "" {
+		errs = append(errs, m.SMIME.validate(m.From, m.recipients())...)
+	}
+	errs = append(errs, m.PGP.validate(m.SMIME)...)
+	errs = append(errs, m.Unsubscribe.validate(m.recipients(), m.Headers)...)
+
+	// Map iteration above is unordered, keep the report stable for callers
+	sort.SliceStable(errs, func(i, j int) bool { return errs[i].Field < errs[j].Field })
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// validateHeaders checks the custom header map for names outside RFC 5322
+// ftext, values that could break out of their header line and size limits
+func validateHeaders(headers map[string]string) ValidationErrors {
+	var errs ValidationErrors
+
+	if len(headers) > maxHeaderCount {
+		errs.add(ErrTooManyHeaders, "headers", "%d custom headers supplied, limit is %d", len(headers), maxHeaderCount)
+	}
+
+	total := 0
+	seen := make(map[string]string, len(headers))
+	for name, value := range headers {
+		field := "headers." + name
+
+		if reason := checkHeaderName(name); reason != "" {
+			errs.add(ErrInvalidHeaderName, field, "%s", reason)
+			continue
+		}
+		if reservedHeaders[strings.ToLower(name)] {
+			errs.add(ErrReservedHeader, field, "%s is generated from the message fields and cannot be set directly", name)
+			continue
+		}
+		if lower := strings.ToLower(name); singleHeaders[lower] {
+			// Report the pair once, on the name that sorts last
+			if other, ok := seen[lower]; ok {
+				first, second := other, name
+				if second < first {
+					first, second = second, first
+				}
+				errs.add(ErrDuplicateHeader, "headers."+second, "%s may occur only once, also given as %s", second, first)
+				continue
+			}
+			seen[lower] = name
+		}
+		if reason := checkHeaderValue(value, false); reason != "" {
+			errs.add(ErrInvalidHeaderValue, field, "%s", reason)
+			continue
+		}
+
+		lineLength := len(name) + len(": ") + len(value)
+		if lineLength > maxHeaderLineLength {
+			errs.add(ErrHeaderTooLong, field, "header line is %d bytes, limit is %d", lineLength, maxHeaderLineLength)
+			continue
+		}
+		total += lineLength + len("\r\n")
+	}
+
+	if total > maxHeaderBytes {
+		errs.add(ErrHeadersTooLarge, "headers", "custom headers total %d bytes, limit is %d", total, maxHeaderBytes)
+	}
+
+	return errs
+}
+
+// checkHeaderName returns a non-empty reason if name is not a valid RFC 5322
+// field name (one or more printable US-ASCII characters except colon)
+func checkHeaderName(name string) string {
+	if name == "" {
+		return "header name is empty"
+	}
+	if len(name) > maxHeaderNameLength {
+		return fmt.Sprintf("header name is %d bytes, limit is %d", len(name), maxHeaderNameLength)
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c < 33 || c > 126 || c == ':' {
+			return fmt.Sprintf("header name contains invalid character %q at position %d", c, i)
+		}
+	}
+	return ""
+}
+
+// checkHeaderValue returns a non-empty reason if value contains anything that
+// could terminate the header line or is not allowed in an unstructured field.
+// Unless allowUTF8 is set (for fields the sender encodes itself), non-ASCII
+// text must be supplied as RFC 2047 encoded-words
+func checkHeaderValue(value string, allowUTF8 bool) string {
+	if allowUTF8 && !utf8.ValidString(value) {
+		return "value is not valid UTF-8"
+	}
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == '\r' || c == '\n':
+			return fmt.Sprintf("value contains a line break at position %d", i)
+		case c == 0:
+			return fmt.Sprintf("value contains a NUL byte at position %d", i)
+		case c == '\t':
+			// HTAB is WSP and allowed
+		case c < 32 || c == 127:
+			return fmt.Sprintf("value contains control character %q at position %d", c, i)
+		case c > 127 && !allowUTF8:
+			return fmt.Sprintf("value contains non-ASCII byte at position %d, use RFC 2047 encoded-words", i)
+		}
+	}
+	return ""
+}
+
+// checkAddress returns a non-empty reason if addr is not a bare RFC 5321
+// mailbox (local@domain, no display name, comments or angle brackets)
+func checkAddress(addr string) string {
+	if addr == "" {
+		return "address is empty"
+	}
+	if len(addr) > maxAddressLength {
+		return fmt.Sprintf("address is %d bytes, limit is %d", len(addr), maxAddressLength)
+	}
+	if strings.ContainsAny(addr, "\r\n\x00<>") {
+		return "address contains forbidden characters"
+	}
+
+	parsed, err := mail.ParseAddress(addr)
+	if err != nil {
+		return err.Error()
+	}
+	if parsed.Name != "" || parsed.Address != addr {
+		return "expected a bare address without display name"
+	}
+
+	at := strings.LastIndex(addr, "@")
+	local, domain := addr[:at], addr[at+1:]
+	if len(local) > maxLocalPartLength {
+		return fmt.Sprintf("local part is %d bytes, limit is %d", len(local), maxLocalPartLength)
+	}
+	return checkDomain(domain)
+}
+
+// checkDomain validates the domain of an address as a DNS hostname
+func checkDomain(domain string) string {
+	if len(domain) > maxDomainLength {
+		return fmt.Sprintf("domain is %d bytes, limit is %d", len(domain), maxDomainLength)
+	}
+	labels := strings.Split(domain, ".")
+	if len(labels) < 2 {
+		return "domain must be fully qualified"
+	}
+	for _, label := range labels {
+		if label == "" || len(label) > 63 {
+			return fmt.Sprintf("invalid domain label %q", label)
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Sprintf("domain label %q may not start or end with a hyphen", label)
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return fmt.Sprintf("domain label %q contains invalid character %q", label, c)
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// validMail returns a message that passes validateJSONMail
+func validMail() *JSONMail {
+	return &JSONMail{
+		From:    "alice@example.com",
+		To:      []string{"bob@example.net"},
+		CC:      []string{"carol@example.org"},
+		BCC:     []string{"dave@example.org"},
+		Subject: "Quarterly report",
+		Body:    "See attached.",
+		Headers: map[string]string{"X-Campaign": "q3", "Reply-To": "team@example.com"},
+	}
+}
+
+func TestValidateJSONMail(t *testing.T) {
+	tests := []struct {
+		name  string
+		edit  func(m *JSONMail)
+		code  ErrorCode // "" when the message is valid
+		field string
+	}{
+		{"valid", func(m *JSONMail) {}, "", ""},
+		{"tab in subject", func(m *JSONMail) { m.Subject = "a\tb" }, "", ""},
+		{"UTF-8 subject", func(m *JSONMail) { m.Subject = "Grüße" }, "", ""},
+
+		// Line breaks and NUL in every address field
+		{"CR in from", func(m *JSONMail) { m.From = "alice@example.com\rBcc: eve@evil.test" }, ErrInvalidAddress, "from"},
+		{"LF in from", func(m *JSONMail) { m.From = "alice@example.com\nBcc: eve@evil.test" }, ErrInvalidAddress, "from"},
+		{"NUL in from", func(m *JSONMail) { m.From = "alice\x00@example.com" }, ErrInvalidAddress, "from"},
+		{"CR in to", func(m *JSONMail) { m.To = []string{"bob@example.net\r"} }, ErrInvalidAddress, "to[0]"},
+		{"LF in to", func(m *JSONMail) { m.To = []string{"bob@example.net", "x@example.net\nSubject: spoofed"} }, ErrInvalidAddress, "to[1]"},
+		{"NUL in to", func(m *JSONMail) { m.To = []string{"bob\x00@example.net"} }, ErrInvalidAddress, "to[0]"},
+		{"CRLF in cc", func(m *JSONMail) { m.CC = []string{"carol@example.org\r\nX-Injected: 1"} }, ErrInvalidAddress, "cc[0]"},
+		{"NUL in cc", func(m *JSONMail) { m.CC = []string{"carol@example.org\x00"} }, ErrInvalidAddress, "cc[0]"},
+		{"LF in bcc", func(m *JSONMail) { m.BCC = []string{"\ndave@example.org"} }, ErrInvalidAddress, "bcc[0]"},
+		{"NUL in bcc", func(m *JSONMail) { m.BCC = []string{"dave@exa\x00mple.org"} }, ErrInvalidAddress, "bcc[0]"},
+		{"CRLF in envelope_from", func(m *JSONMail) { m.EnvelopeFrom = "bounces@example.com\r\nRCPT TO:<eve@evil.test>" }, ErrInvalidEnvelope, "envelope_from"},
+		{"NUL in envelope_from", func(m *JSONMail) { m.EnvelopeFrom = "bounces\x00@example.com" }, ErrInvalidEnvelope, "envelope_from"},
+
+		// VERP tags the envelope sender's local part with "+" and "="
+		{"verp", func(m *JSONMail) { m.VERP, m.MailUID = true, "6f1c2a9e-3b4d-4e5f-8a7b-9c0d1e2f3a4b" }, "", ""},
+		{"verp with +detail", func(m *JSONMail) {
+			m.VERP, m.MailUID, m.EnvelopeFrom = true, "6f1c2a9e-3b4d-4e5f-8a7b-9c0d1e2f3a4b", "bounces+news@example.com"
+		}, "", ""},
+		{"verp with = in local part", func(m *JSONMail) {
+			m.VERP, m.MailUID, m.EnvelopeFrom = true, "6f1c2a9e-3b4d-4e5f-8a7b-9c0d1e2f3a4b", "a=b@example.com"
+		}, ErrInvalidEnvelope, "verp"},
+		{"verp without mail_uid", func(m *JSONMail) { m.VERP = true }, ErrInvalidEnvelope, "verp"},
+
+		// Address syntax
+		{"display name", func(m *JSONMail) { m.From = "Alice <alice@example.com>" }, ErrInvalidAddress, "from"},
+		{"angle brackets", func(m *JSONMail) { m.To = []string{"<bob@example.net>"} }, ErrInvalidAddress, "to[0]"},
+		{"unqualified domain", func(m *JSONMail) { m.To = []string{"bob@localhost"} }, ErrInvalidAddress, "to[0]"},
+		{"bad domain label", func(m *JSONMail) { m.To = []string{"bob@-example.net"} }, ErrInvalidAddress, "to[0]"},
+		{"long local part", func(m *JSONMail) { m.To = []string{strings.Repeat("b", 65) + "@example.net"} }, ErrInvalidAddress, "to[0]"},
+		{"missing from", func(m *JSONMail) { m.From = "" }, ErrMissingFrom, "from"},
+		{"no recipients", func(m *JSONMail) { m.To, m.CC, m.BCC = nil, nil, nil }, ErrNoRecipients, "to"},
+
+		// Line breaks, NUL and control characters in header values
+		{"CR in subject", func(m *JSONMail) { m.Subject = "Hi\rBcc: eve@evil.test" }, ErrInvalidSubject, "subject"},
+		{"LF in subject", func(m *JSONMail) { m.Subject = "Hi\nBcc: eve@evil.test" }, ErrInvalidSubject, "subject"},
+		{"NUL in subject", func(m *JSONMail) { m.Subject = "Hi\x00" }, ErrInvalidSubject, "subject"},
+		{"invalid UTF-8 subject", func(m *JSONMail) { m.Subject = "caf\xe9" }, ErrInvalidSubject, "subject"},
+		{"CR in header", func(m *JSONMail) { m.Headers["X-Campaign"] = "q3\rBcc: eve@evil.test" }, ErrInvalidHeaderValue, "headers.X-Campaign"},
+		{"LF in header", func(m *JSONMail) { m.Headers["X-Campaign"] = "q3\nBcc: eve@evil.test" }, ErrInvalidHeaderValue, "headers.X-Campaign"},
+		{"CRLF in header", func(m *JSONMail) { m.Headers["X-Campaign"] = "q3\r\n\r\nbody" }, ErrInvalidHeaderValue, "headers.X-Campaign"},
+		{"NUL in header", func(m *JSONMail) { m.Headers["X-Campaign"] = "q\x003" }, ErrInvalidHeaderValue, "headers.X-Campaign"},
+		{"DEL in header", func(m *JSONMail) { m.Headers["X-Campaign"] = "q3\x7f" }, ErrInvalidHeaderValue, "headers.X-Campaign"},
+		{"raw UTF-8 in header", func(m *JSONMail) { m.Headers["X-Campaign"] = "Grüße" }, ErrInvalidHeaderValue, "headers.X-Campaign"},
+		{"header line too long", func(m *JSONMail) { m.Headers["X-Campaign"] = strings.Repeat("a", 990) }, ErrHeaderTooLong, "headers.X-Campaign"},
+
+		// Header names outside RFC 5322 ftext
+		{"empty header name", func(m *JSONMail) { m.Headers[""] = "x" }, ErrInvalidHeaderName, "headers."},
+		{"space in header name", func(m *JSONMail) { m.Headers["X Campaign"] = "x" }, ErrInvalidHeaderName, "headers.X Campaign"},
+		{"colon in header name", func(m *JSONMail) { m.Headers["X-Campaign:"] = "x" }, ErrInvalidHeaderName, "headers.X-Campaign:"},
+		{"CR in header name", func(m *JSONMail) { m.Headers["X-Campaign\r"] = "x" }, ErrInvalidHeaderName, "headers.X-Campaign\r"},
+		{"LF in header name", func(m *JSONMail) { m.Headers["Bcc: eve@evil.test\nX-A"] = "x" }, ErrInvalidHeaderName, "headers.Bcc: eve@evil.test\nX-A"},
+		{"NUL in header name", func(m *JSONMail) { m.Headers["X-\x00"] = "x" }, ErrInvalidHeaderName, "headers.X-\x00"},
+		{"non-ASCII header name", func(m *JSONMail) { m.Headers["X-Größe"] = "x" }, ErrInvalidHeaderName, "headers.X-Größe"},
+		{"long header name", func(m *JSONMail) { m.Headers["X-"+strings.Repeat("a", 80)] = "x" }, ErrInvalidHeaderName, "headers.X-" + strings.Repeat("a", 80)},
+		{"reserved header", func(m *JSONMail) { m.Headers["bcc"] = "eve@evil.test" }, ErrReservedHeader, "headers.bcc"},
+		{"reserved header, other case", func(m *JSONMail) { m.Headers["CONTENT-TYPE"] = "text/html" }, ErrReservedHeader, "headers.CONTENT-TYPE"},
+
+		// Single-instance headers given twice in different case
+		{"duplicate Reply-To", func(m *JSONMail) { m.Headers["reply-to"] = "other@example.com" }, ErrDuplicateHeader, "headers.reply-to"},
+		{"duplicate Message-ID", func(m *JSONMail) {
+			m.Headers["Message-ID"] = "<1@example.com>"
+			m.Headers["MESSAGE-ID"] = "<2@example.com>"
+		}, ErrDuplicateHeader, "headers.Message-ID"},
+		{"duplicate Date", func(m *JSONMail) {
+			m.Headers["Date"] = "Mon, 13 Oct 2025 09:00:00 +0000"
+			m.Headers["date"] = "Tue, 14 Oct 2025 09:00:00 +0000"
+		}, ErrDuplicateHeader, "headers.date"},
+		{"repeatable header in two cases", func(m *JSONMail) {
+			m.Headers["Keywords"] = "report"
+			m.Headers["keywords"] = "q3"
+		}, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := validMail()
+			tt.edit(m)
+			errs := validateJSONMail(m)
+			if tt.code == "" {
+				if errs != nil {
+					t.Fatalf("unexpected validation errors: %v", errs)
+				}
+				return
+			}
+			if len(errs) != 1 || errs[0].Code != tt.code || errs[0].Field != tt.field {
+				t.Fatalf("got %v, want a single %s error on %q", errs, tt.code, tt.field)
+			}
+		})
+	}
+}
+
+func TestValidateHeadersLimits(t *testing.T) {
+	headers := make(map[string]string)
+	for i := 0; i <= maxHeaderCount; i++ {
+		headers["X-H"+strings.Repeat("a", i%50)+string(rune('A'+i%26))+string(rune('A'+i/26))] = strings.Repeat("v", 400)
+	}
+	codes := make(map[ErrorCode]bool)
+	for _, err := range validateHeaders(headers) {
+		codes[err.Code] = true
+	}
+	if !codes[ErrTooManyHeaders] || !codes[ErrHeadersTooLarge] {
+		t.Errorf("got codes %v, want too_many_headers and headers_too_large", codes)
+	}
+}